@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ASDFToolVersionsFilename is the name of the file where asdf stores tool versions
+const ASDFToolVersionsFilename = ".tool-versions"
+
+// getASDFDataDir returns the asdf data directory if asdf is installed
+func getASDFDataDir() (string, bool) {
+	dataDir := os.Getenv("ASDF_DATA_DIR")
+	if dataDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", false
+		}
+		dataDir = path.Join(homeDir, ".asdf")
+	}
+
+	_, err := os.Stat(dataDir)
+	if err != nil {
+		if _, lookErr := exec.LookPath("asdf"); lookErr != nil {
+			return "", false
+		}
+	}
+	return dataDir, true
+}
+
+// findASDFToolVersionsFile looks for the .tool-versions file in the directory
+// and all its parents, the same way asdf does
+func findASDFToolVersionsFile(dir string) string {
+	for {
+		candidate := filepath.Join(dir, ASDFToolVersionsFilename)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return ""
+}
+
+// readASDFPythonVersions returns Python versions from the .tool-versions file
+// in order of preference
+func readASDFPythonVersions(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == "python" {
+			return fields[1:], nil
+		}
+	}
+	return nil, scanner.Err()
+}
+
+// isGenericPythonInterpreter checks if the interpreter from the shebang doesn't
+// select a specific Python: there is no shebang or it runs python or python3
+// from PATH. Only then the version selected with asdf is used
+func isGenericPythonInterpreter(interpreter string) bool {
+	return interpreter == "" || interpreter == "python" || interpreter == "python3"
+}
+
+// resolveASDFPython returns the Python interpreter selected for the directory
+// with asdf's .tool-versions file. An empty string is returned if asdf is not
+// installed, no version is selected or none of the selected versions is
+// installed
+func resolveASDFPython(dir string) string {
+	dataDir, ok := getASDFDataDir()
+	if !ok {
+		return ""
+	}
+
+	toolVersionsFile := findASDFToolVersionsFile(dir)
+	if toolVersionsFile == "" {
+		return ""
+	}
+
+	versions, err := readASDFPythonVersions(toolVersionsFile)
+	if err != nil {
+		if flagDebug {
+			loggerErr.Printf("Failed to read %s: %s\n", toolVersionsFile, err)
+		}
+		return ""
+	}
+
+	for _, version := range versions {
+		if version == "system" {
+			// Use the interpreter from PATH
+			return ""
+		}
+		interpreter := path.Join(dataDir, "installs", "python", version, "bin", "python")
+		if _, err := os.Stat(interpreter); err == nil {
+			if flagDebug {
+				loggerErr.Printf("Using asdf Python %s from %s\n", version, toolVersionsFile)
+			}
+			return interpreter
+		}
+		if flagDebug {
+			loggerErr.Printf("asdf Python %s from %s is not installed\n", version, toolVersionsFile)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// exitCodeError is returned when a command exited with a non-zero exit code.
+// If the script was run as a child process, invenv exits with the same code
+type exitCodeError struct {
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return fmt.Sprintf("exit code: %d", e.code)
+}
+
+// runChild runs the command as a child process (as opposed to replacing the
+// invenv process with syscall.Exec) and waits for it to finish. Signals
+// received by invenv are forwarded to the child process. onStart, if provided,
+// is called with the PID of the started child process
+func runChild(cmdSlice []string, cmdEnv []string, sysProcAttr *syscall.SysProcAttr, onStart func(pid int)) error {
+	childCmd := exec.Command(cmdSlice[0], cmdSlice[1:]...)
+	childCmd.Env = cmdEnv
+	childCmd.Stdin = os.Stdin
+	childCmd.Stdout = os.Stdout
+	childCmd.Stderr = os.Stderr
+	childCmd.SysProcAttr = sysProcAttr
+
+	// Signals are forwarded to the script from now on
+	stopSetupSignalHandler()
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signalChan)
+
+	err := childCmd.Start()
+	if err != nil {
+		return err
+	}
+	if onStart != nil {
+		onStart(childCmd.Process.Pid)
+	}
+
+	go func() {
+		for sig := range signalChan {
+			childCmd.Process.Signal(sig)
+		}
+	}()
+
+	err = childCmd.Wait()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return &exitCodeError{code: exitErr.ExitCode()}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// cleanCmd represents the clean command
+var cleanCmd = &cobra.Command{
+	Use:   "clean [env-id]",
+	Short: "remove virtual environments on demand",
+	Long: `Remove virtual environments from the environments directory. Virtual
+environments are selected with the ID and filters, all of which must match.
+At least one of them is required. Locked virtual environments and virtual
+environments used by a running process are never removed.`,
+	Example: `invenv clean --all
+invenv clean --older-than 7d --unused
+invenv clean --dry-run 2aEo8mjRuQBDqH`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		allFlag, err := cmd.Flags().GetBool("all")
+		if err != nil {
+			return err
+		}
+
+		olderThanFlag, err := cmd.Flags().GetString("older-than")
+		if err != nil {
+			return err
+		}
+
+		unusedFlag, err := cmd.Flags().GetBool("unused")
+		if err != nil {
+			return err
+		}
+
+		dryRunFlag, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+
+		envID := ""
+		if len(args) > 0 {
+			envID = args[0]
+		}
+		if !allFlag && olderThanFlag == "" && !unusedFlag && envID == "" {
+			return fmt.Errorf("no virtual environments selected, use an ID, --all, --older-than or --unused")
+		}
+
+		var olderThan time.Duration
+		if olderThanFlag != "" {
+			olderThan, err = parseAge(olderThanFlag)
+			if err != nil {
+				return fmt.Errorf("invalid --older-than: %s", err)
+			}
+		}
+
+		cmd.SilenceUsage = true
+
+		err = ensureCacheLayout()
+		if err != nil {
+			return err
+		}
+
+		envs, err := listEnvs()
+		if err != nil {
+			return err
+		}
+
+		removed := 0
+		for _, env := range envs {
+			if envID != "" && env.ID != envID {
+				continue
+			}
+			if olderThanFlag != "" && time.Since(env.LastUsedAt) <= olderThan {
+				continue
+			}
+			inUse := false
+			if _, err := findProcessWithPrefix(env.Dir); err != ErrNoProcessFound {
+				inUse = true
+			}
+			if unusedFlag && inUse {
+				continue
+			}
+
+			switch {
+			case isEnvLocked(env.Dir):
+				loggerErr.Printf("Skipping %s: locked\n", env.Dir)
+			case inUse:
+				loggerErr.Printf("Skipping %s: in use\n", env.Dir)
+			case dryRunFlag:
+				loggerOut.Printf("Would remove %s\n", env.Dir)
+				removed++
+			case removeUnusedEnv(env):
+				loggerOut.Printf("Removed %s\n", env.Dir)
+				removed++
+			default:
+				loggerErr.Printf("Failed to remove %s\n", env.Dir)
+			}
+		}
+
+		if dryRunFlag {
+			loggerErr.Printf("%d virtual environment(s) would be removed\n", removed)
+		} else {
+			loggerErr.Printf("Removed %d virtual environment(s)\n", removed)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cleanCmd)
+	cleanCmd.Flags().Bool("all", false, "select all virtual environments")
+	cleanCmd.Flags().String("older-than", "",
+		"select virtual environments not used for longer than the duration, e.g. 7d or 12h")
+	cleanCmd.Flags().Bool("unused", false,
+		"select virtual environments which are not used by a running process")
+	cleanCmd.Flags().Bool("dry-run", false, "print selected virtual environments without removing them")
+}
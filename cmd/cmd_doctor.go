@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// doctorCheck is the result of a single check of the doctor command. Failed
+// non-critical checks only disable optional features
+type doctorCheck struct {
+	name     string
+	err      error
+	detail   string
+	hint     string
+	critical bool
+}
+
+// runDoctorChecks checks the toolchain invenv depends on. The checks are
+// independent, so all of them are run even if some fail
+func runDoctorChecks(pythonOverride string) []*doctorCheck {
+	var checks []*doctorCheck
+
+	interpreterCheck := &doctorCheck{
+		name:     "Python interpreter",
+		hint:     "install Python 3 or select the interpreter with --python",
+		critical: true,
+	}
+	checks = append(checks, interpreterCheck)
+	var pythonInterpreter string
+	var wrapper []string
+	var err error
+	if pythonOverride != "" {
+		pythonInterpreter, wrapper, err = resolveInterpreterOverride(pythonOverride)
+	}
+	if err == nil && len(wrapper) == 0 {
+		pythonInterpreter, err = findPythonInterpreter(pythonInterpreter, pythonOverride != "")
+	}
+	if err == nil {
+		var version string
+		version, err = getPythonVersion(wrapper, pythonInterpreter)
+		interpreterCheck.detail = fmt.Sprintf("%s (%s)", pythonInterpreter, version)
+	}
+	interpreterCheck.err = err
+	if err != nil {
+		// Other checks require the interpreter
+		pythonInterpreter = ""
+	}
+
+	venvCheck := &doctorCheck{
+		name:     "venv module or virtualenv",
+		hint:     "install the venv module (python3-venv on Debian and Ubuntu) or virtualenv",
+		critical: true,
+	}
+	checks = append(checks, venvCheck)
+	if pythonInterpreter == "" {
+		venvCheck.err = fmt.Errorf("skipped, no Python interpreter")
+	} else {
+		name, args := wrapCommand(wrapper, pythonInterpreter, "-m", "venv", "--help")
+		if err := exec.Command(name, args...).Run(); err == nil {
+			venvCheck.detail = "venv module"
+		} else if virtualenvPath, err := exec.LookPath("virtualenv"); err == nil && len(wrapper) == 0 {
+			venvCheck.detail = virtualenvPath
+		} else {
+			venvCheck.err = fmt.Errorf("venv module is not available in %s and virtualenv is not installed", pythonInterpreter)
+		}
+	}
+
+	pipCheck := &doctorCheck{
+		name:     "pip",
+		hint:     "install pip for the interpreter (python3-pip on Debian and Ubuntu) or run python -m ensurepip",
+		critical: true,
+	}
+	checks = append(checks, pipCheck)
+	if pythonInterpreter == "" {
+		pipCheck.err = fmt.Errorf("skipped, no Python interpreter")
+	} else {
+		name, args := wrapCommand(wrapper, pythonInterpreter, "-m", "pip", "--version")
+		output, err := exec.Command(name, args...).Output()
+		if err != nil {
+			pipCheck.err = fmt.Errorf("%s -m pip --version failed: %s", pythonInterpreter, err)
+		} else {
+			pipCheck.detail = strings.TrimSpace(string(output))
+		}
+	}
+
+	envDirCheck := &doctorCheck{
+		name:     "Environments directory",
+		hint:     "fix the permissions of the directory or select another one with --env-dir",
+		critical: true,
+	}
+	checks = append(checks, envDirCheck)
+	envsDir, err := getEnvironmentDir()
+	if err == nil {
+		envDirCheck.detail = envsDir
+		err = os.MkdirAll(envsDir, 0755)
+		if err == nil {
+			err = checkDirWritable(envsDir)
+		}
+	}
+	envDirCheck.err = err
+
+	uvCheck := &doctorCheck{
+		name: "uv",
+		hint: "optional: install uv to create virtual environments faster and support uv projects",
+	}
+	checks = append(checks, uvCheck)
+	uvCheck.detail, uvCheck.err = exec.LookPath("uv")
+
+	processCheck := &doctorCheck{
+		name: "Process detection",
+		hint: "virtual environments which are in use can't be detected, so gc and clean may skip or remove them incorrectly",
+	}
+	checks = append(checks, processCheck)
+	if !processDetectionSupported {
+		processCheck.err = fmt.Errorf("not supported on %s", runtime.GOOS)
+	} else if runtime.GOOS == "linux" {
+		_, err := os.ReadDir("/proc")
+		if err != nil {
+			processCheck.err = err
+		} else {
+			processCheck.detail = "/proc is readable"
+		}
+	}
+
+	return checks
+}
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "check that the tools invenv depends on are available",
+	Long: `Check that the tools invenv depends on are available: a Python interpreter,
+the venv module or virtualenv, pip and a writable environments directory. Optional
+features (uv, process detection) are checked as well. Exits with a non-zero
+exit code if a required check fails.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		pythonFlag, err := cmd.Flags().GetString("python")
+		if err != nil {
+			return err
+		}
+
+		failed := 0
+		for _, check := range runDoctorChecks(pythonFlag) {
+			if check.err == nil {
+				if check.detail != "" {
+					loggerOut.Printf("PASS  %s: %s\n", check.name, check.detail)
+				} else {
+					loggerOut.Printf("PASS  %s\n", check.name)
+				}
+				continue
+			}
+			status := "WARN"
+			if check.critical {
+				status = "FAIL"
+				failed++
+			}
+			loggerOut.Printf("%s  %s: %s\n", status, check.name, check.err)
+			loggerOut.Printf("      %s\n", check.hint)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d required checks failed", failed)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	doctorCmd.Flags().StringP("python", "p", "", "check the specified Python interpreter instead of the default one")
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/spf13/cobra"
+)
+
+// freezeCmd represents the freeze command
+var freezeCmd = &cobra.Command{
+	Use:   "freeze [invenv-flags] -- python-script.py",
+	Short: "print packages installed in the virtual environment of the script",
+	Long: `Print packages installed in the virtual environment of the script in the
+requirements file format (pip freeze). The output can be used as a pinned
+requirements file to reproduce the virtual environment.`,
+	Example: `invenv freeze -- somepath/myscript.py
+invenv freeze --output requirements.lock -- somepath/myscript.py`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		requirementsFileFlag, err := cmd.Flags().GetString("requirements-file")
+		if err != nil {
+			return err
+		}
+
+		pythonFlag, err := cmd.Flags().GetString("python")
+		if err != nil {
+			return err
+		}
+
+		outputFlag, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+
+		ensureFlag, err := cmd.Flags().GetBool("ensure")
+		if err != nil {
+			return err
+		}
+
+		err = ensureCacheLayout()
+		if err != nil {
+			return err
+		}
+
+		printProgress("Gathering information about script and environment...")
+		script, err := NewScript(args[0], pythonFlag, requirementsFileFlag)
+		if err != nil {
+			return err
+		}
+
+		if ensureFlag {
+			printProgress("Ensuring virtual environment...")
+			err = script.EnsureEnv(false)
+			if err != nil {
+				return err
+			}
+		} else if _, err := os.Stat(script.EnvDir); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("virtual environment %s doesn't exist, run the script first or use --ensure", script.EnvDir)
+			}
+			return err
+		}
+
+		if !flagDebug {
+			// Clear all progress messages
+			printProgress("")
+		}
+
+		name, pipArgs := script.wrapCommand(venvBinPath(script.EnvDir, "pip"), "freeze")
+		// execCmdSilent discards the output of successful commands
+		output, err := exec.Command(name, pipArgs...).Output()
+		if err != nil {
+			return fmt.Errorf("failed to list installed packages: %s", err)
+		}
+
+		if outputFlag != "" {
+			err = os.WriteFile(outputFlag, output, 0644)
+			if err != nil {
+				return err
+			}
+			if flagDebug {
+				loggerErr.Printf("Wrote installed packages to %s\n", outputFlag)
+			}
+			return nil
+		}
+		loggerOut.Print(string(output))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(freezeCmd)
+	freezeCmd.Flags().StringP("requirements-file", "r", "",
+		`use specified requirements file. If not provided, it
+will try to guess the requirements file name`)
+	freezeCmd.Flags().StringP("python", "p", "",
+		`use specified Python interpreter. Use py:<tag> (e.g.
+py:-3.11) to select it with the Python launcher for Windows`)
+	freezeCmd.Flags().StringP("output", "o", "", "write installed packages to the file instead of STDOUT")
+	freezeCmd.Flags().Bool("ensure", false, "create the virtual environment with installed requirements if it doesn't exist")
+}
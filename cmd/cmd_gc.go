@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// gcCmd represents the gc command
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "remove stale virtual environments",
+	Long: `Remove virtual environments according to the policy from the gc section of
+the configuration file (see README). Flags override the configuration file.
+
+By default virtual environments which were not used for a long time are
+removed, the same cleanup runs automatically every time a script is started.
+With --max-size, least recently used virtual environments are removed until
+the total size fits. With --prune-broken, virtual environments whose Python
+interpreter is missing or doesn't run (e.g. left behind by an interrupted
+build) are removed as well, regardless of their age. Temporary directories
+left by builds which were killed are removed when they are older than an
+hour. Locked virtual
+environments, virtual environments used by a running process and the ones
+from --keep are never removed.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		config, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		policy, err := newGCPolicy(&config.GC)
+		if err != nil {
+			return err
+		}
+
+		if cmd.Flags().Changed("max-age") {
+			maxAgeFlag, err := cmd.Flags().GetString("max-age")
+			if err != nil {
+				return err
+			}
+			policy.MaxAge, err = parseAge(maxAgeFlag)
+			if err != nil {
+				return fmt.Errorf("invalid --max-age: %s", err)
+			}
+		}
+		if cmd.Flags().Changed("max-size") {
+			maxSizeFlag, err := cmd.Flags().GetString("max-size")
+			if err != nil {
+				return err
+			}
+			policy.MaxSize, err = parseSize(maxSizeFlag)
+			if err != nil {
+				return fmt.Errorf("invalid --max-size: %s", err)
+			}
+		}
+		if cmd.Flags().Changed("keep") {
+			policy.KeepNamed, err = cmd.Flags().GetStringSlice("keep")
+			if err != nil {
+				return err
+			}
+		}
+		if cmd.Flags().Changed("prune-broken") {
+			policy.PruneBroken, err = cmd.Flags().GetBool("prune-broken")
+			if err != nil {
+				return err
+			}
+		}
+
+		err = ensureCacheLayout()
+		if err != nil {
+			return err
+		}
+
+		removed, err := clearEnvsOlderThan(policy.MaxAge, policy.KeepNamed)
+		if err != nil {
+			return err
+		}
+		loggerErr.Printf("Removed %d stale virtual environment(s)\n", removed)
+
+		removed, err = removeOrphanedTempDirs(OrphanedTempDirAge)
+		if err != nil {
+			return err
+		}
+		if removed > 0 {
+			loggerErr.Printf("Removed %d leftover temporary build directories\n", removed)
+		}
+
+		if policy.PruneBroken {
+			removed, err = pruneBrokenEnvs(policy.KeepNamed)
+			if err != nil {
+				return err
+			}
+			loggerErr.Printf("Removed %d broken virtual environment(s)\n", removed)
+		}
+
+		if policy.MaxSize > 0 {
+			removed, err = evictEnvsOverSize(policy.MaxSize, policy.KeepNamed)
+			if err != nil {
+				return err
+			}
+			loggerErr.Printf("Removed %d least recently used virtual environment(s)\n", removed)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+	gcCmd.Flags().String("max-age", "",
+		`remove virtual environments which were not used for longer
+than this, e.g. 36h or 14d. Defaults to --stale-after`)
+	gcCmd.Flags().String("max-size", "",
+		`remove least recently used virtual environments until their
+total size fits, e.g. 10GB`)
+	gcCmd.Flags().StringSlice("keep", nil,
+		"comma-separated list of IDs of virtual environments to never remove")
+	gcCmd.Flags().Bool("prune-broken", false,
+		`also remove virtual environments without a working Python
+interpreter, regardless of their age`)
+}
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// EnvInfoItem describes the virtual environment of a script in the output of
+// the info command. Size, BuiltAt and LastUsedAt are empty if the virtual
+// environment doesn't exist or they are unknown
+type EnvInfoItem struct {
+	Script             string     `json:"script"`
+	PythonInterpreter  string     `json:"python_interpreter"`
+	PythonVersion      string     `json:"python_version"`
+	Backend            string     `json:"backend"`
+	RequirementsSource string     `json:"requirements_source"`
+	RequirementsFile   string     `json:"requirements_file"`
+	RequirementsHash   string     `json:"requirements_hash"`
+	ConstraintsFile    string     `json:"constraints_file"`
+	ID                 string     `json:"id"`
+	Dir                string     `json:"dir"`
+	Exists             bool       `json:"exists"`
+	Locked             bool       `json:"locked"`
+	Size               int64      `json:"size,omitempty"`
+	BuiltAt            *time.Time `json:"built_at,omitempty"`
+	LastUsedAt         *time.Time `json:"last_used_at,omitempty"`
+}
+
+// infoCmd represents the info command
+var infoCmd = &cobra.Command{
+	Use:   "info [invenv-flags] -- python-script.py",
+	Short: "describe the virtual environment of the script",
+	Long: `Describe the virtual environment of the script: the Python interpreter, the
+requirements file, the virtual environment ID and directory, and, if the
+virtual environment exists, its size, age and lock status. Nothing is created.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		requirementsFileFlag, err := cmd.Flags().GetString("requirements-file")
+		if err != nil {
+			return err
+		}
+
+		pythonFlag, err := cmd.Flags().GetString("python")
+		if err != nil {
+			return err
+		}
+
+		jsonFlag, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			return err
+		}
+
+		err = checkCacheLayoutReadOnly()
+		if err != nil {
+			return err
+		}
+
+		printProgress("Gathering information about script and environment...")
+		script, err := NewScript(args[0], pythonFlag, requirementsFileFlag)
+		if err != nil {
+			return err
+		}
+		if !flagDebug {
+			// Clear all progress messages
+			printProgress("")
+		}
+
+		// Python of a conda environment is installed when it is created
+		interpreterPath := venvBinPath(script.EnvDir, "python")
+		if script.backend != BackendConda {
+			interpreterPath, err = getInterpreterPath(script.interpreterWrapper, script.PythonInterpreter)
+			if err != nil {
+				return err
+			}
+		}
+		item := &EnvInfoItem{
+			Script:             script.AbsolutePath,
+			PythonInterpreter:  interpreterPath,
+			PythonVersion:      script.pythonVersion,
+			Backend:            script.backend,
+			RequirementsSource: script.requirementsSource,
+			RequirementsFile:   script.RequirementsPath,
+			RequirementsHash:   script.requirementsHash,
+			ConstraintsFile:    script.ConstraintsPath,
+			ID:                 script.venvID,
+			Dir:                script.EnvDir,
+		}
+		if item.RequirementsSource == RequirementsSourcePip {
+			item.RequirementsSource = "pip"
+		}
+		if _, err := os.Stat(script.EnvDir); err == nil {
+			item.Exists = true
+			item.Locked = isEnvLocked(script.EnvDir)
+			item.Size, err = getDirSize(script.EnvDir)
+			if err != nil && flagDebug {
+				loggerErr.Println(err)
+			}
+			builtAt, err := script.getLastBuildTime()
+			if err == nil {
+				item.BuiltAt = &builtAt
+			} else if flagDebug {
+				loggerErr.Println(err)
+			}
+			if index, err := loadEnvIndex(); err == nil {
+				if entry, ok := index.Envs[script.EnvDir]; ok {
+					item.LastUsedAt = &entry.LastUsedAt
+				}
+			}
+		}
+
+		if jsonFlag {
+			dataBytes, err := json.MarshalIndent(item, "", "  ")
+			if err != nil {
+				return err
+			}
+			loggerOut.Println(string(dataBytes))
+			return nil
+		}
+
+		report := func(name string, value string) {
+			loggerOut.Printf("%-20s %s\n", name+":", value)
+		}
+		report("Script", item.Script)
+		report("Python interpreter", item.PythonInterpreter)
+		report("Python version", item.PythonVersion)
+		report("Backend", item.Backend)
+		if item.RequirementsFile == "" {
+			report("Requirements file", "none")
+		} else {
+			report("Requirements file", fmt.Sprintf("%s (%s)", item.RequirementsFile, item.RequirementsSource))
+			report("Requirements hash", item.RequirementsHash)
+		}
+		if item.ConstraintsFile != "" {
+			report("Constraints file", item.ConstraintsFile)
+		}
+		report("Environment ID", item.ID)
+		report("Environment", item.Dir)
+		if !item.Exists {
+			report("Exists", "no")
+			return nil
+		}
+		report("Exists", "yes")
+		report("Size", fmt.Sprintf("%d bytes", item.Size))
+		if item.BuiltAt != nil {
+			report("Built", fmt.Sprintf("%s (%s ago)", item.BuiltAt.Format(time.RFC3339), time.Since(*item.BuiltAt).Round(time.Second)))
+		}
+		if item.LastUsedAt != nil {
+			report("Last used", item.LastUsedAt.Format(time.RFC3339))
+		}
+		if item.Locked {
+			report("Lock", "locked")
+		} else {
+			report("Lock", "unlocked")
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(infoCmd)
+	infoCmd.Flags().StringP("requirements-file", "r", "",
+		`use specified requirements file. If not provided, it
+will try to guess the requirements file name`)
+	infoCmd.Flags().StringP("python", "p", "",
+		`use specified Python interpreter. Use py:<tag> (e.g.
+py:-3.11) to select it with the Python launcher for Windows`)
+	infoCmd.Flags().Bool("json", false, "print information in JSON format")
+}
@@ -15,7 +15,9 @@ var initCmd = &cobra.Command{
 	Short: "initialize a virtual environment in the current directory",
 	Long: `Initialize a virtual environment in the current directory in .venv directory.
 If requirements.txt or similar file is present, it will automatically
-install the dependenciesfrom it.`,
+install the dependenciesfrom it. If uv is installed, uv projects are
+supported as well: uv.lock is installed with "uv sync --frozen", a project
+with only pyproject.toml is resolved from scratch.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cmd.SilenceUsage = true
 
@@ -29,17 +31,31 @@ install the dependenciesfrom it.`,
 			return err
 		}
 
+		promptFlag, err := cmd.Flags().GetString("prompt")
+		if err != nil {
+			return err
+		}
+
 		deleteOldEnvFlag, err := cmd.Flags().GetBool("new-environment")
 		if err != nil {
 			return err
 		}
 
+		venvDirFlag, err := cmd.Flags().GetString("venv-dir")
+		if err != nil {
+			return err
+		}
+
 		printProgress("Gathering information about script and environment...")
-		script, err := NewInitCmd(pythonFlag, requirementsFileFlag)
+		script, err := NewInitCmd(pythonFlag, requirementsFileFlag, venvDirFlag)
 		if err != nil {
 			return err
 		}
 
+		if promptFlag != "" {
+			script.Prompt = promptFlag
+		}
+
 		printProgress("Ensuring virtual environment...")
 		err = script.EnsureEnv(deleteOldEnvFlag)
 		if err != nil {
@@ -65,6 +81,21 @@ func init() {
 	initCmd.Flags().StringP("requirements-file", "r", "",
 		`use specified requirements file. If not provided, it
 will use requirements.txt`)
-	initCmd.Flags().StringP("python", "p", "", "use specified Python interpreter")
+	initCmd.Flags().StringP("python", "p", "",
+		`use specified Python interpreter. A bare version (e.g. 3.11)
+is resolved to python3.11, py -3.11 on Windows or pyenv. Use
+py:<tag> (e.g. py:-3.11) to select it with the Python
+launcher for Windows or pyenv:<version> (e.g. pyenv:3.11.8)
+to select the version installed with pyenv.
+A command (e.g. "docker run --rm -i image python") runs the
+interpreter with a wrapper, see README for details`)
+	initCmd.Flags().String("prompt", "",
+		`prompt prefix of the activated virtual environment. Defaults
+to the current directory name`)
 	initCmd.Flags().BoolP("new-environment", "n", false, "create a new virtual environment even if it already exists")
+	initCmd.Flags().String("venv-dir", "",
+		`create the virtual environment in the specified directory
+instead of .venv, e.g. if the current directory is not
+writable. The location is remembered for the current
+directory`)
 }
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// EnvListItem describes a virtual environment in the output of the list command
+type EnvListItem struct {
+	ID               string    `json:"id"`
+	Dir              string    `json:"dir"`
+	Size             int64     `json:"size"`
+	ModifiedAt       time.Time `json:"modified_at"`
+	Locked           bool      `json:"locked"`
+	RequirementsHash string    `json:"requirements_hash"`
+	PythonVersion    string    `json:"python_version"`
+}
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "show all virtual environments managed by invenv",
+	Long: `Show all virtual environments in the environments directory: their ID, size on
+disk, last modification time, whether they are locked, the Python version and
+the requirements hash. The Python version and the requirements hash are empty
+if they are unknown.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		jsonFlag, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			return err
+		}
+
+		err = checkCacheLayoutReadOnly()
+		if err != nil {
+			return err
+		}
+
+		envs, err := listEnvs()
+		if err != nil {
+			if os.IsNotExist(err) {
+				envs = nil
+			} else {
+				return err
+			}
+		}
+
+		items := []*EnvListItem{}
+		for _, env := range envs {
+			info, err := os.Stat(env.Dir)
+			if err != nil {
+				if flagDebug {
+					loggerErr.Println(err)
+				}
+				continue
+			}
+			// The size is recorded in the index when the virtual environment
+			// is built, walk the directory only for unindexed ones
+			size := env.Size
+			if size == 0 {
+				size, err = getDirSize(env.Dir)
+				if err != nil && flagDebug {
+					loggerErr.Println(err)
+				}
+			}
+			items = append(items, &EnvListItem{
+				ID:               env.ID,
+				Dir:              env.Dir,
+				Size:             size,
+				ModifiedAt:       info.ModTime(),
+				Locked:           isEnvLocked(env.Dir),
+				RequirementsHash: env.RequirementsHash,
+				PythonVersion:    env.PythonVersion,
+			})
+		}
+
+		if jsonFlag {
+			dataBytes, err := json.MarshalIndent(items, "", "  ")
+			if err != nil {
+				return err
+			}
+			loggerOut.Println(string(dataBytes))
+			return nil
+		}
+
+		if len(items) == 0 {
+			loggerErr.Println("No virtual environments found")
+			return nil
+		}
+		for _, item := range items {
+			state := "unlocked"
+			if item.Locked {
+				state = "locked"
+			}
+			loggerOut.Printf("%s\t%d\t%s\t%s\t%s\t%s\n",
+				item.ID, item.Size, item.ModifiedAt.Format(time.RFC3339), state, item.PythonVersion, item.RequirementsHash)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+	listCmd.Flags().Bool("json", false, "print virtual environments in JSON format")
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune --max-size SIZE",
+	Short: "remove least recently used virtual environments until they fit the size",
+	Long: `Remove least recently used virtual environments until the total size of the
+environments directory is under the limit. Locked virtual environments, virtual
+environments used by a running process and the ones from keep_named in the
+configuration file are never removed.`,
+	Example: `invenv prune --max-size 10GB`,
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		maxSizeFlag, err := cmd.Flags().GetString("max-size")
+		if err != nil {
+			return err
+		}
+		if maxSizeFlag == "" {
+			cmd.SilenceUsage = false
+			return fmt.Errorf("--max-size is required")
+		}
+		maxSize, err := parseSize(maxSizeFlag)
+		if err != nil {
+			return fmt.Errorf("invalid --max-size: %s", err)
+		}
+
+		config, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		err = ensureCacheLayout()
+		if err != nil {
+			return err
+		}
+
+		removed, err := evictEnvsOverSize(maxSize, config.GC.KeepNamed)
+		if err != nil {
+			return err
+		}
+		loggerErr.Printf("Removed %d least recently used virtual environment(s)\n", removed)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+	pruneCmd.Flags().String("max-size", "", "maximal total size of virtual environments, e.g. 10GB")
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/spf13/cobra"
+)
+
+// EnvProcessesItem describes processes which use a virtual environment in the
+// output of the ps command
+type EnvProcessesItem struct {
+	ID        string         `json:"id"`
+	Dir       string         `json:"dir"`
+	Locked    bool           `json:"locked"`
+	Processes []*ProcessInfo `json:"processes"`
+}
+
+// psCmd represents the ps command
+var psCmd = &cobra.Command{
+	Use:   "ps [env-id]",
+	Short: "show processes which use virtual environments",
+	Long: `Show all processes which use virtual environments managed by invenv: the
+virtual environment ID, the PID and the command line of each process. Virtual
+environments which are used by a process are skipped by gc and clean, so this
+command helps to find out why a virtual environment is not removed. Only
+virtual environments which are in use are shown, unless the ID is provided.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		jsonFlag, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			return err
+		}
+
+		if !processDetectionSupported {
+			return fmt.Errorf("detecting processes is not supported on %s", runtime.GOOS)
+		}
+
+		err = checkCacheLayoutReadOnly()
+		if err != nil {
+			return err
+		}
+
+		envs, err := listEnvs()
+		if err != nil {
+			if os.IsNotExist(err) {
+				envs = nil
+			} else {
+				return err
+			}
+		}
+
+		items := []*EnvProcessesItem{}
+		for _, env := range envs {
+			if len(args) > 0 && env.ID != args[0] {
+				continue
+			}
+			processes, err := findProcessesWithPrefix(env.Dir)
+			if err != nil {
+				return err
+			}
+			if len(processes) == 0 && len(args) == 0 {
+				continue
+			}
+			if processes == nil {
+				processes = []*ProcessInfo{}
+			}
+			items = append(items, &EnvProcessesItem{
+				ID:        env.ID,
+				Dir:       env.Dir,
+				Locked:    isEnvLocked(env.Dir),
+				Processes: processes,
+			})
+		}
+		if len(args) > 0 && len(items) == 0 {
+			return fmt.Errorf("virtual environment %s not found", args[0])
+		}
+
+		if jsonFlag {
+			dataBytes, err := json.MarshalIndent(items, "", "  ")
+			if err != nil {
+				return err
+			}
+			loggerOut.Println(string(dataBytes))
+			return nil
+		}
+
+		found := false
+		for _, item := range items {
+			for _, process := range item.Processes {
+				found = true
+				loggerOut.Printf("%s\t%d\t%s\n", item.ID, process.PID, process.Command)
+			}
+		}
+		if !found {
+			loggerErr.Println("No processes use virtual environments")
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(psCmd)
+	psCmd.Flags().Bool("json", false, "print processes in JSON format")
+}
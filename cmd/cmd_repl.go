@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// replCmd represents the repl command
+var replCmd = &cobra.Command{
+	Use:   "repl [invenv-flags] [-- python-script.py]",
+	Short: "start an interactive Python interpreter in a virtual environment",
+	Long: `Start an interactive Python interpreter in the virtual environment of the
+script. If no script is provided, the virtual environment is based on the
+requirements file in the current directory or the one provided with -r.`,
+	Example: `invenv repl -- somepath/myscript.py
+invenv repl -r req.txt
+invenv repl --ipython -r req.txt
+invenv repl --bpython -r req.txt`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		requirementsFileFlag, err := cmd.Flags().GetString("requirements-file")
+		if err != nil {
+			return err
+		}
+
+		pythonFlag, err := cmd.Flags().GetString("python")
+		if err != nil {
+			return err
+		}
+
+		deleteOldEnvFlag, err := cmd.Flags().GetBool("new-environment")
+		if err != nil {
+			return err
+		}
+
+		ipythonFlag, err := cmd.Flags().GetBool("ipython")
+		if err != nil {
+			return err
+		}
+
+		bpythonFlag, err := cmd.Flags().GetBool("bpython")
+		if err != nil {
+			return err
+		}
+		if ipythonFlag && bpythonFlag {
+			return fmt.Errorf("--ipython and --bpython can't be used together")
+		}
+
+		err = ensureCacheLayout()
+		if err != nil {
+			return err
+		}
+
+		printProgress("Removing stale environments...")
+		_, err = clearStaleEnvs()
+		if err != nil {
+			loggerErr.Printf("Warning: failed to remove stale environments: %s\n", err)
+		}
+
+		printProgress("Gathering information about script and environment...")
+		var script *Script
+		if len(args) > 0 {
+			script, err = NewScript(args[0], pythonFlag, requirementsFileFlag)
+		} else {
+			var cwd string
+			cwd, err = os.Getwd()
+			if err != nil {
+				return err
+			}
+			script, err = NewDirScript(cwd, pythonFlag, requirementsFileFlag)
+		}
+		if err != nil {
+			return err
+		}
+
+		printProgress("Ensuring virtual environment...")
+		err = script.EnsureEnv(deleteOldEnvFlag)
+		if err != nil {
+			return err
+		}
+
+		printProgress("Done! Starting interpreter...")
+		if !flagDebug {
+			// Clear all progress messages
+			printProgress("")
+		}
+
+		interpreter := venvBinPath(script.EnvDir, "python")
+		if ipythonFlag {
+			interpreter = getReplInterpreter(script.EnvDir, "ipython", "IPython")
+		} else if bpythonFlag {
+			interpreter = getReplInterpreter(script.EnvDir, "bpython", "bpython")
+		}
+
+		// Flush the buffers to preserve the output order and avoid interference
+		// between the interpreter output and the invenv output
+		os.Stderr.Sync()
+		os.Stdout.Sync()
+
+		name, args := script.wrapCommand(interpreter)
+		cmdSlice := append([]string{name}, args...)
+
+		if runtime.GOOS == "windows" {
+			// Windows doesn't support syscall.Exec
+			err = runChild(cmdSlice, os.Environ(), nil, nil)
+			var exitErr *exitCodeError
+			if errors.As(err, &exitErr) {
+				cmd.SilenceErrors = true
+			}
+			return err
+		}
+		executable, err := exec.LookPath(name)
+		if err != nil {
+			return err
+		}
+		stopSetupSignalHandler()
+		return syscall.Exec(executable, cmdSlice, os.Environ())
+	},
+}
+
+// getReplInterpreter returns the executable of the alternative interactive
+// interpreter (e.g. ipython) in the virtual environment. python is returned if
+// it is not installed
+func getReplInterpreter(envDir string, executable string, name string) string {
+	interpreter := venvBinPath(envDir, executable)
+	if _, err := os.Stat(interpreter); err == nil {
+		return interpreter
+	}
+	loggerErr.Printf("%s is not installed in the virtual environment, starting python\n", name)
+	return venvBinPath(envDir, "python")
+}
+
+func init() {
+	rootCmd.AddCommand(replCmd)
+	replCmd.Flags().StringP("requirements-file", "r", "",
+		`use specified requirements file. If not provided, it
+will try to guess the requirements file name`)
+	replCmd.Flags().StringP("python", "p", "",
+		`use specified Python interpreter. A bare version (e.g. 3.11)
+is resolved to python3.11, py -3.11 on Windows or pyenv. Use
+py:<tag> (e.g. py:-3.11) to select it with the Python
+launcher for Windows or pyenv:<version> (e.g. pyenv:3.11.8)
+to select the version installed with pyenv.
+A command (e.g. "docker run --rm -i image python") runs the
+interpreter with a wrapper, see README for details`)
+	replCmd.Flags().BoolP("new-environment", "n", false, "create a new virtual environment even if it already exists")
+	replCmd.Flags().Bool("ipython", false, "start IPython instead of python if it is installed in the virtual environment")
+	replCmd.Flags().Bool("bpython", false, "start bpython instead of python if it is installed in the virtual environment")
+}
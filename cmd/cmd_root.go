@@ -4,17 +4,65 @@ Copyright © 2023 YAUHEN SHULITSKI <jsnjack@gmail.com>
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"path"
+	"os/exec"
+	"runtime"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 var flagDebug bool
 var flagSilent bool
+var flagPlatformRequirements bool
+var flagParallelInstall bool
+var flagMaxRequirementsSize string
+var flagMaxRequirementsLines int
+var flagInstallStallTimeout time.Duration
+var flagAbortOnStall bool
+var flagKeepLockOnExit bool
+var flagRequirementsOrder []string
+var flagUpgradeDeps bool
+var flagExplainRequirements bool
+var flagIncremental bool
+var flagExtras []string
+var flagAllowUnlocked bool
+var flagCondaEnvFile string
+var flagExactHash bool
+var flagBackend string
+var flagPythonFallback []string
+var flagStaleAfter string
+var flagNoCleanup bool
+var flagRefreshInterval string
+var flagEnvDir string
+var flagResolveForID bool
+var flagConstraints string
+var flagPythonCheckCommand string
+var flagStrictPython bool
+var flagLockAttempts int
+var flagLockInterval time.Duration
+var flagLockStaleTime time.Duration
+var flagLockTimeout time.Duration
+var flagSystemSitePackages bool
+var flagHashSystemSitePackages bool
+var flagNotify bool
+var flagNotifyAfter time.Duration
+var flagNotifyCommand string
+var flagColor string
+var flagNoColor bool
+var flagLogFormat string
+var flagVerify bool
+var flagRequirementsTimeout time.Duration
+var flagIndexURL string
+var flagExtraIndexURLs []string
+var flagHashIndex bool
+var flagPipArgs []string
+var flagShowInstall bool
 var Version = "dev"
 
 var loggerErr = log.New(os.Stderr, "", 0)
@@ -25,8 +73,28 @@ var rootCmd = &cobra.Command{
 	Use: "invenv [invenv-flags] -- [VAR=val] python-script.py",
 	Example: `invenv -- somepath/myscript.py
 invenv -n -- somepath/myscript.py --version
-invenv -r req.txt -- DEBUG=1 somepath/myscript.py`,
+invenv -r req.txt -- DEBUG=1 somepath/myscript.py
+echo 'print("hi")' | invenv --stdin -r req.txt -- DEBUG=1 --verbose`,
 	Short: "a tool to automatically create and run your Python scripts in a virtual environment with installed dependencies. See https://github.com/jsnjack/invenv",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		handleSetupSignals()
+
+		// Fail early instead of silently skipping the cleanup of stale
+		// virtual environments
+		_, err := getStaleEnvironmentTime()
+		if err != nil {
+			return err
+		}
+		_, err = getRefreshInterval()
+		if err != nil {
+			return err
+		}
+		err = setupLogFormat(cmd.Root(), os.Stderr)
+		if err != nil {
+			return err
+		}
+		return validateColorFlag()
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cmd.SilenceUsage = true
 
@@ -46,6 +114,21 @@ invenv -r req.txt -- DEBUG=1 somepath/myscript.py`,
 			return err
 		}
 
+		whichPythonFlag, err := cmd.Flags().GetBool("which-python")
+		if err != nil {
+			return err
+		}
+
+		ensureFlag, err := cmd.Flags().GetBool("ensure")
+		if err != nil {
+			return err
+		}
+
+		buildOnlyFlag, err := cmd.Flags().GetBool("build-only")
+		if err != nil {
+			return err
+		}
+
 		requirementsFileFlag, err := cmd.Flags().GetString("requirements-file")
 		if err != nil {
 			return err
@@ -56,47 +139,247 @@ invenv -r req.txt -- DEBUG=1 somepath/myscript.py`,
 			return err
 		}
 
+		promptFlag, err := cmd.Flags().GetString("prompt")
+		if err != nil {
+			return err
+		}
+
+		dropPrivilegesFlag, err := cmd.Flags().GetString("drop-privileges")
+		if err != nil {
+			return err
+		}
+
+		envIDFromFlag, err := cmd.Flags().GetString("env-id-from")
+		if err != nil {
+			return err
+		}
+
+		recordRunFlag, err := cmd.Flags().GetBool("record-run")
+		if err != nil {
+			return err
+		}
+
+		envFileFlag, err := cmd.Flags().GetString("env-file")
+		if err != nil {
+			return err
+		}
+
+		envFileFormatFlag, err := cmd.Flags().GetString("env-file-format")
+		if err != nil {
+			return err
+		}
+
+		validateFlag, err := cmd.Flags().GetBool("validate")
+		if err != nil {
+			return err
+		}
+
+		dryRunFlag, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+		// --dry-run runs the same checks as --validate
+		validateFlag = validateFlag || dryRunFlag
+		validateOnly = validateFlag
+		if validateFlag && flagResolveForID {
+			return fmt.Errorf("--resolve-for-id can't be used with --validate or --dry-run, it resolves requirements with uv or pip-compile")
+		}
+		if validateFlag && flagHashSystemSitePackages {
+			return fmt.Errorf("--hash-system-site-packages can't be used with --validate or --dry-run, it runs pip to list the packages")
+		}
+
+		planInstallFlag, err := cmd.Flags().GetBool("plan-install")
+		if err != nil {
+			return err
+		}
+
+		trustCacheFlag, err := cmd.Flags().GetBool("trust-cache")
+		if err != nil {
+			return err
+		}
+
+		rebuildCooldownFlag, err := cmd.Flags().GetDuration("rebuild-cooldown")
+		if err != nil {
+			return err
+		}
+
+		stdinFlag, err := cmd.Flags().GetBool("stdin")
+		if err != nil {
+			return err
+		}
+
+		afterRunFlag, err := cmd.Flags().GetString("after-run")
+		if err != nil {
+			return err
+		}
+
+		deterministicFlag, err := cmd.Flags().GetBool("deterministic")
+		if err != nil {
+			return err
+		}
+
+		pythonHashSeedFlag, err := cmd.Flags().GetString("python-hash-seed")
+		if err != nil {
+			return err
+		}
+
+		dontWriteBytecodeFlag, err := cmd.Flags().GetBool("dont-write-bytecode")
+		if err != nil {
+			return err
+		}
+
+		unbufferedFlag, err := cmd.Flags().GetBool("unbuffered")
+		if err != nil {
+			return err
+		}
+
+		if deterministicFlag {
+			// --deterministic only changes defaults, so each setting can
+			// still be turned off, e.g. with --unbuffered=false
+			if !cmd.Flags().Changed("python-hash-seed") {
+				pythonHashSeedFlag = DeterministicPythonHashSeed
+			}
+			if !cmd.Flags().Changed("dont-write-bytecode") {
+				dontWriteBytecodeFlag = true
+			}
+			if !cmd.Flags().Changed("unbuffered") {
+				unbufferedFlag = true
+			}
+		}
+		determinismEnv, err := getDeterminismEnv(pythonHashSeedFlag, dontWriteBytecodeFlag, unbufferedFlag)
+		if err != nil {
+			return err
+		}
+
 		if versionFlag {
 			loggerOut.Println(Version)
 			return nil
 		}
 
-		if len(args) == 0 {
+		if len(args) == 0 && !stdinFlag {
 			cmd.SilenceUsage = false
 			return fmt.Errorf("no script name provided")
 		}
 
-		envVars, scriptName, scriptArgs := organizeArgs(args)
+		envVars, scriptName, scriptArgs, err := organizeArgs(args)
+		if err != nil {
+			return err
+		}
+		if stdinFlag {
+			// All arguments except environment variables are passed to the
+			// script read from STDIN
+			if scriptName != "" {
+				scriptArgs = append([]string{scriptName}, scriptArgs...)
+			}
+			var cleanup func()
+			scriptName, cleanup, err = writeStdinScript()
+			if err != nil {
+				return fmt.Errorf("failed to read script from STDIN: %s", err)
+			}
+			defer cleanup()
+		}
 		if scriptName == "" {
 			cmd.SilenceUsage = false
 			return fmt.Errorf("no script name provided")
 		}
-
-		printProgress("Removing stale environments...")
-		err = clearStaleEnvs()
-		if flagDebug && err != nil {
-			loggerErr.Println(err)
+		if _, err := os.Stat(scriptName); os.IsNotExist(err) {
+			// Most likely a mistyped environment variable, e.g. DEBUG 1
+			// instead of DEBUG=1
+			return fmt.Errorf("script %s doesn't exist. Environment variables must be passed as NAME=value before the script name, check the order of the arguments", scriptName)
 		}
 
-		printProgress("Gathering information about script and environment...")
-		script, err := NewScript(scriptName, pythonFlag, requirementsFileFlag)
-		if err != nil {
-			return err
+		var script *Script
+		if trustCacheFlag && !validateFlag && !planInstallFlag && !flagVerify {
+			script = getTrustedScript(scriptName)
 		}
 
-		if isWhichFlag {
-			if !flagDebug {
-				// Clear all progress messages
-				printProgress("")
+		if script == nil {
+			if validateFlag || planInstallFlag {
+				err = checkCacheLayoutReadOnly()
+				if err != nil {
+					return err
+				}
+			} else {
+				err = ensureCacheLayout()
+				if err != nil {
+					return err
+				}
+
+				printProgress("Removing stale environments...")
+				_, err = clearStaleEnvs()
+				if err != nil {
+					loggerErr.Printf("Warning: failed to remove stale environments: %s\n", err)
+				}
 			}
-			loggerOut.Println(script.EnvDir)
-			return nil
-		}
 
-		printProgress("Ensuring virtual environment...")
-		err = script.EnsureEnv(deleteOldEnvFlag)
-		if err != nil {
-			return err
+			printProgress("Gathering information about script and environment...")
+			script, err = NewScript(scriptName, pythonFlag, requirementsFileFlag)
+			if err != nil {
+				return err
+			}
+
+			if promptFlag != "" {
+				script.Prompt = promptFlag
+			}
+
+			if envIDFromFlag != "" {
+				err = script.SetEnvID(envIDFromFlag)
+				if err != nil {
+					return err
+				}
+			}
+
+			if rebuildCooldownFlag > 0 && !deleteOldEnvFlag && envIDFromFlag == "" {
+				script.applyRebuildCooldown(rebuildCooldownFlag)
+			}
+
+			if validateFlag {
+				if !flagDebug {
+					// Clear all progress messages
+					printProgress("")
+				}
+				return validateScript(script, deleteOldEnvFlag)
+			}
+
+			if planInstallFlag {
+				return script.PlanInstall()
+			}
+
+			if isWhichFlag || whichPythonFlag {
+				if ensureFlag {
+					printProgress("Ensuring virtual environment...")
+					err = script.EnsureEnv(deleteOldEnvFlag)
+					if err != nil {
+						return err
+					}
+				}
+				if !flagDebug {
+					// Clear all progress messages
+					printProgress("")
+				}
+				if whichPythonFlag {
+					loggerOut.Println(venvBinPath(script.EnvDir, "python"))
+				} else {
+					loggerOut.Println(script.EnvDir)
+				}
+				return nil
+			}
+
+			printProgress("Ensuring virtual environment...")
+			err = script.EnsureEnv(deleteOldEnvFlag)
+			if err != nil {
+				return err
+			}
+
+			if buildOnlyFlag {
+				printProgress("Done!")
+				if !flagDebug {
+					// Clear all progress messages
+					printProgress("")
+				}
+				loggerOut.Println(script.EnvDir)
+				return nil
+			}
 		}
 
 		printProgress("Done! Running script...")
@@ -112,13 +395,87 @@ invenv -r req.txt -- DEBUG=1 somepath/myscript.py`,
 
 		// https://gobyexample.com/execing-processes
 		// Generate the command slice
-		cmdSlice := append([]string{path.Join(script.EnvDir, "bin/python")}, scriptName)
+		// Interpreter flags from the shebang (e.g. -O) are kept, the script
+		// author relies on them
+		cmdSlice := []string{venvBinPath(script.EnvDir, "python")}
+		if _, interpreterFlags, err := extractPythonFromShebang(scriptName); err == nil && len(interpreterFlags) > 0 {
+			if flagDebug {
+				loggerErr.Printf("Using interpreter flags from shebang: %s\n", strings.Join(interpreterFlags, " "))
+			}
+			cmdSlice = append(cmdSlice, interpreterFlags...)
+		}
+		cmdSlice = append(cmdSlice, scriptName)
 		cmdSlice = append(cmdSlice, scriptArgs...)
+		name, args := script.wrapCommand(cmdSlice[0], cmdSlice[1:]...)
+		cmdSlice = append([]string{name}, args...)
+
+		// Generate the environment. Variables provided as arguments take
+		// precedence over the determinism settings, the process environment
+		// and the environment file, in that order
+		cmdEnv := append(envVars, determinismEnv...)
+		cmdEnv = append(cmdEnv, os.Environ()...)
+		if envFileFlag != "" {
+			fileEnvVars, err := loadEnvFile(envFileFlag, envFileFormatFlag)
+			if err != nil {
+				return err
+			}
+			cmdEnv = append(cmdEnv, fileEnvVars...)
+		}
+		cmdEnv = dedupEnv(cmdEnv)
+
+		onStart := func(pid int) {
+			if !recordRunFlag {
+				return
+			}
+			err := recordRun(script, pid)
+			if err != nil && flagDebug {
+				loggerErr.Printf("Failed to record the run: %s\n", err)
+			}
+		}
 
-		// Generate the environment
-		cmdEnv := os.Environ()
-		cmdEnv = append(envVars, cmdEnv...)
-		return syscall.Exec(path.Join(script.EnvDir, "bin/python"), cmdSlice, cmdEnv)
+		if dropPrivilegesFlag != "" || runtime.GOOS == "windows" || stdinFlag || afterRunFlag != "" {
+			// Credentials can't be changed with syscall.Exec, Windows doesn't
+			// support it at all, and the script read from STDIN must be removed
+			// (and the after-run hook must run) after the script finishes, so
+			// the script runs as a child process
+			var sysProcAttr *syscall.SysProcAttr
+			if dropPrivilegesFlag != "" {
+				sysProcAttr, err = prepareDropPrivileges(dropPrivilegesFlag, script.EnvDir)
+				if err != nil {
+					return err
+				}
+			}
+			err = runChild(cmdSlice, cmdEnv, sysProcAttr, onStart)
+			var exitErr *exitCodeError
+			if errors.As(err, &exitErr) {
+				// The script has already reported its error
+				cmd.SilenceErrors = true
+			}
+			if afterRunFlag != "" && (err == nil || exitErr != nil) {
+				exitCode := 0
+				if exitErr != nil {
+					exitCode = exitErr.code
+				}
+				hookErr := runAfterRunHook(afterRunFlag, script.EnvDir, cmdEnv, exitCode)
+				if hookErr != nil {
+					// The exit code of the script takes precedence
+					loggerErr.Println(hookErr)
+					if err == nil {
+						cmd.SilenceErrors = true
+						err = &exitCodeError{code: 1}
+					}
+				}
+			}
+			return err
+		}
+		// syscall.Exec keeps the PID of the invenv process
+		onStart(os.Getpid())
+		stopSetupSignalHandler()
+		executable, err := exec.LookPath(cmdSlice[0])
+		if err != nil {
+			return err
+		}
+		return syscall.Exec(executable, cmdSlice, cmdEnv)
 	},
 }
 
@@ -127,6 +484,10 @@ invenv -r req.txt -- DEBUG=1 somepath/myscript.py`,
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
+		var exitErr *exitCodeError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
 		os.Exit(1)
 	}
 }
@@ -134,16 +495,277 @@ func Execute() {
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&flagDebug, "debug", "d", false, "enable debug mode with verbose output")
 	rootCmd.PersistentFlags().BoolVarP(&flagSilent, "silent", "s", false, "silence progress output. --debug flag overrides this")
+	rootCmd.PersistentFlags().DurationVar(&flagRequirementsTimeout, "requirements-timeout", 30*time.Second,
+		`timeout of downloading the requirements file provided with
+-r as a URL`)
+	rootCmd.PersistentFlags().StringVar(&flagColor, "color", "auto",
+		`highlight errors and progress messages: auto, always or
+never. auto highlights them only if STDERR is a terminal and
+the NO_COLOR environment variable is not set`)
+	rootCmd.PersistentFlags().BoolVar(&flagNoColor, "no-color", false,
+		`don't highlight the output, same as --color never`)
+	rootCmd.PersistentFlags().StringVar(&flagLogFormat, "log-format", "plain",
+		`format of messages printed to STDERR: plain or json. json
+prints every message as a JSON object with timestamp, level,
+msg, env_dir and env_id fields and disables colors`)
+	rootCmd.PersistentFlags().BoolVar(&flagKeepLockOnExit, "keep-lock-on-exit", false,
+		`debug only: don't remove the lock file of the virtual
+environment after it is created, so it can be inspected`)
+	rootCmd.PersistentFlags().MarkHidden("keep-lock-on-exit")
+	rootCmd.PersistentFlags().DurationVar(&flagInstallStallTimeout, "install-stall-timeout", 0,
+		`warn if pip produces no output for the specified duration
+while installing requirements, e.g. 5m`)
+	rootCmd.PersistentFlags().IntVar(&flagLockAttempts, "lock-attempts", 0,
+		`number of attempts to acquire the lock of a virtual
+environment which is being built by another process before
+failing. Defaults to attempts from the configuration file
+or no limit (until the lock becomes stale)`)
+	rootCmd.PersistentFlags().DurationVar(&flagLockInterval, "lock-interval", 0,
+		`interval between attempts to acquire the lock. Defaults to
+interval from the configuration file or 1s`)
+	rootCmd.PersistentFlags().DurationVar(&flagLockStaleTime, "lock-stale-time", 0,
+		`time after which the lock is considered stale and the virtual
+environment is recreated (Windows only). Defaults to
+stale_time from the configuration file or 15m`)
+	rootCmd.PersistentFlags().DurationVar(&flagLockTimeout, "lock-timeout", 0,
+		`maximum time to wait for the lock of a virtual environment
+which is being built by another process, e.g. 2m. Defaults
+to timeout from the configuration file or no limit`)
+	rootCmd.PersistentFlags().BoolVar(&flagAbortOnStall, "abort-on-stall", false,
+		`stop the installation if it stalls. Requires
+--install-stall-timeout`)
+	rootCmd.PersistentFlags().StringVar(&flagMaxRequirementsSize, "max-requirements-size", "",
+		`fail if the requirements file (including files it includes)
+is larger than the specified size, e.g. 64KB`)
+	rootCmd.PersistentFlags().IntVar(&flagMaxRequirementsLines, "max-requirements-lines", 0,
+		`fail if the requirements file (including files it includes)
+has more lines than specified`)
+	rootCmd.PersistentFlags().BoolVar(&flagUpgradeDeps, "upgrade-deps", false,
+		`upgrade pip and setuptools in the new virtual environment.
+Virtual environments with upgraded dependencies have a
+different ID`)
+	rootCmd.PersistentFlags().BoolVar(&flagExplainRequirements, "explain-requirements", false,
+		`print every requirements file candidate which was considered,
+whether it exists and which one was selected to STDERR.
+Combine with --silent to get machine-readable output`)
+	rootCmd.PersistentFlags().StringVar(&flagBackend, "backend", BackendAuto,
+		`backend which creates virtual environments and installs
+requirements: auto, pip or uv. auto uses uv if it is installed.
+Virtual environments created by uv have a different ID`)
+	rootCmd.PersistentFlags().BoolVar(&flagSystemSitePackages, "system-site-packages", false,
+		`give the virtual environment access to the system
+site-packages. Such virtual environments have a different ID`)
+	rootCmd.PersistentFlags().BoolVar(&flagHashSystemSitePackages, "hash-system-site-packages", false,
+		`include the list of packages installed in the system
+site-packages in the virtual environment ID, so the virtual
+environment is recreated when they change. Slow, requires
+--system-site-packages`)
+	rootCmd.PersistentFlags().StringVar(&flagIndexURL, "index-url", "",
+		`base URL of the package index, passed to pip (or uv)
+instead of relying on PIP_INDEX_URL`)
+	rootCmd.PersistentFlags().StringArrayVar(&flagExtraIndexURLs, "extra-index-url", nil,
+		`URL of an additional package index, passed to pip (or uv).
+Can be repeated`)
+	rootCmd.PersistentFlags().BoolVar(&flagHashIndex, "hash-index", false,
+		`include --index-url and --extra-index-url in the virtual
+environment ID. By default package indexes don't change the ID`)
+	rootCmd.PersistentFlags().BoolVar(&flagShowInstall, "show-install", false,
+		`stream the output of commands which create the virtual
+environment and install requirements (pip, uv, venv) without
+enabling --debug`)
+	rootCmd.PersistentFlags().BoolVar(&flagVerify, "verify", false,
+		`verify the content of the interpreter binary the virtual
+environment was created from and rebuild it if the binary
+changed. By default only its size and modification time are
+compared. Disables --trust-cache`)
+	rootCmd.PersistentFlags().StringArrayVar(&flagPipArgs, "pip-arg", nil,
+		`argument appended verbatim to pip install (or uv pip install),
+e.g. --pip-arg=--pre. Can be repeated. Not part of the virtual
+environment ID, use --new-environment to apply changed
+arguments to an existing virtual environment`)
+	rootCmd.PersistentFlags().StringVar(&flagEnvDir, "env-dir", "",
+		`directory where virtual environments are stored. Overrides
+the INVENV_ENV_DIR environment variable. Defaults to
+~/.local/invenv`)
+	rootCmd.PersistentFlags().StringVar(&flagConstraints, "constraints", "",
+		`pip constraints file to install requirements with. If not
+provided, constraints_<script_name>.txt,
+<script_name>_constraints.txt or constraints.txt next to the
+script is used if it exists`)
+	rootCmd.PersistentFlags().BoolVar(&flagResolveForID, "resolve-for-id", false,
+		`resolve requirements with uv or pip-compile and use the
+resolved packages in the virtual environment ID, so different
+requirements which resolve to the same packages share the
+virtual environment. Slow, requires network access`)
+	rootCmd.PersistentFlags().BoolVar(&flagStrictPython, "strict-python", false,
+		`fail if the interpreter doesn't satisfy requires-python of
+the script or pyproject.toml instead of searching for another
+interpreter`)
+	rootCmd.PersistentFlags().StringVar(&flagStaleAfter, "stale-after", "",
+		`remove virtual environments which were not used for longer
+than the duration, e.g. 24h or 14d. Overrides the
+INVENV_STALE_AFTER environment variable. Defaults to 336h
+(14 days)`)
+	rootCmd.PersistentFlags().BoolVar(&flagNoCleanup, "no-cleanup", false,
+		`don't remove stale virtual environments automatically, e.g.
+in production where a virtual environment must not disappear
+while it is used. Can be set with INVENV_NO_CLEANUP=1`)
+	rootCmd.PersistentFlags().StringVar(&flagRefreshInterval, "refresh-interval", "",
+		`reinstall requirements of the virtual environment with
+--upgrade if it was built longer than the duration ago, e.g.
+12h or 7d. Pulls updates allowed by the requirements, the
+virtual environment ID doesn't change`)
+	rootCmd.PersistentFlags().StringVar(&flagPythonCheckCommand, "python-check-command", "",
+		`command which prints the version of the Python interpreter,
+used instead of python --version. {interpreter} is replaced
+with the interpreter, e.g. '{interpreter} -c "import
+platform; print(platform.python_version())"'`)
+	rootCmd.PersistentFlags().StringSliceVar(&flagPythonFallback, "python-fallback", nil,
+		`comma-separated list of Python interpreters to try, in
+order, if no interpreter is selected for the script (e.g.
+python3.11,python3,python). Defaults to python_fallback from
+the configuration file or python`)
+	rootCmd.PersistentFlags().StringSliceVar(&flagExtras, "extras", nil,
+		`comma-separated list of optional dependency groups from
+[project.optional-dependencies] of pyproject.toml, pipenv
+categories (e.g. develop) or poetry dependency groups to
+install. Used only if dependencies are read from
+pyproject.toml, Pipfile.lock or poetry.lock`)
+	rootCmd.PersistentFlags().BoolVar(&flagAllowUnlocked, "allow-unlocked", false,
+		`install packages from Pipfile if there is no Pipfile.lock.
+Their versions are not pinned`)
+	rootCmd.PersistentFlags().StringVar(&flagCondaEnvFile, "conda-env-file", "",
+		`create a conda environment from the environment file
+instead of a virtual environment. By default environment.yml
+next to the script is used if there is no requirements file.
+Requires mamba or conda`)
+	rootCmd.PersistentFlags().BoolVar(&flagExactHash, "exact-hash", false,
+		`hash requirements files byte by byte. By default comments,
+blank lines, whitespace, the order of lines and the case of
+package names don't change the virtual environment ID`)
+	rootCmd.PersistentFlags().BoolVar(&flagIncremental, "incremental", false,
+		`update the virtual environment created with init command
+by installing only changed requirements and uninstalling
+removed ones instead of recreating it. Falls back to
+recreating the environment if the interpreter or other
+options changed, or the update fails. Not supported with
+uv backend`)
+	rootCmd.PersistentFlags().BoolVar(&flagNotify, "notify", false,
+		`notify when building the virtual environment takes longer
+than --notify-after. Only works in a terminal`)
+	rootCmd.PersistentFlags().DurationVar(&flagNotifyAfter, "notify-after", 30*time.Second,
+		"minimal build duration to notify about with --notify")
+	rootCmd.PersistentFlags().StringVar(&flagNotifyCommand, "notify-command", "",
+		`command to run with --notify instead of the terminal bell.
+INVENV_BUILD_STATUS (success or failure), INVENV_ENV_DIR and
+INVENV_BUILD_DURATION are available in its environment`)
+	rootCmd.PersistentFlags().StringSliceVar(&flagRequirementsOrder, "requirements-order", nil,
+		`comma-separated list of requirements file names to try, in
+order, relative to the script directory. {name} is replaced
+with the script name without .py, {platform} with the
+platform name, e.g. 'reqs/{name}.txt,requirements.txt'`)
+	rootCmd.PersistentFlags().BoolVar(&flagParallelInstall, "parallel-install", false,
+		`experimental: build requirements files included with -r
+concurrently before installing them. See README for details`)
+	rootCmd.PersistentFlags().BoolVar(&flagPlatformRequirements, "platform-requirements", false,
+		`prefer platform specific requirements file, e.g.
+requirements-linux.txt or requirements-darwin.txt, over
+requirements.txt. The platform is a part of the virtual
+environment ID`)
+	rootCmd.Flags().Bool("record-run", false,
+		`record the running script, so "invenv status" can report if
+its requirements have changed since it was started`)
+	rootCmd.Flags().Duration("rebuild-cooldown", 0,
+		`if requirements changed, but the virtual environment of the
+script was built less than the specified duration ago (e.g.
+5m), reuse it instead of building a new one. A warning is
+printed every time an outdated environment is reused. If
+more than half of the requirements lines changed, the
+environment is rebuilt anyway`)
 	rootCmd.Flags().StringP("requirements-file", "r", "",
 		`use specified requirements file. If not provided, it
 will try to guess the requirements file name:
 requirements_<script_name>.txt, <script_name>_requirements.txt or
-requirements.txt`)
+requirements.txt. An http(s) URL is downloaded and cached`)
 	rootCmd.Flags().BoolP("new-environment", "n", false, "create a new virtual environment even if it already exists")
 	rootCmd.Flags().BoolP("which", "w", false,
-		`print the location of virtual environment folder and exit. If
-the virtual environment does not exist, it will be created with
-installed requirements`)
-	rootCmd.Flags().StringP("python", "p", "", "use specified Python interpreter")
+		`print the location of virtual environment folder and exit. Use
+--ensure to create the virtual environment with installed
+requirements if it does not exist`)
+	rootCmd.Flags().Bool("build-only", false,
+		`create the virtual environment with installed requirements,
+print its location and exit without running the script`)
+	rootCmd.Flags().String("env-file", "",
+		`load environment variables for the script from the file`)
+	rootCmd.Flags().String("env-file-format", "",
+		`format of the environment file: dotenv, json or yaml. If
+not provided, it is detected from the file extension: .json
+and .yaml files are parsed as json and yaml, other files as
+dotenv`)
+	rootCmd.Flags().String("env-id-from", "",
+		`use the provided key as the virtual environment ID instead
+of the one calculated from the requirements file and the
+Python version`)
+	rootCmd.Flags().Bool("which-python", false,
+		`print the location of the Python interpreter in the virtual
+environment and exit`)
+	rootCmd.Flags().Bool("dry-run", false,
+		`print the selected requirements file, interpreter, environment
+ID and whether the virtual environment would be created,
+reused or recreated, and exit without creating anything.
+Same as --validate`)
+	rootCmd.Flags().Bool("ensure", false,
+		`create the virtual environment with installed requirements
+if it doesn't exist. Used with --which and --which-python`)
+	rootCmd.Flags().StringP("python", "p", "",
+		`use specified Python interpreter. A bare version (e.g. 3.11)
+is resolved to python3.11, py -3.11 on Windows or pyenv. Use
+py:<tag> (e.g. py:-3.11) to select it with the Python
+launcher for Windows or pyenv:<version> (e.g. pyenv:3.11.8)
+to select the version installed with pyenv.
+A command (e.g. "docker run --rm -i image python") runs the
+interpreter with a wrapper, see README for details`)
+	rootCmd.Flags().String("prompt", "",
+		`prompt prefix of the activated virtual environment. Defaults
+to the script name`)
+	rootCmd.Flags().String("drop-privileges", "",
+		`run the script as the specified user (name, uid or uid:gid)
+after the virtual environment is created. Requires invenv to
+run as root`)
+	rootCmd.Flags().Bool("trust-cache", false,
+		`if the script was run before and its virtual environment
+still exists, run the script in it immediately, skipping
+all validation. Use at your own risk: changes of
+requirements or the interpreter are not detected`)
+	rootCmd.Flags().String("after-run", "",
+		`command to run with the system shell after the script
+finishes, with the virtual environment activated. The exit
+code of the script is available in INVENV_EXIT_CODE`)
+	rootCmd.Flags().Bool("stdin", false,
+		`read the script from STDIN. All arguments except environment
+variables are passed to the script. Requirements are read
+from -r or from the script itself`)
+	rootCmd.Flags().Bool("deterministic", false,
+		`run the script reproducibly: set PYTHONHASHSEED=0,
+PYTHONDONTWRITEBYTECODE=1 and PYTHONUNBUFFERED=1. Each of them
+can be changed with its own flag`)
+	rootCmd.Flags().String("python-hash-seed", "",
+		`set PYTHONHASHSEED for the script (random or an integer).
+Defaults to 0 with --deterministic`)
+	rootCmd.Flags().Bool("dont-write-bytecode", false,
+		`set PYTHONDONTWRITEBYTECODE=1 for the script. Enabled by
+--deterministic`)
+	rootCmd.Flags().Bool("unbuffered", false,
+		`set PYTHONUNBUFFERED=1 for the script. Enabled by
+--deterministic`)
+	rootCmd.Flags().Bool("plan-install", false,
+		`print packages and versions which would be installed in the
+virtual environment and exit without installing them. Uses
+pip install --dry-run in a temporary virtual environment`)
+	rootCmd.Flags().Bool("validate", false,
+		`validate the script, its interpreter and requirements without
+network access, print what would happen and exit. No processes
+except the interpreter's version check are started, so
+--resolve-for-id and --hash-system-site-packages are refused`)
 	rootCmd.Flags().BoolP("version", "v", false, "print version and exit")
 }
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// runCmd is an explicit alias of the root command: invenv run -- script.py is
+// the same as invenv -- script.py
+var runCmd = &cobra.Command{
+	Use:   "run [invenv-flags] -- [VAR=val] python-script.py",
+	Short: "run the script in its virtual environment (same as invenv without a command)",
+	Long: `Run the script in its virtual environment, creating it and installing
+requirements if needed. This is the same as running invenv without a command,
+all flags of invenv are supported.`,
+	Example: `invenv run -- somepath/myscript.py
+invenv run -r req.txt -- DEBUG=1 somepath/myscript.py`,
+}
+
+func init() {
+	rootCmd.AddCommand(runCmd)
+	// The root command and its flags are defined in cmd_root.go, which is
+	// initialized first. Sharing the flags keeps both commands in sync
+	runCmd.RunE = rootCmd.RunE
+	runCmd.Flags().AddFlagSet(rootCmd.Flags())
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+
+	"github.com/spf13/cobra"
+)
+
+// selftestCmd represents the selftest command
+var selftestCmd = &cobra.Command{
+	Use:    "selftest",
+	Short:  "verify that invenv works on this platform",
+	Hidden: true,
+}
+
+// selftestLockCmd represents the selftest lock command
+var selftestLockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "verify the locking subsystem",
+	Long: `Exercise locking of virtual environments in a temporary directory: acquiring
+and releasing the lock, detection of stale locks and detection of processes
+which use a virtual environment.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		tmpDir, err := os.MkdirTemp("", "invenv-selftest-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		envDir := path.Join(tmpDir, "selftest.env")
+
+		failed := 0
+		report := func(name string, err error) {
+			if err != nil {
+				failed++
+				loggerOut.Printf("FAIL  %s: %s\n", name, err)
+			} else {
+				loggerOut.Printf("PASS  %s\n", name)
+			}
+		}
+		skip := func(name string, reason string) {
+			loggerOut.Printf("SKIP  %s: %s\n", name, reason)
+		}
+
+		report("acquire lock", func() error {
+			err := lockEnv(envDir)
+			if err != nil {
+				return err
+			}
+			if !isEnvLocked(envDir) {
+				return fmt.Errorf("environment is not locked after lockEnv")
+			}
+			return nil
+		}())
+
+		report("release lock", func() error {
+			err := unlockEnv(envDir)
+			if err != nil {
+				return err
+			}
+			if isEnvLocked(envDir) {
+				return fmt.Errorf("environment is still locked after unlockEnv")
+			}
+			return nil
+		}())
+
+		report("wait for unlocked environment", waitUntilEnvIsUnlocked(envDir))
+
+		if flockSupported {
+			report("detect held lock", func() error {
+				err := lockEnv(envDir)
+				if err != nil {
+					return err
+				}
+				defer unlockEnv(envDir)
+				// The advisory lock conflicts with any other open file
+				locked, err := tryLockEnv(envDir)
+				if err != nil {
+					return err
+				}
+				if locked {
+					return fmt.Errorf("environment was locked twice")
+				}
+				return nil
+			}())
+
+			report("ignore abandoned lock file", func() error {
+				// A lock file without the advisory lock, as left by a
+				// crashed process
+				f, err := os.Create(generateLockFileName(envDir))
+				if err != nil {
+					return err
+				}
+				f.Close()
+				defer unlockEnv(envDir)
+				if isEnvLocked(envDir) {
+					return fmt.Errorf("abandoned lock file locks the environment")
+				}
+				return nil
+			}())
+		}
+
+		if processDetectionSupported {
+			if !flockSupported {
+				// Without advisory locks, lock files left by crashed
+				// processes are detected with process detection
+				report("detect stale lock", func() error {
+					err := lockEnv(envDir)
+					if err != nil {
+						return err
+					}
+					defer unlockEnv(envDir)
+					// Nobody uses the environment, so the lock must be detected as stale
+					err = waitUntilEnvIsUnlocked(envDir)
+					if !errors.Is(err, ErrNoProcessFound) {
+						return fmt.Errorf("expected %q, got %v", ErrNoProcessFound, err)
+					}
+					return nil
+				}())
+			}
+
+			report("find current process", func() error {
+				cmdline, err := readCmdline(os.Getpid())
+				if err != nil {
+					return err
+				}
+				pid, err := findProcessWithPrefix(cmdline)
+				if err != nil {
+					return err
+				}
+				if pid != os.Getpid() {
+					return fmt.Errorf("expected PID %d, got %d", os.Getpid(), pid)
+				}
+				return nil
+			}())
+
+			report("ignore unused environment", func() error {
+				_, err := findProcessWithPrefix(envDir)
+				if !errors.Is(err, ErrNoProcessFound) {
+					return fmt.Errorf("expected %q, got %v", ErrNoProcessFound, err)
+				}
+				return nil
+			}())
+		} else {
+			reason := "process detection is not supported on " + runtime.GOOS
+			skip("detect stale lock", reason)
+			skip("find current process", reason)
+			skip("ignore unused environment", reason)
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d check(s) failed", failed)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(selftestCmd)
+	selftestCmd.AddCommand(selftestLockCmd)
+}
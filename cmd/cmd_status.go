@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show running scripts and whether their virtual environments are outdated",
+	Long: `Show scripts started with --record-run which are still running. A script is
+reported as outdated if its requirements have changed since it was started, so
+it should be restarted to pick up the new requirements.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		err := checkCacheLayoutReadOnly()
+		if err != nil {
+			return err
+		}
+
+		records, err := loadRunRecords()
+		if err != nil {
+			return err
+		}
+
+		if len(records) == 0 {
+			loggerErr.Println("No running scripts found")
+			return nil
+		}
+
+		for _, record := range records {
+			state := "up-to-date"
+			outdated, err := isRunOutdated(record)
+			if err != nil {
+				state = "unknown (" + err.Error() + ")"
+			} else if outdated {
+				state = "outdated, restart required"
+			}
+			loggerOut.Printf("%d\t%s\t%s\t%s\n", record.PID, record.StartedAt.Format(time.RFC3339), record.Script, state)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
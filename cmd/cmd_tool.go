@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// toolCmd represents the tool command
+var toolCmd = &cobra.Command{
+	Use:   "tool [invenv-flags] -- tool-name [tool-args]",
+	Short: "run a console script installed in a virtual environment",
+	Long: `Run a console script (e.g. black or flask) installed in the virtual
+environment with requirements. There is no script to anchor the virtual
+environment to, so it is based on the requirements file in the current
+directory or the one provided with -r.`,
+	Example: `invenv tool -r requirements-dev.txt -- black .
+invenv tool -- flask --app app run`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		requirementsFileFlag, err := cmd.Flags().GetString("requirements-file")
+		if err != nil {
+			return err
+		}
+
+		pythonFlag, err := cmd.Flags().GetString("python")
+		if err != nil {
+			return err
+		}
+
+		deleteOldEnvFlag, err := cmd.Flags().GetBool("new-environment")
+		if err != nil {
+			return err
+		}
+
+		err = ensureCacheLayout()
+		if err != nil {
+			return err
+		}
+
+		printProgress("Removing stale environments...")
+		_, err = clearStaleEnvs()
+		if err != nil {
+			loggerErr.Printf("Warning: failed to remove stale environments: %s\n", err)
+		}
+
+		printProgress("Gathering information about requirements and environment...")
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		script, err := NewDirScript(cwd, pythonFlag, requirementsFileFlag)
+		if err != nil {
+			return err
+		}
+		if script.RequirementsPath == "" {
+			return fmt.Errorf("no requirements found in %s, provide the requirements file which installs %s with -r", cwd, args[0])
+		}
+
+		printProgress("Ensuring virtual environment...")
+		err = script.EnsureEnv(deleteOldEnvFlag)
+		if err != nil {
+			return err
+		}
+
+		printProgress("Done! Starting tool...")
+		if !flagDebug {
+			// Clear all progress messages
+			printProgress("")
+		}
+
+		tool := venvBinPath(script.EnvDir, args[0])
+		if _, err := os.Stat(tool); err != nil {
+			return fmt.Errorf("%s is not installed in the virtual environment %s. Add the package which provides it to %s", args[0], script.EnvDir, script.RequirementsPath)
+		}
+
+		// Flush the buffers to preserve the output order and avoid interference
+		// between the tool output and the invenv output
+		os.Stderr.Sync()
+		os.Stdout.Sync()
+
+		name, toolArgs := script.wrapCommand(tool, args[1:]...)
+		cmdSlice := append([]string{name}, toolArgs...)
+
+		if runtime.GOOS == "windows" {
+			// Windows doesn't support syscall.Exec
+			err = runChild(cmdSlice, os.Environ(), nil, nil)
+			var exitErr *exitCodeError
+			if errors.As(err, &exitErr) {
+				cmd.SilenceErrors = true
+			}
+			return err
+		}
+		executable, err := exec.LookPath(name)
+		if err != nil {
+			return err
+		}
+		stopSetupSignalHandler()
+		return syscall.Exec(executable, cmdSlice, os.Environ())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(toolCmd)
+	// Flags after the tool name belong to the tool
+	toolCmd.Flags().SetInterspersed(false)
+	toolCmd.Flags().StringP("requirements-file", "r", "",
+		`use specified requirements file. If not provided, it
+will try to guess the requirements file name`)
+	toolCmd.Flags().StringP("python", "p", "",
+		`use specified Python interpreter. A bare version (e.g. 3.11)
+is resolved to python3.11, py -3.11 on Windows or pyenv. Use
+py:<tag> (e.g. py:-3.11) to select it with the Python
+launcher for Windows or pyenv:<version> (e.g. pyenv:3.11.8)
+to select the version installed with pyenv.
+A command (e.g. "docker run --rm -i image python") runs the
+interpreter with a wrapper, see README for details`)
+	toolCmd.Flags().BoolP("new-environment", "n", false, "create a new virtual environment even if it already exists")
+}
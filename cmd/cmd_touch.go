@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// touchCmd represents the touch command
+var touchCmd = &cobra.Command{
+	Use:   "touch [invenv-flags] -- python-script.py | env-id",
+	Short: "mark a virtual environment as recently used without running the script",
+	Long: `Mark a virtual environment as recently used, so it is not removed as stale.
+The virtual environment is identified either by the script it belongs to or
+by its ID. Nothing is done if the virtual environment doesn't exist.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		requirementsFileFlag, err := cmd.Flags().GetString("requirements-file")
+		if err != nil {
+			return err
+		}
+
+		pythonFlag, err := cmd.Flags().GetString("python")
+		if err != nil {
+			return err
+		}
+
+		err = ensureCacheLayout()
+		if err != nil {
+			return err
+		}
+
+		var envDir string
+		if _, err := os.Stat(args[0]); err == nil {
+			script, err := NewScript(args[0], pythonFlag, requirementsFileFlag)
+			if err != nil {
+				return err
+			}
+			envDir = script.EnvDir
+		} else {
+			if !isValidEnvID(args[0]) {
+				return fmt.Errorf("%s is neither a script nor a valid environment ID", args[0])
+			}
+			envsDir, err := getEnvironmentDir()
+			if err != nil {
+				return err
+			}
+			envDir = path.Join(envsDir, args[0]+".env")
+		}
+
+		_, err = os.Stat(envDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				loggerErr.Printf("Virtual environment %s doesn't exist, nothing to do\n", envDir)
+				return nil
+			}
+			return err
+		}
+
+		now := time.Now()
+		err = os.Chtimes(envDir, now, now)
+		if err != nil {
+			return err
+		}
+
+		err = touchEnvInIndex(envDir, now)
+		if err != nil {
+			return err
+		}
+
+		if flagDebug {
+			loggerErr.Printf("Marked %s as used at %s\n", envDir, now.Format(time.RFC3339))
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(touchCmd)
+	touchCmd.Flags().StringP("requirements-file", "r", "",
+		`use specified requirements file. If not provided, it
+will try to guess the requirements file name`)
+	touchCmd.Flags().StringP("python", "p", "",
+		`use specified Python interpreter. Use py:<tag> (e.g.
+py:-3.11) to select it with the Python launcher for Windows`)
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+)
+
+// CondaEnvFilenames are the conda environment files looked up next to the
+// script, in order of preference
+var CondaEnvFilenames = []string{"environment.yml", "environment.yaml"}
+
+// findCondaEnvFile returns the conda environment file selected with
+// --conda-env-file or found in the directory. An empty string is returned if
+// there is none
+func findCondaEnvFile(dir string) (string, error) {
+	if flagCondaEnvFile != "" {
+		envFile, err := filepath.Abs(flagCondaEnvFile)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(envFile); err != nil {
+			return "", fmt.Errorf("conda environment file %s doesn't exist", flagCondaEnvFile)
+		}
+		explainRequirements("override", envFile)
+		return envFile, nil
+	}
+	for _, filename := range CondaEnvFilenames {
+		envFile := path.Join(dir, filename)
+		if _, err := os.Stat(envFile); err == nil {
+			explainRequirements("conda", envFile)
+			return envFile, nil
+		}
+	}
+	return "", nil
+}
+
+// getCondaExecutable returns mamba if it is installed, because it resolves
+// environments much faster, otherwise conda
+func getCondaExecutable() (string, error) {
+	for _, name := range []string{"mamba", "conda"} {
+		if executable, err := exec.LookPath(name); err == nil {
+			return executable, nil
+		}
+	}
+	return "", fmt.Errorf("conda environment files require mamba or conda to be installed")
+}
+
+// newCondaScript creates a new Script instance for the script with a conda
+// environment file. The environment is created as a prefix in the
+// environments directory. Python is installed by conda, so its ID depends only
+// on the environment file and PythonInterpreter is not set
+func newCondaScript(scriptPath string, envFile string, prompt string, interpreterOverride string) (*Script, error) {
+	if flagBackend != BackendAuto && flagBackend != "" {
+		return nil, fmt.Errorf("--backend %s can't be used with conda environment file %s", flagBackend, envFile)
+	}
+	if interpreterOverride != "" {
+		return nil, fmt.Errorf("--python %s can't be used with conda environment file %s, add python to its dependencies instead, e.g. python=3.11", interpreterOverride, envFile)
+	}
+	requirementsHash, err := getFileHash(envFile)
+	if err != nil {
+		return nil, err
+	}
+	if flagDebug {
+		loggerErr.Printf("Conda environment file hash: %s\n", requirementsHash)
+	}
+
+	envID := generateEnvID(requirementsHash, "", "", BackendConda)
+	envsDir, err := getEnvironmentDir()
+	if err != nil {
+		return nil, err
+	}
+	envDir := path.Join(envsDir, envID+".env")
+	if flagDebug {
+		loggerErr.Println("Using conda environment: ", envDir)
+	}
+
+	script := &Script{
+		AbsolutePath:       scriptPath,
+		EnvDir:             envDir,
+		RequirementsPath:   envFile,
+		Prompt:             prompt,
+		venvID:             envID,
+		requirementsHash:   requirementsHash,
+		requirementsSource: RequirementsSourceConda,
+		backend:            BackendConda,
+	}
+	return script, nil
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFilename is the name of the invenv configuration file in the user
+// configuration directory, e.g. ~/.config/invenv/config.yaml
+const ConfigFilename = "config.yaml"
+
+// Config is the invenv configuration file
+type Config struct {
+	PythonFallback []string   `yaml:"python_fallback"`
+	GC             GCConfig   `yaml:"gc"`
+	Lock           LockConfig `yaml:"lock"`
+}
+
+// LockConfig controls waiting for the lock of a virtual environment which is
+// being built by another process. Durations are strings, e.g. 2s and 30m
+type LockConfig struct {
+	Attempts  int    `yaml:"attempts"`
+	Interval  string `yaml:"interval"`
+	StaleTime string `yaml:"stale_time"`
+	Timeout   string `yaml:"timeout"`
+}
+
+// GCConfig is the policy of the gc command. Durations and sizes are strings,
+// e.g. 720h and 10GB
+type GCConfig struct {
+	MaxAge      string   `yaml:"max_age"`
+	MaxSize     string   `yaml:"max_size"`
+	KeepNamed   []string `yaml:"keep_named"`
+	PruneBroken bool     `yaml:"prune_broken"`
+}
+
+func getConfigFilename() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(configDir, "invenv", ConfigFilename), nil
+}
+
+// loadConfig reads the configuration file. An empty configuration is returned
+// if the file doesn't exist
+func loadConfig() (*Config, error) {
+	config := &Config{}
+
+	configFilename, err := getConfigFilename()
+	if err != nil {
+		return nil, err
+	}
+	dataBytes, err := os.ReadFile(configFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(dataBytes, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", configFilename, err)
+	}
+	if flagDebug {
+		loggerErr.Printf("Loaded configuration from %s\n", configFilename)
+	}
+	return config, nil
+}
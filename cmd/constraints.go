@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// getConstraintsFileForScript returns the pip constraints file for the script.
+// The file provided with --constraints must exist. Otherwise
+// constraints_<script_name>.txt, <script_name>_constraints.txt and
+// constraints.txt next to the script are tried. An empty string is returned if
+// there is no constraints file
+func getConstraintsFileForScript(scriptPath string) (string, error) {
+	if flagConstraints != "" {
+		constraintsFile, err := filepath.Abs(flagConstraints)
+		if err != nil {
+			return "", err
+		}
+		_, err = os.Stat(constraintsFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read constraints file: %s", err)
+		}
+		return constraintsFile, nil
+	}
+
+	scriptPath, err := filepath.Abs(scriptPath)
+	if err != nil {
+		return "", err
+	}
+	scriptDir := path.Dir(scriptPath)
+	scriptFile := strings.TrimSuffix(path.Base(scriptPath), ".py")
+	guesses := []string{
+		"constraints_" + scriptFile + ".txt",
+		scriptFile + "_constraints.txt",
+		"constraints.txt",
+	}
+	for _, guess := range guesses {
+		constraintsFile := path.Join(scriptDir, guess)
+		info, err := os.Stat(constraintsFile)
+		if err == nil && !info.IsDir() {
+			if flagDebug {
+				loggerErr.Println("Found constraints file: ", constraintsFile)
+			}
+			return constraintsFile, nil
+		}
+	}
+	return "", nil
+}
+
+// getConstraintsVariant returns the variant of the virtual environment ID for
+// the constraints file, so changing constraints recreates the virtual
+// environment. See generateEnvID
+func getConstraintsVariant(constraintsFile string) ([]string, error) {
+	if constraintsFile == "" {
+		return nil, nil
+	}
+	hash, err := getRequirementsHash(constraintsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read constraints file: %s", err)
+	}
+	if flagDebug {
+		loggerErr.Printf("Constraints file hash: %s\n", hash)
+	}
+	return []string{"constraints-" + hash}, nil
+}
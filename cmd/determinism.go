@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// DeterministicPythonHashSeed is the PYTHONHASHSEED value set with
+// --deterministic
+const DeterministicPythonHashSeed = "0"
+
+// getDeterminismEnv returns environment variables which make the behavior of
+// the script reproducible. An empty hashSeed leaves PYTHONHASHSEED unset
+func getDeterminismEnv(hashSeed string, dontWriteBytecode bool, unbuffered bool) ([]string, error) {
+	var env []string
+	if hashSeed != "" {
+		if hashSeed != "random" {
+			// Python accepts integers in the range [0; 4294967295]
+			_, err := strconv.ParseUint(hashSeed, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --python-hash-seed value %q: expected random or an integer in range [0; 4294967295]", hashSeed)
+			}
+		}
+		env = append(env, "PYTHONHASHSEED="+hashSeed)
+	}
+	if dontWriteBytecode {
+		env = append(env, "PYTHONDONTWRITEBYTECODE=1")
+	}
+	if unbuffered {
+		env = append(env, "PYTHONUNBUFFERED=1")
+	}
+	return env, nil
+}
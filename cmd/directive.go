@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// RequirementsDirectiveMaxLines is the number of lines at the beginning of the
+// script which are scanned for the requirements directive
+const RequirementsDirectiveMaxLines = 20
+
+// requirementsDirectiveRegexp matches the requirements directive, e.g.
+// `# requirements: requests, rich>=13`
+var requirementsDirectiveRegexp = regexp.MustCompile(`^#\s*requirements:(.*)$`)
+
+// scriptMetadataRegexp matches the PEP 723 inline script metadata block. The
+// expression is the reference one from the specification
+var scriptMetadataRegexp = regexp.MustCompile(`(?m)^# /// script$\s((?:^#(?:| .*)$\s)+)^# ///$`)
+
+// readScriptMetadata returns the TOML content of the PEP 723 inline script
+// metadata block. found is false if the script has no metadata block
+func readScriptMetadata(content []byte) (toml string, found bool) {
+	match := scriptMetadataRegexp.FindSubmatch(content)
+	if match == nil {
+		return "", false
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(match[1]), "\n"), "\n") {
+		line = strings.TrimPrefix(line, "#")
+		lines = append(lines, strings.TrimPrefix(line, " "))
+	}
+	return strings.Join(lines, "\n"), true
+}
+
+// readScriptRequiresPython returns requires-python from the PEP 723 inline
+// script metadata, e.g. ">=3.11". An empty string is returned if it is not set
+func readScriptRequiresPython(scriptPath string) (string, error) {
+	content, err := os.ReadFile(scriptPath)
+	if err != nil {
+		return "", err
+	}
+	toml, found := readScriptMetadata(content)
+	if !found {
+		return "", nil
+	}
+	requiresPython, _ := parseTOMLString(toml, "requires-python")
+	return strings.TrimSpace(requiresPython), nil
+}
+
+// readScriptMetadataDependencies returns dependencies from the PEP 723 inline
+// script metadata. found is false if the script has no metadata block
+func readScriptMetadataDependencies(content []byte) (dependencies []string, found bool, err error) {
+	toml, found := readScriptMetadata(content)
+	if !found {
+		return nil, false, nil
+	}
+
+	arrays, err := parseTOMLStringArrays(toml, func(key string) bool {
+		return key == "dependencies"
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid inline script metadata: %s", err)
+	}
+	return arrays["dependencies"], true, nil
+}
+
+// readRequirementsDirective returns requirements declared in the script
+// itself: either in the PEP 723 inline script metadata or in the requirements
+// directive. PEP 723 metadata takes precedence. nil is returned if the script
+// declares no requirements
+func readRequirementsDirective(scriptPath string) ([]string, error) {
+	content, err := os.ReadFile(scriptPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dependencies, found, err := readScriptMetadataDependencies(content)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return dependencies, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for i := 0; i < RequirementsDirectiveMaxLines && scanner.Scan(); i++ {
+		match := requirementsDirectiveRegexp.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			continue
+		}
+		var requirements []string
+		for _, requirement := range strings.Split(match[1], ",") {
+			requirement = strings.TrimSpace(requirement)
+			if requirement != "" {
+				requirements = append(requirements, requirement)
+			}
+		}
+		return requirements, nil
+	}
+	return nil, scanner.Err()
+}
+
+// getInlineRequirementsHash calculates the hash of requirements declared in
+// the script. Only the requirements are hashed, so changes in the rest of the
+// script don't affect the virtual environment ID
+func getInlineRequirementsHash(requirements []string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(requirements, "\n"))))
+}
@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envVarNameRegexp matches valid names of environment variables
+var envVarNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// detectEnvFileFormat guesses the format of the environment file from its
+// extension. Files with other extensions (e.g. .env) are dotenv files
+func detectEnvFileFormat(filename string) (string, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return "json", nil
+	case ".yaml", ".yml":
+		return "yaml", nil
+	}
+	return "dotenv", nil
+}
+
+// loadEnvFile reads environment variables from the file. Structured formats
+// (json and yaml) are flattened, see flattenEnvValue, dotenv files are parsed
+// with parseDotEnv
+func loadEnvFile(filename string, format string) ([]string, error) {
+	var err error
+	if format == "" {
+		format, err = detectEnvFileFormat(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dataBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var envVars []string
+	data := make(map[string]interface{})
+	switch format {
+	case "json":
+		err = json.Unmarshal(dataBytes, &data)
+	case "yaml":
+		err = yaml.Unmarshal(dataBytes, &data)
+	case "dotenv":
+		envVars, err = parseDotEnv(dataBytes)
+	default:
+		return nil, fmt.Errorf("unsupported environment file format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse environment file %s: %s", filename, err)
+	}
+
+	if format != "dotenv" {
+		flattenEnvValue("", data, &envVars)
+		sort.Strings(envVars)
+	}
+
+	if flagDebug {
+		loggerErr.Printf("Loaded %d environment variables from %s\n", len(envVars), filename)
+	}
+	return envVars, nil
+}
+
+// flattenEnvValue converts a structured value into KEY=value pairs. Keys of
+// nested objects are joined with `_`, items of lists are suffixed with their
+// index. Numbers and booleans are converted to their string representation,
+// null becomes an empty string
+func flattenEnvValue(key string, value interface{}, envVars *[]string) {
+	joinKey := func(k string) string {
+		if key == "" {
+			return k
+		}
+		return key + "_" + k
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			flattenEnvValue(joinKey(k), item, envVars)
+		}
+	case map[interface{}]interface{}:
+		for k, item := range v {
+			flattenEnvValue(joinKey(fmt.Sprint(k)), item, envVars)
+		}
+	case []interface{}:
+		for i, item := range v {
+			flattenEnvValue(joinKey(fmt.Sprint(i)), item, envVars)
+		}
+	case nil:
+		*envVars = append(*envVars, key+"=")
+	case string:
+		*envVars = append(*envVars, key+"="+v)
+	default:
+		*envVars = append(*envVars, key+"="+fmt.Sprint(v))
+	}
+}
+
+// parseDotEnv parses KEY=VALUE lines of a dotenv file. Blank lines and lines
+// starting with # are skipped, an optional `export ` prefix is removed. Values
+// in single quotes are used as is, values in double quotes support \n, \t, \"
+// and \\ escapes. Unquoted values are trimmed and a comment after ` #` is
+// removed. Variables are returned in the order of the file
+func parseDotEnv(data []byte) ([]string, error) {
+	var envVars []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || !envVarNameRegexp.MatchString(key) {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE, got %q", lineNumber, line)
+		}
+
+		value, err := parseDotEnvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+		envVars = append(envVars, key+"="+value)
+	}
+	return envVars, scanner.Err()
+}
+
+// parseDotEnvValue unquotes the value of a dotenv variable, see parseDotEnv
+func parseDotEnvValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	switch value[0] {
+	case '\'':
+		end := strings.Index(value[1:], "'")
+		if end == -1 {
+			return "", fmt.Errorf("unterminated single quoted value")
+		}
+		return value[1 : end+1], nil
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(value); i++ {
+			switch value[i] {
+			case '"':
+				return b.String(), nil
+			case '\\':
+				if i+1 == len(value) {
+					break
+				}
+				i++
+				switch value[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'r':
+					b.WriteByte('\r')
+				default:
+					b.WriteByte(value[i])
+				}
+			default:
+				b.WriteByte(value[i])
+			}
+		}
+		return "", fmt.Errorf("unterminated double quoted value")
+	}
+	if i := strings.Index(value, " #"); i != -1 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
+
+// dedupEnv removes duplicate variables from the environment, keeping the first
+// occurrence. Without it the precedence of duplicates depends on how the
+// script is started: os/exec keeps the last one
+func dedupEnv(env []string) []string {
+	seen := make(map[string]bool, len(env))
+	deduped := make([]string, 0, len(env))
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if runtime.GOOS == "windows" {
+			key = strings.ToUpper(key)
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		deduped = append(deduped, kv)
+	}
+	return deduped
+}
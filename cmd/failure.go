@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// FailureContextLines is the number of the last relevant output lines of a
+// failed command which are printed
+const FailureContextLines = 20
+
+// ANSI escape sequences used to highlight the output
+const (
+	colorBold  = "\033[1m"
+	colorRed   = "\033[31m"
+	colorReset = "\033[0m"
+)
+
+// noisyOutputPrefixes are prefixes of pip and uv output lines which describe
+// the progress rather than the reason of the failure
+var noisyOutputPrefixes = []string{
+	"Collecting ",
+	"Downloading ",
+	"Using cached ",
+	"Obtaining ",
+	"Requirement already satisfied",
+	"Looking in indexes",
+	"Installing build dependencies",
+	"Getting requirements to build",
+	"Preparing metadata",
+	"Building wheels for collected packages",
+	"Created wheel for",
+	"Stored in directory",
+	"Successfully ",
+	"[notice]",
+}
+
+// errorOutputMarkers mark output lines which are highlighted
+var errorOutputMarkers = []string{"error", "Error", "ERROR", "fatal", "Traceback"}
+
+// failureHint is a likely cause of a failure detected in the output
+type failureHint struct {
+	markers []string
+	hint    string
+}
+
+var failureHints = []failureHint{
+	{
+		markers: []string{
+			"Could not fetch URL", "Temporary failure in name resolution", "Name or service not known",
+			"Connection refused", "ConnectTimeoutError", "ReadTimeoutError", "ProxyError", "SSLError",
+			"NewConnectionError", "Failed to download",
+		},
+		hint: "the package index is not reachable. Check the network connection, proxy settings and the index URL",
+	},
+	{
+		markers: []string{"No matching distribution found", "Could not find a version that satisfies", "No solution found"},
+		hint:    "the requested version is not available for this Python version or platform, or the package name is misspelled",
+	},
+	{
+		markers: []string{
+			"Python.h: No such file", "fatal error:", "command 'gcc' failed", "command 'cc' failed",
+			"command 'x86_64-linux-gnu-gcc' failed", "Microsoft Visual C++", "pg_config executable not found",
+			"Failed building wheel", "Failed to build",
+		},
+		hint: "a C extension failed to build. Install a compiler and the development headers of Python and the required libraries (e.g. build-essential, python3-dev, libpq-dev on Debian and Ubuntu) or use a Python version with prebuilt wheels",
+	},
+}
+
+// useColor checks if the output to the file should be highlighted, see
+// --color and --no-color. In auto mode the NO_COLOR environment variable
+// (https://no-color.org) disables colors
+func useColor(f *os.File) bool {
+	if flagNoColor || isJSONLog() {
+		return false
+	}
+	switch flagColor {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		return os.Getenv("NO_COLOR") == "" && isTerminal(f)
+	}
+}
+
+// validateColorFlag verifies the value of --color
+func validateColorFlag() error {
+	switch flagColor {
+	case "auto", "always", "never":
+	default:
+		return fmt.Errorf("invalid --color value %q: expected auto, always or never", flagColor)
+	}
+	if flagNoColor && flagColor == "always" {
+		return fmt.Errorf("--no-color can't be combined with --color always")
+	}
+	return nil
+}
+
+// getRelevantOutput returns the last n lines of the output, skipping empty
+// lines and progress messages. The number of skipped lines is returned as well
+func getRelevantOutput(output []string, n int) ([]string, int) {
+	var relevant []string
+	for _, line := range output {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		noisy := false
+		for _, prefix := range noisyOutputPrefixes {
+			if strings.HasPrefix(trimmed, prefix) {
+				noisy = true
+				break
+			}
+		}
+		if !noisy {
+			relevant = append(relevant, line)
+		}
+	}
+	if len(relevant) > n {
+		relevant = relevant[len(relevant)-n:]
+	}
+	return relevant, len(output) - len(relevant)
+}
+
+// getFailureHint returns the likely cause of the failure detected in the
+// output. An empty string is returned if the cause is unknown
+func getFailureHint(output []string) string {
+	for _, h := range failureHints {
+		for _, line := range output {
+			for _, marker := range h.markers {
+				if strings.Contains(line, marker) {
+					return h.hint
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// printCommandFailure prints what failed: the phase (e.g. "Installing
+// requirements"), the command with its exit code, the last relevant lines of
+// the buffered output and a hint about the likely cause. The output is empty
+// if it was streamed with --debug or --show-install
+func printCommandFailure(phase string, name string, args []string, output []string, err error) {
+	color := useColor(os.Stderr)
+	highlight := func(s string, codes string) string {
+		if !color {
+			return s
+		}
+		return codes + s + colorReset
+	}
+
+	var b strings.Builder
+	b.WriteString("\n" + highlight(phase+" failed", colorBold+colorRed) + "\n")
+	b.WriteString(fmt.Sprintf("  Command:   %s\n", strings.Join(append([]string{name}, args...), " ")))
+	var exitErr *exitCodeError
+	if errors.As(err, &exitErr) {
+		b.WriteString(fmt.Sprintf("  Exit code: %d\n", exitErr.code))
+	} else if err != nil {
+		b.WriteString(fmt.Sprintf("  Error:     %s\n", err))
+	}
+
+	if len(output) > 0 {
+		relevant, skipped := getRelevantOutput(output, FailureContextLines)
+		b.WriteString("\n")
+		if skipped > 0 {
+			b.WriteString(fmt.Sprintf("  ... %d lines skipped, run with --show-install to see the full output\n", skipped))
+		}
+		for _, line := range relevant {
+			for _, marker := range errorOutputMarkers {
+				if strings.Contains(line, marker) {
+					line = highlight(line, colorRed)
+					break
+				}
+			}
+			b.WriteString("  " + line + "\n")
+		}
+	}
+
+	if hint := getFailureHint(output); hint != "" {
+		b.WriteString("\n" + highlight("Hint:", colorBold) + " " + hint + "\n")
+	}
+	loggerErr.Print(b.String())
+}
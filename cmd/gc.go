@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// OrphanedTempDirAge is the age after which an unlocked temporary directory of
+// a virtual environment build (see buildEnvInTempDir) is removed by gc
+const OrphanedTempDirAge = 1 * time.Hour
+
+// tempEnvDirRegexp matches temporary directories of virtual environment builds
+// and captures the virtual environment directory, see getTempEnvDir
+var tempEnvDirRegexp = regexp.MustCompile(`^(.+\.env)\.tmp-[0-9]+$`)
+
+// GCPolicy describes which virtual environments the gc command removes
+type GCPolicy struct {
+	MaxAge      time.Duration // Remove virtual environments not used for longer than this
+	MaxSize     int64         // Remove least recently used virtual environments until they fit, 0 means no limit
+	KeepNamed   []string      // IDs of virtual environments which are never removed
+	PruneBroken bool          // Remove broken virtual environments regardless of their age
+}
+
+// newGCPolicy creates the policy from the gc section of the configuration file
+func newGCPolicy(config *GCConfig) (*GCPolicy, error) {
+	staleAfter, err := getStaleEnvironmentTime()
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &GCPolicy{
+		MaxAge:      staleAfter,
+		KeepNamed:   config.KeepNamed,
+		PruneBroken: config.PruneBroken,
+	}
+
+	if config.MaxAge != "" {
+		policy.MaxAge, err = parseAge(config.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_age in configuration file: %s", err)
+		}
+	}
+	if config.MaxSize != "" {
+		policy.MaxSize, err = parseSize(config.MaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_size in configuration file: %s", err)
+		}
+	}
+	return policy, nil
+}
+
+// isEnvBroken checks if the virtual environment is structurally broken, e.g.
+// its creation was interrupted. A virtual environment is broken if its Python
+// interpreter is missing or doesn't run
+func isEnvBroken(envDir string) bool {
+	output, err := execCmdSilent(venvBinPath(envDir, "python"), "-c", "pass")
+	if err != nil {
+		if flagDebug {
+			loggerErr.Printf("Virtual environment %s is broken: %s %s\n", envDir, err, output)
+		}
+		return true
+	}
+	return false
+}
+
+// pruneBrokenEnvs removes broken virtual environments regardless of their age,
+// except for the ones from keep, and returns the number of removed ones.
+// Virtual environments which are locked (e.g. are being created right now) or
+// used by a running process are skipped
+func pruneBrokenEnvs(keep []string) (int, error) {
+	envs, err := listEnvs()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, env := range envs {
+		if isEnvKept(env, keep) || isEnvLocked(env.Dir) || !isEnvBroken(env.Dir) {
+			continue
+		}
+		if pruneBrokenEnv(env) {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// pruneBrokenEnv removes the broken virtual environment while holding its lock
+func pruneBrokenEnv(env *EnvIndexEntry) bool {
+	locked, err := tryLockEnv(env.Dir)
+	if err != nil || !locked {
+		if flagDebug && err != nil {
+			loggerErr.Println(err)
+		}
+		return false
+	}
+	defer unlockEnv(env.Dir)
+
+	// The virtual environment could have been recreated before the lock was
+	// acquired, so check again
+	if !isEnvBroken(env.Dir) {
+		return false
+	}
+	if _, err := findProcessWithPrefix(env.Dir); err != ErrNoProcessFound {
+		return false
+	}
+
+	if flagDebug {
+		loggerErr.Printf("Removing broken virtual environment %s...\n", env.Dir)
+	}
+	return removeCachedEnv(env.Dir)
+}
+
+// evictEnvsOverSize removes least recently used virtual environments, except
+// for the ones from keep, until their total size doesn't exceed maxSize and
+// returns the number of removed ones
+func evictEnvsOverSize(maxSize int64, keep []string) (int, error) {
+	startedAt := time.Now()
+	envs, err := listEnvs()
+	if err != nil {
+		return 0, err
+	}
+
+	var totalSize int64
+	for _, env := range envs {
+		if env.Size == 0 {
+			env.Size, err = getDirSize(env.Dir)
+			if err != nil && flagDebug {
+				loggerErr.Println(err)
+			}
+		}
+		totalSize += env.Size
+	}
+	if flagDebug {
+		loggerErr.Printf("Virtual environments use %d bytes, limit is %d bytes\n", totalSize, maxSize)
+	}
+
+	sort.Slice(envs, func(i, j int) bool {
+		return envs[i].LastUsedAt.Before(envs[j].LastUsedAt)
+	})
+
+	removed := 0
+	for _, env := range envs {
+		if totalSize <= maxSize {
+			break
+		}
+		if isEnvKept(env, keep) || isEnvLocked(env.Dir) {
+			continue
+		}
+		if flagDebug {
+			loggerErr.Printf("Removing least recently used virtual environment %s...\n", env.Dir)
+		}
+		if evictEnv(env, startedAt) {
+			totalSize -= env.Size
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// evictEnv removes the least recently used virtual environment while holding
+// its lock, unless it was used after since or is used by a running process
+func evictEnv(env *EnvIndexEntry, since time.Time) bool {
+	locked, err := tryLockEnv(env.Dir)
+	if err != nil || !locked {
+		if flagDebug && err != nil {
+			loggerErr.Println(err)
+		}
+		return false
+	}
+	defer unlockEnv(env.Dir)
+
+	// Another process could have used the virtual environment after the
+	// virtual environments were sorted, so check again
+	if reloadEnvIndexEntry(env).LastUsedAt.After(since) {
+		return false
+	}
+	if _, err := findProcessWithPrefix(env.Dir); err != ErrNoProcessFound {
+		return false
+	}
+
+	return removeCachedEnv(env.Dir)
+}
+
+// removeUnusedEnv removes the virtual environment while holding its lock,
+// unless it is used by a running process
+func removeUnusedEnv(env *EnvIndexEntry) bool {
+	locked, err := tryLockEnv(env.Dir)
+	if err != nil || !locked {
+		if flagDebug && err != nil {
+			loggerErr.Println(err)
+		}
+		return false
+	}
+	defer unlockEnv(env.Dir)
+
+	if _, err := findProcessWithPrefix(env.Dir); err != ErrNoProcessFound {
+		return false
+	}
+
+	return removeCachedEnv(env.Dir)
+}
+
+// removeOrphanedTempDirs removes temporary directories left by virtual
+// environment builds which were killed, and returns the number of removed
+// ones. They are removed by the next build of the same virtual environment,
+// which may never happen. Directories of builds which hold the lock of the
+// virtual environment or are younger than maxAge are skipped
+func removeOrphanedTempDirs(maxAge time.Duration) (int, error) {
+	envsDir, err := getEnvironmentDir()
+	if err != nil {
+		return 0, err
+	}
+	dirs, err := filepath.Glob(filepath.Join(envsDir, "*.env.tmp-*"))
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, dir := range dirs {
+		match := tempEnvDirRegexp.FindStringSubmatch(dir)
+		if match == nil {
+			continue
+		}
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if removeOrphanedTempDir(match[1], dir) {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// removeOrphanedTempDir removes the temporary directory of the virtual
+// environment build while holding the lock of the virtual environment
+func removeOrphanedTempDir(envDir string, tempDir string) bool {
+	locked, err := tryLockEnv(envDir)
+	if err != nil || !locked {
+		if flagDebug && err != nil {
+			loggerErr.Println(err)
+		}
+		return false
+	}
+	defer unlockEnv(envDir)
+
+	if flagDebug {
+		loggerErr.Printf("Removing leftover temporary directory %s...\n", tempDir)
+	}
+	err = removeDir(tempDir)
+	if err != nil {
+		if flagDebug {
+			loggerErr.Println(err)
+		}
+		return false
+	}
+	return true
+}
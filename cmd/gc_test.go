@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoveOrphanedTempDirs(t *testing.T) {
+	flagEnvDir = t.TempDir()
+	defer func() { flagEnvDir = "" }()
+
+	old := time.Now().Add(-2 * OrphanedTempDirAge)
+	orphaned := filepath.Join(flagEnvDir, "orphaned.env.tmp-123")
+	fresh := filepath.Join(flagEnvDir, "fresh.env.tmp-456")
+	building := filepath.Join(flagEnvDir, "building.env.tmp-789")
+	for _, dir := range []string{orphaned, fresh, building} {
+		err := os.MkdirAll(filepath.Join(dir, "bin"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{orphaned, building} {
+		err := os.Chtimes(dir, old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buildingEnv := filepath.Join(flagEnvDir, "building.env")
+	locked, err := tryLockEnv(buildingEnv)
+	if err != nil || !locked {
+		t.Fatalf("failed to lock %s: %v", buildingEnv, err)
+	}
+	defer unlockEnv(buildingEnv)
+
+	removed, err := removeOrphanedTempDirs(OrphanedTempDirAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("expected 1 removed directory, got %d", removed)
+	}
+	if _, err := os.Stat(orphaned); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", orphaned)
+	}
+	for _, dir := range []string{fresh, building} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("expected %s to be kept: %s", dir, err)
+		}
+	}
+}
+
+func TestNewGCPolicyMaxAge(t *testing.T) {
+	tests := []struct {
+		maxAge   string
+		expected time.Duration
+		err      bool
+	}{
+		{"", StaleEnvironmentTime, false},
+		{"14d", 14 * 24 * time.Hour, false},
+		{"720h", 720 * time.Hour, false},
+		{"2w", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.maxAge, func(t *testing.T) {
+			t.Setenv("INVENV_STALE_AFTER", "")
+			policy, err := newGCPolicy(&GCConfig{MaxAge: test.maxAge})
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %s", policy.MaxAge)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy.MaxAge != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, policy.MaxAge)
+			}
+		})
+	}
+}
+
+func TestEvictEnvSkipsRecentlyUsed(t *testing.T) {
+	flagEnvDir = t.TempDir()
+	defer func() { flagEnvDir = "" }()
+
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	unused := filepath.Join(flagEnvDir, "unused.env")
+	reused := filepath.Join(flagEnvDir, "reused.env")
+	index := &EnvIndex{Envs: map[string]*EnvIndexEntry{}, Scripts: map[string]string{}}
+	for _, dir := range []string{unused, reused} {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(dir, old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index.Envs[dir] = &EnvIndexEntry{ID: filepath.Base(dir), Dir: dir, LastUsedAt: old}
+	}
+	err := index.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	envs, err := listEnvs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := time.Now()
+
+	// Another process uses the virtual environment after it was listed
+	index.Envs[reused].LastUsedAt = time.Now().Add(time.Second)
+	err = index.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, env := range envs {
+		removed := evictEnv(env, since)
+		if removed != (env.Dir == unused) {
+			t.Errorf("expected %s to be removed: %t, got %t", env.Dir, env.Dir == unused, removed)
+		}
+	}
+	if _, err := os.Stat(reused); err != nil {
+		t.Errorf("expected %s to be kept: %s", reused, err)
+	}
+}
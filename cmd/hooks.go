@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+// newShellCommand creates a command which runs the command line with the
+// system shell
+func newShellCommand(commandLine string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", commandLine)
+	}
+	return exec.Command("sh", "-c", commandLine)
+}
+
+// runAfterRunHook runs the --after-run hook after the script finished. The
+// hook runs with the virtual environment activated and the exit code of the
+// script in INVENV_EXIT_CODE
+func runAfterRunHook(hook string, envDir string, cmdEnv []string, exitCode int) error {
+	binDir := filepath.Dir(venvBinPath(envDir, "python"))
+
+	hookCmd := newShellCommand(hook)
+	hookCmd.Env = append(cmdEnv,
+		"VIRTUAL_ENV="+envDir,
+		"PATH="+binDir+string(os.PathListSeparator)+os.Getenv("PATH"),
+		"INVENV_EXIT_CODE="+strconv.Itoa(exitCode),
+	)
+	hookCmd.Stdout = os.Stdout
+	hookCmd.Stderr = os.Stderr
+
+	if flagDebug {
+		loggerErr.Printf("Running after-run hook: %s\n", hook)
+	}
+	err := hookCmd.Run()
+	if err != nil {
+		return fmt.Errorf("after-run hook failed: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// RequirementsSnapshotFilename is the name of the file in the virtual
+// environment created with init command which stores requirements it was
+// built from. It is used to update the virtual environment incrementally
+const RequirementsSnapshotFilename = ".venv.requirements"
+
+// requirementNameRegexp matches the project name at the beginning of a
+// requirement specifier
+var requirementNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*`)
+
+// readRequirementLines returns requirement lines of the requirements file and
+// all files it includes, without comments, empty lines and includes
+func readRequirementLines(requirementsFile string) ([]string, error) {
+	files, err := collectRequirementFiles(requirementsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, f := range files {
+		file, err := os.Open(f)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if _, ok := parseRequirementInclude(line); ok {
+				continue
+			}
+			if _, ok := parseConstraintInclude(line); ok {
+				continue
+			}
+			if idx := strings.Index(line, "#"); idx != -1 {
+				line = line[:idx]
+			}
+			line = strings.TrimSpace(line)
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
+}
+
+// getRequirementName returns the normalized project name of the requirement
+// line or an empty string if the line is not a simple requirement specifier
+// (e.g. an option or a URL)
+func getRequirementName(line string) string {
+	if strings.HasPrefix(line, "-") || strings.Contains(line, "://") {
+		return ""
+	}
+	name := requirementNameRegexp.FindString(line)
+	return strings.ToLower(strings.NewReplacer("_", "-", ".", "-").Replace(name))
+}
+
+// saveRequirementsSnapshot stores the requirements the virtual environment was
+// built from
+func (s *Script) saveRequirementsSnapshot() error {
+	var lines []string
+	if s.RequirementsPath != "" && s.requirementsSource == RequirementsSourcePip {
+		var err error
+		lines, err = readRequirementLines(s.RequirementsPath)
+		if err != nil {
+			return err
+		}
+	}
+	snapshotFilename := path.Join(s.EnvDir, RequirementsSnapshotFilename)
+	return os.WriteFile(snapshotFilename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// updateEnvIncrementally updates the existing virtual environment to match
+// the current requirements instead of recreating it: changed and new
+// requirements are installed, removed ones are uninstalled. This is a
+// heuristic (transitive dependencies are not uninstalled, for example), so
+// `pip check` is run afterwards and an error is returned if the virtual
+// environment is inconsistent
+func (s *Script) updateEnvIncrementally() error {
+	if s.requirementsSource != RequirementsSourcePip {
+		return fmt.Errorf("incremental update is only supported for requirements files")
+	}
+	if s.backend == BackendUV {
+		return fmt.Errorf("incremental update is not supported with %s backend: its virtual environments have no pip", BackendUV)
+	}
+	err := s.checkEnvInfoForUpdate()
+	if err != nil {
+		return err
+	}
+
+	// A virtual environment copied or moved from another project can't be
+	// updated, its executables would modify the original one
+	location, err := os.ReadFile(path.Join(s.EnvDir, VEnvLocationFilename))
+	if err != nil || string(location) != s.EnvDir {
+		return fmt.Errorf("virtual environment was created in another location")
+	}
+
+	dataBytes, err := os.ReadFile(path.Join(s.EnvDir, RequirementsSnapshotFilename))
+	if err != nil {
+		return fmt.Errorf("previous requirements are unknown: %s", err)
+	}
+	var oldLines []string
+	for _, line := range strings.Split(string(dataBytes), "\n") {
+		if line != "" {
+			oldLines = append(oldLines, line)
+		}
+	}
+
+	var newLines []string
+	if s.RequirementsPath != "" {
+		newLines, err = readRequirementLines(s.RequirementsPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	oldSet := make(map[string]bool)
+	for _, line := range oldLines {
+		oldSet[line] = true
+	}
+	newSet := make(map[string]bool)
+	newNames := make(map[string]bool)
+	for _, line := range newLines {
+		newSet[line] = true
+		newNames[getRequirementName(line)] = true
+	}
+
+	changed := 0
+	for _, line := range newLines {
+		if !oldSet[line] {
+			changed++
+		}
+	}
+
+	var removedNames []string
+	for _, line := range oldLines {
+		if newSet[line] {
+			continue
+		}
+		name := getRequirementName(line)
+		if name == "" {
+			return fmt.Errorf("unable to uninstall removed requirement %q", line)
+		}
+		if !newNames[name] {
+			removedNames = append(removedNames, name)
+		}
+	}
+
+	if flagDebug {
+		loggerErr.Printf("Incremental update: %d changed requirements, %d removed\n", changed, len(removedNames))
+	}
+
+	if changed > 0 {
+		err = s.InstallRequirementsInEnv()
+		if err != nil {
+			return err
+		}
+	}
+
+	var output []string
+	pip := venvBinPath(s.EnvDir, "pip")
+	if len(removedNames) > 0 {
+		name, args := s.wrapCommand(pip, append([]string{"uninstall", "--yes"}, removedNames...)...)
+		output, err = execCmdSilent(name, args...)
+		if err != nil {
+			printCommandFailure("Uninstalling removed requirements", name, args, output, err)
+			return fmt.Errorf("failed to uninstall removed requirements: %s", err)
+		}
+	}
+
+	name, args := s.wrapCommand(pip, "check")
+	output, err = execCmdSilent(name, args...)
+	if err != nil {
+		if flagDebug {
+			loggerErr.Println(strings.Join(output, "\n"))
+		}
+		return fmt.Errorf("virtual environment is inconsistent after incremental update")
+	}
+
+	return s.saveRequirementsSnapshot()
+}
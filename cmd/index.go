@@ -0,0 +1,434 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EnvIndexFilename is the name of the index file in the environments directory.
+// The index allows management commands to get information about all virtual
+// environments without walking the environments directory
+const EnvIndexFilename = "index.json"
+
+// EnvIndexLockFilename is the name of the lock file which serializes updates
+// of the index file
+const EnvIndexLockFilename = "index.lock"
+
+// EnvIndexEntry describes a single virtual environment
+type EnvIndexEntry struct {
+	ID               string    `json:"id"`
+	Dir              string    `json:"dir"`
+	RequirementsHash string    `json:"requirements_hash"`
+	PythonVersion    string    `json:"python_version"`
+	CreatedAt        time.Time `json:"created_at"`
+	LastUsedAt       time.Time `json:"last_used_at"`
+	Size             int64     `json:"size"`
+	Requirements     []string  `json:"requirements,omitempty"` // Normalized, compared by --rebuild-cooldown
+}
+
+// EnvIndex holds metadata of all virtual environments in the environments
+// directory, keyed by the virtual environment directory. Scripts maps the
+// absolute path of a script to the virtual environment it was last run in.
+// Projects maps the directory initialized with init command to its virtual
+// environment created with --venv-dir outside of the directory
+type EnvIndex struct {
+	Envs     map[string]*EnvIndexEntry `json:"envs"`
+	Scripts  map[string]string         `json:"scripts"`
+	Projects map[string]string         `json:"projects,omitempty"`
+}
+
+func getEnvIndexFilename() (string, error) {
+	envsDir, err := getEnvironmentDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(envsDir, EnvIndexFilename), nil
+}
+
+// withEnvIndexLock runs fn while holding the lock of the index file. Every
+// read-modify-write cycle of the index must run in it, otherwise concurrent
+// processes overwrite each other's updates
+func withEnvIndexLock(fn func() error) error {
+	envsDir, err := getEnvironmentDir()
+	if err != nil {
+		return err
+	}
+	return withFileLock(path.Join(envsDir, EnvIndexLockFilename), fn)
+}
+
+// loadEnvIndex reads the index file. An error is returned if the index is
+// missing or corrupted
+func loadEnvIndex() (*EnvIndex, error) {
+	indexFilename, err := getEnvIndexFilename()
+	if err != nil {
+		return nil, err
+	}
+
+	dataBytes, err := os.ReadFile(indexFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &EnvIndex{}
+	err = json.Unmarshal(dataBytes, index)
+	if err != nil {
+		return nil, fmt.Errorf("corrupted index file %s: %s", indexFilename, err)
+	}
+	if index.Envs == nil {
+		index.Envs = make(map[string]*EnvIndexEntry)
+	}
+	if index.Scripts == nil {
+		index.Scripts = make(map[string]string)
+	}
+	if index.Projects == nil {
+		index.Projects = make(map[string]string)
+	}
+	return index, nil
+}
+
+// loadOrCreateEnvIndex reads the index file. If it is missing or corrupted,
+// the index is rebuilt from the environments directory
+func loadOrCreateEnvIndex() *EnvIndex {
+	index, err := loadEnvIndex()
+	if err == nil {
+		return index
+	}
+	if flagDebug && !os.IsNotExist(err) {
+		loggerErr.Println(err)
+	}
+	index = &EnvIndex{
+		Envs:     make(map[string]*EnvIndexEntry),
+		Scripts:  make(map[string]string),
+		Projects: make(map[string]string),
+	}
+	index.addWalkedEnvs()
+	return index
+}
+
+// addWalkedEnvs adds virtual environments from the environments directory
+// which have no entry in the index. Only information available from the file
+// system is filled in
+func (idx *EnvIndex) addWalkedEnvs() {
+	envs, err := walkEnvs()
+	if err != nil {
+		if flagDebug && !os.IsNotExist(err) {
+			loggerErr.Println(err)
+		}
+		return
+	}
+	for _, entry := range envs {
+		if _, ok := idx.Envs[entry.Dir]; !ok {
+			if flagDebug {
+				loggerErr.Printf("Adding virtual environment %s to the index\n", entry.Dir)
+			}
+			idx.Envs[entry.Dir] = entry
+		}
+	}
+}
+
+// Save writes the index file. The file is replaced atomically so concurrent
+// readers never see a partially written index
+func (idx *EnvIndex) Save() error {
+	indexFilename, err := getEnvIndexFilename()
+	if err != nil {
+		return err
+	}
+
+	dataBytes, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(indexFilename), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpFilename := fmt.Sprintf("%s.tmp-%d", indexFilename, os.Getpid())
+	err = os.WriteFile(tmpFilename, dataBytes, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, indexFilename)
+}
+
+// recordEnvInIndex updates the index entry of the script's virtual environment.
+// If built is true, the environment was just (re)created
+func recordEnvInIndex(s *Script, built bool) error {
+	return withEnvIndexLock(func() error {
+		index := loadOrCreateEnvIndex()
+		now := time.Now()
+
+		entry, ok := index.Envs[s.EnvDir]
+		if !ok || built {
+			entry = &EnvIndexEntry{
+				ID:        s.venvID,
+				Dir:       s.EnvDir,
+				CreatedAt: now,
+			}
+			index.Envs[s.EnvDir] = entry
+		}
+		if entry.Size == 0 {
+			// Entries rebuilt from the environments directory have no size
+			size, err := getDirSize(s.EnvDir)
+			if err != nil && flagDebug {
+				loggerErr.Printf("Failed to calculate size of %s: %s\n", s.EnvDir, err)
+			}
+			entry.Size = size
+		}
+		if entry.Requirements == nil || entry.RequirementsHash != s.requirementsHash {
+			entry.Requirements = s.getNormalizedRequirements()
+		}
+		entry.RequirementsHash = s.requirementsHash
+		entry.PythonVersion = s.pythonVersion
+		entry.LastUsedAt = now
+		if !isStdinScript(s.AbsolutePath) {
+			index.Scripts[s.AbsolutePath] = s.EnvDir
+		}
+		return index.Save()
+	})
+}
+
+// recordProjectInIndex records the virtual environment of the directory
+// initialized with init command. The association is removed if the virtual
+// environment is in the default location inside of the directory
+func recordProjectInIndex(projectDir string, envDir string) error {
+	return withEnvIndexLock(func() error {
+		index := loadOrCreateEnvIndex()
+		if envDir == path.Join(projectDir, VEnvDirDefaultName) {
+			if _, ok := index.Projects[projectDir]; !ok {
+				return nil
+			}
+			delete(index.Projects, projectDir)
+		} else {
+			index.Projects[projectDir] = envDir
+		}
+		return index.Save()
+	})
+}
+
+// getProjectEnvDir returns the virtual environment recorded for the directory
+// initialized with init command and --venv-dir. An empty string is returned if
+// there is no such virtual environment
+func getProjectEnvDir(projectDir string) string {
+	index, err := loadEnvIndex()
+	if err != nil {
+		return ""
+	}
+	envDir, ok := index.Projects[projectDir]
+	if !ok {
+		return ""
+	}
+	if _, err := os.Stat(envDir); err != nil {
+		return ""
+	}
+	return envDir
+}
+
+// removeEnvFromIndex removes the virtual environment from the index
+func removeEnvFromIndex(envDir string) error {
+	return withEnvIndexLock(func() error {
+		index, err := loadEnvIndex()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if _, ok := index.Envs[envDir]; !ok {
+			return nil
+		}
+		delete(index.Envs, envDir)
+		for script, scriptEnvDir := range index.Scripts {
+			if scriptEnvDir == envDir {
+				delete(index.Scripts, script)
+			}
+		}
+		return index.Save()
+	})
+}
+
+// listEnvs returns all virtual environments in the environments directory,
+// sorted by the directory name. It uses the index file and falls back to
+// walking the environments directory if the index is missing or corrupted.
+// Virtual environments which have no entry in the index are included too
+func listEnvs() ([]*EnvIndexEntry, error) {
+	var envs []*EnvIndexEntry
+
+	index, err := loadEnvIndex()
+	if err == nil {
+		index.addWalkedEnvs()
+		for _, entry := range index.Envs {
+			envs = append(envs, entry)
+		}
+	} else {
+		if flagDebug {
+			loggerErr.Printf("Failed to load index, walking environments directory: %s\n", err)
+		}
+		envs, err = walkEnvs()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(envs, func(i, j int) bool {
+		return envs[i].Dir < envs[j].Dir
+	})
+	return envs, nil
+}
+
+// walkEnvs collects information about virtual environments by walking the
+// environments directory. Only information available from the file system
+// is filled in
+func walkEnvs() ([]*EnvIndexEntry, error) {
+	envsDir, err := getEnvironmentDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(envsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var envs []*EnvIndexEntry
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasSuffix(entry.Name(), ".env") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if flagDebug {
+				loggerErr.Println(err)
+			}
+			continue
+		}
+		envs = append(envs, &EnvIndexEntry{
+			ID:         strings.TrimSuffix(entry.Name(), ".env"),
+			Dir:        path.Join(envsDir, entry.Name()),
+			CreatedAt:  info.ModTime(),
+			LastUsedAt: info.ModTime(),
+		})
+	}
+	return envs, nil
+}
+
+// touchEnvInIndex marks the virtual environment as recently used
+func touchEnvInIndex(envDir string, usedAt time.Time) error {
+	return withEnvIndexLock(func() error {
+		index := loadOrCreateEnvIndex()
+		entry, ok := index.Envs[envDir]
+		if !ok {
+			entry = &EnvIndexEntry{
+				ID:        strings.TrimSuffix(path.Base(envDir), ".env"),
+				Dir:       envDir,
+				CreatedAt: usedAt,
+			}
+			index.Envs[envDir] = entry
+		}
+		entry.LastUsedAt = usedAt
+		return index.Save()
+	})
+}
+
+// getTrustedScript returns the Script with the virtual environment the script
+// was last run in, without any validation. nil is returned if the script was
+// not run before or its virtual environment doesn't exist anymore. The virtual
+// environment is marked as used, so it isn't removed as stale
+func getTrustedScript(scriptName string) *Script {
+	scriptPath, err := filepath.Abs(scriptName)
+	if err != nil {
+		return nil
+	}
+
+	index, err := loadEnvIndex()
+	if err != nil {
+		return nil
+	}
+
+	envDir, ok := index.Scripts[scriptPath]
+	if !ok {
+		return nil
+	}
+	if _, err := os.Stat(envDir); err != nil {
+		return nil
+	}
+
+	if flagDebug {
+		loggerErr.Println("Trusting cached virtual environment: ", envDir)
+	}
+	script := &Script{
+		AbsolutePath: scriptPath,
+		EnvDir:       envDir,
+	}
+	if entry, ok := index.Envs[envDir]; ok {
+		script.venvID = entry.ID
+		script.requirementsHash = entry.RequirementsHash
+		script.pythonVersion = entry.PythonVersion
+	}
+
+	now := time.Now()
+	err = os.Chtimes(envDir, now, now)
+	if err != nil && flagDebug {
+		loggerErr.Printf("Failed to update modification time of %s: %s\n", envDir, err)
+	}
+	err = touchEnvInIndex(envDir, now)
+	if err != nil && flagDebug {
+		loggerErr.Printf("Failed to update environments index: %s\n", err)
+	}
+	return script
+}
+
+// applyRebuildCooldown reuses the virtual environment the script was last run
+// in, if it was built less than cooldown ago and the virtual environment for
+// the current requirements doesn't exist yet. It avoids rebuilding the virtual
+// environment on every change while requirements are actively edited. If the
+// requirements changed too much (see isRequirementsChangeSmall), the virtual
+// environment is rebuilt anyway. A warning is always printed when an outdated
+// virtual environment is reused
+func (s *Script) applyRebuildCooldown(cooldown time.Duration) {
+	if _, err := os.Stat(s.EnvDir); err == nil {
+		// Nothing to rebuild
+		return
+	}
+
+	index, err := loadEnvIndex()
+	if err != nil {
+		return
+	}
+	lastEnvDir, ok := index.Scripts[s.AbsolutePath]
+	if !ok || lastEnvDir == s.EnvDir {
+		return
+	}
+	entry, ok := index.Envs[lastEnvDir]
+	if !ok || time.Since(entry.CreatedAt) > cooldown {
+		return
+	}
+	if entry.PythonVersion != s.pythonVersion {
+		// A different interpreter always requires a rebuild
+		return
+	}
+	if !isRequirementsChangeSmall(entry.Requirements, s.getNormalizedRequirements()) {
+		if flagDebug {
+			loggerErr.Println("Requirements changed too much to reuse the outdated virtual environment")
+		}
+		return
+	}
+	if _, err := os.Stat(lastEnvDir); err != nil {
+		return
+	}
+
+	loggerErr.Printf(
+		"\nWarning: requirements changed, but the virtual environment was built %s ago. Reusing the outdated virtual environment %s because of --rebuild-cooldown\n",
+		time.Since(entry.CreatedAt).Round(time.Second), lastEnvDir,
+	)
+	s.EnvDir = lastEnvDir
+	s.venvID = entry.ID
+	s.requirementsHash = entry.RequirementsHash
+}
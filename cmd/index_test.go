@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentIndexUpdates(t *testing.T) {
+	flagEnvDir = t.TempDir()
+	defer func() { flagEnvDir = "" }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			projectDir := fmt.Sprintf("/projects/%d", i)
+			err := recordProjectInIndex(projectDir, path.Join(flagEnvDir, fmt.Sprintf("%d.env", i)))
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	index, err := loadEnvIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Projects) != 200 {
+		t.Errorf("expected 200 projects in the index, got %d", len(index.Projects))
+	}
+}
+
+func TestListEnvsIncludesUnindexedEnvs(t *testing.T) {
+	flagEnvDir = t.TempDir()
+	defer func() { flagEnvDir = "" }()
+
+	indexed := path.Join(flagEnvDir, "indexed.env")
+	unindexed := path.Join(flagEnvDir, "unindexed.env")
+	for _, dir := range []string{indexed, unindexed} {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	index := &EnvIndex{
+		Envs:    map[string]*EnvIndexEntry{indexed: {ID: "indexed", Dir: indexed}},
+		Scripts: map[string]string{},
+	}
+	err := index.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envs, err := listEnvs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envs) != 2 || envs[0].Dir != indexed || envs[1].Dir != unindexed {
+		t.Errorf("expected %s and %s, got %v", indexed, unindexed, envs)
+	}
+}
+
+func TestTrustedScriptIsTouched(t *testing.T) {
+	flagEnvDir = t.TempDir()
+	defer func() { flagEnvDir = "" }()
+
+	envDir := path.Join(flagEnvDir, "trusted.env")
+	err := os.Mkdir(envDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scriptPath := path.Join(flagEnvDir, "script.py")
+	lastUsedAt := time.Now().Add(-30 * 24 * time.Hour)
+	index := &EnvIndex{
+		Envs:    map[string]*EnvIndexEntry{envDir: {ID: "trusted", Dir: envDir, LastUsedAt: lastUsedAt}},
+		Scripts: map[string]string{scriptPath: envDir},
+	}
+	err = index.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if getTrustedScript(scriptPath) == nil {
+		t.Fatal("expected the trusted script")
+	}
+	index, err = loadEnvIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.Envs[envDir].LastUsedAt.After(lastUsedAt) {
+		t.Errorf("expected last used time to be updated, got %s", index.Envs[envDir].LastUsedAt)
+	}
+}
+
+func TestStdinScriptIsNotIndexed(t *testing.T) {
+	flagEnvDir = t.TempDir()
+	defer func() { flagEnvDir = "" }()
+
+	tmpDir, err := os.MkdirTemp(t.TempDir(), StdinDirPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scriptPath := path.Join(tmpDir, StdinScriptName)
+	envDir := path.Join(flagEnvDir, "stdin.env")
+	err = os.Mkdir(envDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = recordEnvInIndex(&Script{AbsolutePath: scriptPath, EnvDir: envDir, venvID: "stdin"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := loadEnvIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := index.Envs[envDir]; !ok {
+		t.Errorf("expected %s in the index", envDir)
+	}
+	if _, ok := index.Scripts[scriptPath]; ok {
+		t.Errorf("expected %s not to be recorded in the index", scriptPath)
+	}
+}
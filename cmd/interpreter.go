@@ -0,0 +1,524 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// PyLauncherPrefix selects the interpreter with the Python launcher for
+// Windows, e.g. py:-3.11 or py:-3.11-64 (PEP 514 tags)
+const PyLauncherPrefix = "py:"
+
+// PyenvPrefix selects the interpreter of the installed pyenv version, e.g.
+// pyenv:3.11.8
+const PyenvPrefix = "pyenv:"
+
+// DefaultPythonFallback is the interpreter used if no interpreter is selected
+// for the script and no fallback chain is configured
+const DefaultPythonFallback = "python"
+
+// getPythonFallback returns the chain of interpreters which are tried in order
+// if no interpreter is selected for the script. --python-fallback takes
+// precedence over python_fallback from the configuration file
+func getPythonFallback() []string {
+	if len(flagPythonFallback) > 0 {
+		return flagPythonFallback
+	}
+	config, err := loadConfig()
+	if err != nil {
+		if flagDebug {
+			loggerErr.Println(err)
+		}
+	} else if len(config.PythonFallback) > 0 {
+		return config.PythonFallback
+	}
+	return []string{DefaultPythonFallback}
+}
+
+// findPythonInterpreter checks that the interpreter exists. If it doesn't,
+// or no interpreter was selected (an empty string), the first interpreter
+// from the fallback chain which exists is returned. An interpreter provided
+// with --python must exist
+func findPythonInterpreter(pythonInterpreter string, isOverride bool) (string, error) {
+	if pythonInterpreter != "" {
+		_, err := exec.LookPath(pythonInterpreter)
+		if err == nil {
+			return pythonInterpreter, nil
+		}
+		if isOverride {
+			return "", fmt.Errorf("failed to find python interpreter %s: %s", pythonInterpreter, err)
+		}
+		if flagDebug {
+			loggerErr.Printf("Failed to find python interpreter %s: %s, trying fallback interpreters...\n", pythonInterpreter, err)
+		}
+	}
+
+	fallback := getPythonFallback()
+	for _, candidate := range fallback {
+		_, err := exec.LookPath(candidate)
+		if err == nil {
+			if flagDebug {
+				loggerErr.Printf("Selected python interpreter %s from fallback chain %s\n", candidate, strings.Join(fallback, ","))
+			}
+			return candidate, nil
+		}
+		if flagDebug {
+			loggerErr.Printf("Failed to find fallback python interpreter %s: %s\n", candidate, err)
+		}
+	}
+	return "", fmt.Errorf("failed to find python interpreter, tried %s", strings.Join(fallback, ", "))
+}
+
+// pythonVersionSpecRegexp matches a bare Python version provided with
+// --python, e.g. 3 or 3.11
+var pythonVersionSpecRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+){0,2}$`)
+
+// resolveInterpreterOverride resolves the interpreter provided with --python
+// into an executable. A bare version (e.g. 3.11) is resolved with
+// resolvePythonVersionSpec. pyenv:<version> is resolved with resolvePyenvVersion.
+// A multi-word value is a wrapper command which runs the
+// interpreter, e.g. "docker run --rm -v$PWD:$PWD image python". The last word
+// is the interpreter, the rest is returned as the wrapper
+func resolveInterpreterOverride(override string) (string, []string, error) {
+	if strings.HasPrefix(override, PyLauncherPrefix) {
+		interpreter, err := resolvePyLauncher(strings.TrimPrefix(override, PyLauncherPrefix))
+		return interpreter, nil, err
+	}
+
+	if strings.HasPrefix(override, PyenvPrefix) {
+		interpreter, err := resolvePyenvVersion(strings.TrimPrefix(override, PyenvPrefix))
+		return interpreter, nil, err
+	}
+
+	if pythonVersionSpecRegexp.MatchString(override) {
+		interpreter, err := resolvePythonVersionSpec(override)
+		return interpreter, nil, err
+	}
+
+	if _, err := exec.LookPath(override); err == nil {
+		// Paths with spaces, e.g. C:\Program Files\Python311\python.exe
+		return override, nil, nil
+	}
+
+	words, err := splitCommandLine(override)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse python interpreter %q: %s", override, err)
+	}
+	if len(words) < 2 {
+		return override, nil, nil
+	}
+	wrapper := words[:len(words)-1]
+	_, err = exec.LookPath(wrapper[0])
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to find python interpreter wrapper %s: %s", wrapper[0], err)
+	}
+	if flagDebug {
+		loggerErr.Printf("Running python interpreter %s with wrapper %s\n", words[len(words)-1], strings.Join(wrapper, " "))
+	}
+	return words[len(words)-1], wrapper, nil
+}
+
+// splitCommandLine splits the command into words. Words are separated by
+// whitespace, single and double quotes group words (without any escaping)
+func splitCommandLine(command string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	for _, r := range command {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote %c", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// wrapCommand prepends the interpreter wrapper (see resolveInterpreterOverride)
+// to the command
+func wrapCommand(wrapper []string, name string, args ...string) (string, []string) {
+	if len(wrapper) == 0 {
+		return name, args
+	}
+	wrappedArgs := append([]string{}, wrapper[1:]...)
+	wrappedArgs = append(wrappedArgs, name)
+	return wrapper[0], append(wrappedArgs, args...)
+}
+
+// getInterpreterPath returns the absolute path of the Python interpreter with
+// symlinks resolved. Interpreters with the same version (e.g. the system one
+// and the one installed with pyenv) have different paths, while aliases of the
+// same interpreter (python3 and python3.11) have the same path. An interpreter
+// run with a wrapper isn't on the host, so the whole command identifies it
+func getInterpreterPath(wrapper []string, pythonInterpreter string) (string, error) {
+	if len(wrapper) > 0 {
+		return strings.Join(append(append([]string{}, wrapper...), pythonInterpreter), " "), nil
+	}
+	interpreterPath, err := exec.LookPath(pythonInterpreter)
+	if err != nil {
+		return "", err
+	}
+	interpreterPath, err = filepath.Abs(interpreterPath)
+	if err != nil {
+		return "", err
+	}
+	resolvedPath, err := filepath.EvalSymlinks(interpreterPath)
+	if err != nil {
+		if flagDebug {
+			loggerErr.Printf("Failed to resolve symlinks of %s: %s\n", interpreterPath, err)
+		}
+		return interpreterPath, nil
+	}
+	return resolvedPath, nil
+}
+
+// resolvePythonVersionSpec resolves a bare Python version (e.g. 3.11) into an
+// interpreter: python3.11 from PATH, the Python launcher for Windows (py -3.11)
+// or the interpreter installed with pyenv, in that order
+func resolvePythonVersionSpec(version string) (string, error) {
+	tried := []string{"python" + version}
+	interpreter, err := exec.LookPath("python" + version)
+	if err == nil {
+		return interpreter, nil
+	}
+	if validateOnly {
+		return "", fmt.Errorf("failed to find Python %s interpreter, tried %s (the Python launcher and pyenv aren't run with --validate or --dry-run)", version, strings.Join(tried, ", "))
+	}
+
+	if runtime.GOOS == "windows" {
+		tried = append(tried, "py -"+version)
+		interpreter, err = resolvePyLauncher(version)
+		if err == nil {
+			return interpreter, nil
+		}
+		if flagDebug {
+			loggerErr.Println(err)
+		}
+	}
+
+	if _, err := exec.LookPath("pyenv"); err == nil {
+		tried = append(tried, "pyenv")
+		// pyenv resolves a version prefix to the latest installed version
+		output, err := exec.Command("pyenv", "prefix", version).Output()
+		if err == nil {
+			interpreter = path.Join(strings.TrimSpace(string(output)), "bin", "python")
+			if _, err := os.Stat(interpreter); err == nil {
+				if flagDebug {
+					loggerErr.Printf("pyenv resolved Python %s to %s\n", version, interpreter)
+				}
+				return interpreter, nil
+			}
+		} else if flagDebug {
+			loggerErr.Printf("Failed to resolve Python %s with pyenv: %s\n", version, err)
+		}
+	}
+	return "", fmt.Errorf("failed to find Python %s interpreter, tried %s", version, strings.Join(tried, ", "))
+}
+
+// resolvePyenvVersion returns the interpreter of the version installed with
+// pyenv. Unlike pyenv shims, it doesn't depend on the version selected for the
+// current directory
+func resolvePyenvVersion(version string) (string, error) {
+	if version == "" {
+		return "", fmt.Errorf("pyenv version is not provided, expected e.g. %s3.11.8", PyenvPrefix)
+	}
+	if _, err := exec.LookPath("pyenv"); err != nil {
+		return "", fmt.Errorf("failed to find pyenv: %s", err)
+	}
+	if validateOnly {
+		return "", fmt.Errorf("pyenv isn't run with --validate or --dry-run")
+	}
+
+	output, err := exec.Command("pyenv", "root").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get pyenv root: %s", err)
+	}
+	versionDir := filepath.Join(strings.TrimSpace(string(output)), "versions", version)
+	if _, err := os.Stat(versionDir); err != nil {
+		return "", fmt.Errorf("Python %s is not installed with pyenv, install it with \"pyenv install %s\"", version, version)
+	}
+
+	// pyenv-win keeps the interpreter in the root of the version directory
+	interpreter := filepath.Join(versionDir, "bin", "python")
+	if runtime.GOOS == "windows" {
+		interpreter = filepath.Join(versionDir, "python.exe")
+	}
+	if _, err := os.Stat(interpreter); err != nil {
+		return "", fmt.Errorf("failed to find python interpreter of pyenv version %s: %s", version, err)
+	}
+	if flagDebug {
+		loggerErr.Printf("pyenv resolved Python %s to %s\n", version, interpreter)
+	}
+	return interpreter, nil
+}
+
+// resolvePyLauncher asks the Python launcher for Windows for the path of the
+// interpreter selected with the tag
+func resolvePyLauncher(tag string) (string, error) {
+	launcher, err := exec.LookPath("py")
+	if err != nil {
+		return "", fmt.Errorf("failed to find Python launcher: %s", err)
+	}
+	if validateOnly {
+		return "", fmt.Errorf("Python launcher isn't run with --validate or --dry-run")
+	}
+
+	args := []string{}
+	if tag != "" {
+		if !strings.HasPrefix(tag, "-") {
+			tag = "-" + tag
+		}
+		args = append(args, tag)
+	}
+	args = append(args, "-c", "import sys; print(sys.executable)")
+
+	output, err := exec.Command(launcher, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve Python %s with Python launcher: %s", tag, err)
+	}
+
+	interpreter := strings.TrimSpace(string(output))
+	if interpreter == "" {
+		return "", fmt.Errorf("no interpreter returned by Python launcher for %s", tag)
+	}
+	if flagDebug {
+		loggerErr.Printf("Python launcher resolved %s to %s\n", tag, interpreter)
+	}
+	return interpreter, nil
+}
+
+// parsePythonVersion parses the output of python --version (e.g.
+// "Python 3.11.4") or a version from a specifier (e.g. 3.11) into numbers.
+// Pre-release suffixes (e.g. 3.13.0rc1) are ignored
+func parsePythonVersion(version string) ([]int, error) {
+	version = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(version), "Python"))
+	var numbers []int
+	for _, part := range strings.Split(version, ".") {
+		digits := part
+		for i, c := range part {
+			if c < '0' || c > '9' {
+				digits = part[:i]
+				break
+			}
+		}
+		if digits == "" {
+			return nil, fmt.Errorf("invalid Python version %q", version)
+		}
+		number, err := strconv.Atoi(digits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Python version %q", version)
+		}
+		numbers = append(numbers, number)
+		if digits != part {
+			break
+		}
+	}
+	return numbers, nil
+}
+
+// comparePythonVersions compares versions number by number, missing numbers
+// are zeros. The result is -1, 0 or 1
+func comparePythonVersions(a []int, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+// matchesPythonSpecifier checks if the Python version satisfies the PEP 440
+// version specifier from requires-python, e.g. ">=3.9,<3.13" or "==3.11.*"
+func matchesPythonSpecifier(pythonVersion string, specifier string) (bool, error) {
+	version, err := parsePythonVersion(pythonVersion)
+	if err != nil {
+		return false, err
+	}
+
+	for _, clause := range strings.Split(specifier, ",") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		var operator string
+		for _, candidate := range []string{"===", "~=", "==", "!=", "<=", ">=", "<", ">"} {
+			if strings.HasPrefix(clause, candidate) {
+				operator = candidate
+				break
+			}
+		}
+		if operator == "" {
+			return false, fmt.Errorf("invalid requires-python specifier %q", specifier)
+		}
+		value := strings.TrimSpace(strings.TrimPrefix(clause, operator))
+
+		wildcard := strings.HasSuffix(value, ".*")
+		if wildcard && operator != "==" && operator != "!=" {
+			return false, fmt.Errorf("invalid requires-python specifier %q", specifier)
+		}
+		expected, err := parsePythonVersion(strings.TrimSuffix(value, ".*"))
+		if err != nil {
+			return false, fmt.Errorf("invalid requires-python specifier %q: %s", specifier, err)
+		}
+
+		var matches bool
+		switch operator {
+		case "==", "===", "!=":
+			if wildcard {
+				// Only the numbers before the wildcard are compared
+				matches = len(version) >= len(expected) && comparePythonVersions(version[:len(expected)], expected) == 0
+			} else {
+				matches = comparePythonVersions(version, expected) == 0
+			}
+			if operator == "!=" {
+				matches = !matches
+			}
+		case "~=":
+			// Compatible release: ~=3.9 is >=3.9,==3.*
+			if len(expected) < 2 {
+				return false, fmt.Errorf("invalid requires-python specifier %q", specifier)
+			}
+			prefix := expected[:len(expected)-1]
+			matches = comparePythonVersions(version, expected) >= 0 &&
+				len(version) >= len(prefix) && comparePythonVersions(version[:len(prefix)], prefix) == 0
+		case "<=":
+			matches = comparePythonVersions(version, expected) <= 0
+		case ">=":
+			matches = comparePythonVersions(version, expected) >= 0
+		case "<":
+			matches = comparePythonVersions(version, expected) < 0
+		case ">":
+			matches = comparePythonVersions(version, expected) > 0
+		}
+		if !matches {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// findPythonForSpecifier returns the first interpreter (and its version) which
+// satisfies requires-python of the script. Interpreters from the fallback
+// chain are tried first, then versioned interpreters (python3.20 down to
+// python3.6) from PATH
+func findPythonForSpecifier(specifier string) (string, string, error) {
+	candidates := getPythonFallback()
+	for minor := 20; minor >= 6; minor-- {
+		candidates = append(candidates, fmt.Sprintf("python3.%d", minor))
+	}
+	for _, candidate := range candidates {
+		if _, err := exec.LookPath(candidate); err != nil {
+			continue
+		}
+		version, err := getPythonVersion(nil, candidate)
+		if err != nil {
+			continue
+		}
+		matches, err := matchesPythonSpecifier(version, specifier)
+		if err != nil {
+			return "", "", err
+		}
+		if matches {
+			if flagDebug {
+				loggerErr.Printf("Selected python interpreter %s (%s) for requires-python %s\n", candidate, version, specifier)
+			}
+			return candidate, version, nil
+		}
+	}
+	return "", "", fmt.Errorf("failed to find python interpreter which satisfies requires-python %s", specifier)
+}
+
+// getRequiresPython returns requires-python of the script and where it was
+// declared. PEP 723 inline script metadata of the script (if scriptPath is not
+// empty) takes precedence over pyproject.toml in the directory
+func getRequiresPython(scriptPath string, dir string) (string, string, error) {
+	if scriptPath != "" {
+		requiresPython, err := readScriptRequiresPython(scriptPath)
+		if err != nil {
+			return "", "", err
+		}
+		if requiresPython != "" {
+			return requiresPython, scriptPath, nil
+		}
+	}
+	requiresPython, err := readProjectRequiresPython(dir)
+	if err != nil {
+		return "", "", err
+	}
+	return requiresPython, path.Join(dir, PyprojectFilename), nil
+}
+
+// checkRequiresPython verifies that the interpreter satisfies requires-python.
+// If it doesn't, another interpreter is searched for (see
+// findPythonForSpecifier), unless the interpreter was provided with --python or
+// --strict-python is set. The selected interpreter and its version are
+// returned
+func checkRequiresPython(requiresPython string, source string, pythonInterpreter string, pythonVersion string, isOverride bool) (string, string, error) {
+	if requiresPython == "" {
+		return pythonInterpreter, pythonVersion, nil
+	}
+	matches, err := matchesPythonSpecifier(pythonVersion, requiresPython)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %s", source, err)
+	}
+	if matches {
+		return pythonInterpreter, pythonVersion, nil
+	}
+
+	if flagStrictPython {
+		return "", "", fmt.Errorf("%s (%s) doesn't satisfy requires-python %s from %s, select another interpreter with --python",
+			pythonVersion, pythonInterpreter, requiresPython, source)
+	}
+	if isOverride {
+		loggerErr.Printf("Warning: %s doesn't satisfy requires-python %s from %s\n", pythonVersion, requiresPython, source)
+		return pythonInterpreter, pythonVersion, nil
+	}
+	if validateOnly {
+		// Searching runs every candidate interpreter
+		return "", "", fmt.Errorf("%s (%s) doesn't satisfy requires-python %s from %s, another interpreter isn't searched for with --validate or --dry-run",
+			pythonVersion, pythonInterpreter, requiresPython, source)
+	}
+	if flagDebug {
+		loggerErr.Printf("%s doesn't satisfy requires-python %s from %s, searching for another interpreter...\n", pythonVersion, requiresPython, source)
+	}
+	return findPythonForSpecifier(requiresPython)
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/go-cmd/cmd"
+)
+
+// setupState tracks commands started, virtual environments locked and
+// temporary directories created while the virtual environment is set up, so
+// they can be cleaned up if invenv is interrupted
+var setupState = struct {
+	sync.Mutex
+	cmds     map[*cmd.Cmd]struct{}
+	locks    map[string]struct{}
+	tempDirs map[string]struct{}
+}{
+	cmds:     make(map[*cmd.Cmd]struct{}),
+	locks:    make(map[string]struct{}),
+	tempDirs: make(map[string]struct{}),
+}
+
+// setupSignalChan receives signals while the setup signal handler is installed
+var setupSignalChan chan os.Signal
+
+// trackCmd registers the running command. The returned function unregisters
+// it and must be called once the command finishes
+func trackCmd(c *cmd.Cmd) func() {
+	setupState.Lock()
+	defer setupState.Unlock()
+	setupState.cmds[c] = struct{}{}
+	return func() {
+		setupState.Lock()
+		defer setupState.Unlock()
+		delete(setupState.cmds, c)
+	}
+}
+
+// trackLock registers the virtual environment locked by this process
+func trackLock(envDir string) {
+	setupState.Lock()
+	defer setupState.Unlock()
+	setupState.locks[envDir] = struct{}{}
+}
+
+// untrackLock unregisters the virtual environment unlocked by this process
+func untrackLock(envDir string) {
+	setupState.Lock()
+	defer setupState.Unlock()
+	delete(setupState.locks, envDir)
+}
+
+// trackTempDir registers the temporary directory the virtual environment is
+// built in, see buildEnvInTempDir
+func trackTempDir(dir string) {
+	setupState.Lock()
+	defer setupState.Unlock()
+	setupState.tempDirs[dir] = struct{}{}
+}
+
+// untrackTempDir unregisters the temporary directory
+func untrackTempDir(dir string) {
+	setupState.Lock()
+	defer setupState.Unlock()
+	delete(setupState.tempDirs, dir)
+}
+
+// handleSetupSignals installs the handler of SIGINT and SIGTERM which is used
+// until the script is started. Commands started by go-cmd run in their own
+// process group and don't receive the signal from the terminal, so the handler
+// stops them, removes lock files of this process and exits with 128+signal
+// (130 for SIGINT)
+func handleSetupSignals() {
+	if setupSignalChan != nil {
+		return
+	}
+	setupSignalChan = make(chan os.Signal, 1)
+	signal.Notify(setupSignalChan, os.Interrupt, syscall.SIGTERM)
+	go func(signalChan chan os.Signal) {
+		sig, ok := <-signalChan
+		if !ok {
+			return
+		}
+		loggerErr.Printf("\nReceived %s, cleaning up...\n", sig)
+		cleanupSetup()
+		code := 130
+		if s, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(s)
+		}
+		os.Exit(code)
+	}(setupSignalChan)
+}
+
+// stopSetupSignalHandler removes the handler installed by handleSetupSignals.
+// It must be called before the script is started, so signals reach the script
+func stopSetupSignalHandler() {
+	if setupSignalChan == nil {
+		return
+	}
+	signal.Stop(setupSignalChan)
+	close(setupSignalChan)
+	setupSignalChan = nil
+}
+
+// cleanupSetup stops running commands, removes temporary directories and
+// unlocks virtual environments locked by this process
+func cleanupSetup() {
+	setupState.Lock()
+	cmds := make([]*cmd.Cmd, 0, len(setupState.cmds))
+	for c := range setupState.cmds {
+		cmds = append(cmds, c)
+	}
+	locks := make([]string, 0, len(setupState.locks))
+	for envDir := range setupState.locks {
+		locks = append(locks, envDir)
+	}
+	tempDirs := make([]string, 0, len(setupState.tempDirs))
+	for dir := range setupState.tempDirs {
+		tempDirs = append(tempDirs, dir)
+	}
+	setupState.Unlock()
+
+	for _, c := range cmds {
+		err := c.Stop()
+		if err != nil && flagDebug {
+			loggerErr.Printf("Failed to stop command: %s\n", err)
+		}
+	}
+	for _, dir := range tempDirs {
+		err := removeDir(dir)
+		if err != nil {
+			loggerErr.Printf("Failed to remove %s: %s\n", dir, err)
+		}
+	}
+	if flagKeepLockOnExit {
+		return
+	}
+	for _, envDir := range locks {
+		err := unlockEnv(envDir)
+		if err != nil {
+			loggerErr.Printf("Failed to unlock virtual environment %s: %s\n", envDir, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mattheath/base62"
+)
+
+// LayoutVersionFilename is the name of the file in the environments directory
+// which stores the version of the cache layout
+const LayoutVersionFilename = "layout_version"
+
+// LayoutLockFilename is the name of the lock file in the environments directory
+// which is held while the cache layout is upgraded
+const LayoutLockFilename = "layout.lock"
+
+// CacheLayoutVersion is the version of the cache layout (naming of virtual
+// environments, metadata files) used by this version of invenv. It must be
+// increased, and a migration added to layoutMigrations, every time the layout
+// changes in an incompatible way
+const CacheLayoutVersion = 2
+
+// layoutMigrations upgrade the cache from the previous layout version. The
+// migration with index i upgrades the cache from version i to version i+1
+var layoutMigrations = []func(envsDir string) error{
+	// 0 -> 1: the layout version file was introduced, nothing to migrate
+	func(envsDir string) error { return nil },
+	// 1 -> 2: environment IDs are derived from SHA256 hashes instead of
+	// truncated SHA1 hashes
+	removeSHA1Envs,
+}
+
+// sha1EnvIDRegexp matches decoded IDs of virtual environments created before
+// cache layout version 2: an 8 characters long SHA1 hash of requirements (or
+// nothing, optionally with the platform, e.g. -linux) followed by the output
+// of python --version, e.g. 1a2b3c4d_Python 3.11.4
+var sha1EnvIDRegexp = regexp.MustCompile(`^([0-9a-f]{8}(-[a-z0-9]+)?)?_Python `)
+
+// removeSHA1Envs removes virtual environments with IDs based on truncated SHA1
+// hashes. They are never used again, so there is no point in waiting until
+// they become stale. Virtual environments with IDs provided with --env-id-from
+// are kept, as well as the ones which are in use right now (they are removed
+// as stale later)
+func removeSHA1Envs(envsDir string) error {
+	envs, err := walkEnvs()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, env := range envs {
+		decoded := base62.DecodeToBigInt(env.ID).Bytes()
+		if !sha1EnvIDRegexp.Match(decoded) || isEnvLocked(env.Dir) {
+			continue
+		}
+		if flagDebug {
+			loggerErr.Printf("Removing virtual environment %s with outdated ID...\n", env.Dir)
+		}
+		removeUnusedEnv(env)
+	}
+	return nil
+}
+
+// readLayoutVersion returns the layout version of the cache. Caches created
+// before the layout version was introduced have version 0
+func readLayoutVersion(envsDir string) (int, error) {
+	dataBytes, err := os.ReadFile(path.Join(envsDir, LayoutVersionFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(dataBytes)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid cache layout version in %s: %s", path.Join(envsDir, LayoutVersionFilename), err)
+	}
+	return version, nil
+}
+
+// checkCacheLayout returns the layout version of the cache in the
+// environments directory. Caches with a newer layout are refused. Nothing is
+// changed on disk
+func checkCacheLayout() (string, int, error) {
+	envsDir, err := getEnvironmentDir()
+	if err != nil {
+		return "", 0, err
+	}
+
+	version, err := readLayoutVersion(envsDir)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if version > CacheLayoutVersion {
+		return "", 0, fmt.Errorf(
+			"environments directory %s was written by a newer version of invenv (cache layout version %d, supported %d). Upgrade invenv or use a different environments directory",
+			envsDir, version, CacheLayoutVersion,
+		)
+	}
+	return envsDir, version, nil
+}
+
+// checkCacheLayoutReadOnly verifies the cache layout for commands which only
+// read the environments directory (e.g. list). Caches with an older layout
+// are not upgraded, a warning is printed instead
+func checkCacheLayoutReadOnly() error {
+	envsDir, version, err := checkCacheLayout()
+	if err != nil {
+		return err
+	}
+	if version == CacheLayoutVersion {
+		return nil
+	}
+	if _, err := os.Stat(envsDir); err != nil {
+		// Nothing was created yet
+		return nil
+	}
+	loggerErr.Printf("Warning: environments directory %s has an outdated cache layout (version %d, current %d). It is upgraded by the next command which sets up a virtual environment\n",
+		envsDir, version, CacheLayoutVersion)
+	return nil
+}
+
+// ensureCacheLayout verifies that the cache in the environments directory was
+// written by a compatible version of invenv. Caches with an older layout are
+// upgraded, caches with a newer layout are refused. Read-only commands use
+// checkCacheLayoutReadOnly instead
+func ensureCacheLayout() error {
+	envsDir, version, err := checkCacheLayout()
+	if err != nil {
+		return err
+	}
+	if version == CacheLayoutVersion {
+		return nil
+	}
+
+	err = os.MkdirAll(envsDir, 0755)
+	if err != nil {
+		return err
+	}
+	// Migrations remove virtual environments, so they must not run in
+	// several processes at once
+	return withFileLock(path.Join(envsDir, LayoutLockFilename), func() error {
+		// Another process could have upgraded the cache while this one was
+		// waiting for the lock
+		_, version, err := checkCacheLayout()
+		if err != nil {
+			return err
+		}
+		if version == CacheLayoutVersion {
+			return nil
+		}
+
+		for v := version; v < CacheLayoutVersion; v++ {
+			if flagDebug {
+				loggerErr.Printf("Upgrading cache layout from version %d to %d...\n", v, v+1)
+			}
+			err = layoutMigrations[v](envsDir)
+			if err != nil {
+				return fmt.Errorf("failed to upgrade cache layout from version %d to %d: %s", v, v+1, err)
+			}
+		}
+		return os.WriteFile(path.Join(envsDir, LayoutVersionFilename), []byte(strconv.Itoa(CacheLayoutVersion)+"\n"), 0644)
+	})
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/mattheath/base62"
+)
+
+// generateLegacyEnvID generates the ID of the virtual environment the way
+// invenv did before cache layout version 2: the truncated SHA1 hash of the
+// requirements and the output of python --version, encoded in base62
+func generateLegacyEnvID(requirements string, pythonVersion string) string {
+	hash := ""
+	if requirements != "" {
+		hash = fmt.Sprintf("%x", sha1.Sum([]byte(requirements)))[:8]
+	}
+	venvID := fmt.Sprintf("%s_%s", hash, pythonVersion)
+	return base62.EncodeBigInt(big.NewInt(0).SetBytes([]byte(venvID)))
+}
+
+func TestSHA1EnvIDRegexp(t *testing.T) {
+	tests := []struct {
+		name  string
+		id    string
+		match bool
+	}{
+		{"legacy ID", generateLegacyEnvID("requests==2.31.0\n", "Python 3.11.4"), true},
+		{"legacy ID without requirements", generateLegacyEnvID("", "Python 3.12.1"), true},
+		{"legacy ID with platform", base62.EncodeBigInt(big.NewInt(0).SetBytes([]byte("1a2b3c4d-linux_Python 3.10.12"))), true},
+		{"current ID", generateEnvID("4f1b2c", "Python 3.11.4", "/usr/bin/python3.11"), false},
+		{"current ID without requirements", generateEnvID("", "Python 3.11.4", "/usr/bin/python3.11"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded := base62.DecodeToBigInt(test.id).Bytes()
+			if match := sha1EnvIDRegexp.Match(decoded); match != test.match {
+				t.Errorf("sha1EnvIDRegexp.Match(%q) = %v, want %v", decoded, match, test.match)
+			}
+		})
+	}
+}
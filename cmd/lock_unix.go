@@ -0,0 +1,47 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// flockSupported is true if lock files are locked with advisory locks. The
+// lock is released by the OS when the process exits, so a lock file left by a
+// crashed process doesn't lock the virtual environment
+const flockSupported = true
+
+// flockFile places an advisory lock on the file without waiting. false is
+// returned if another open file holds a conflicting lock
+func flockFile(f *os.File, exclusive bool) (bool, error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// flockFileWait places an exclusive advisory lock on the file, waiting until
+// other open files release their locks
+func flockFileWait(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+	}
+}
+
+// funlockFile releases the advisory lock of the file
+func funlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package cmd
+
+import "os"
+
+// flockSupported is false on Windows: the lock file itself locks the virtual
+// environment and stale lock files are detected by their age
+const flockSupported = false
+
+func flockFile(f *os.File, exclusive bool) (bool, error) {
+	return true, nil
+}
+
+func flockFileWait(f *os.File) error {
+	return nil
+}
+
+func funlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// logRecord is a log message printed with --log-format json
+type logRecord struct {
+	Timestamp string `json:"timestamp"`
+	Level     string `json:"level"`
+	Msg       string `json:"msg"`
+	EnvDir    string `json:"env_dir,omitempty"`
+	EnvID     string `json:"env_id,omitempty"`
+}
+
+// logContext holds the fields added to every log record: the virtual
+// environment which is being set up
+var logContext = struct {
+	sync.Mutex
+	envDir string
+	envID  string
+}{}
+
+// setLogContext sets the virtual environment added to log records
+func setLogContext(envDir string, envID string) {
+	logContext.Lock()
+	defer logContext.Unlock()
+	logContext.envDir = envDir
+	logContext.envID = envID
+}
+
+// jsonLogWriter formats every message written to it as a JSON object on its
+// own line. The log package writes every message with a single Write call
+type jsonLogWriter struct {
+	out   io.Writer
+	level string // Level of all messages, detected from the message if empty
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	msg := strings.Trim(string(p), "\n")
+	if msg == "" {
+		return len(p), nil
+	}
+	level := w.level
+	if level == "" {
+		level = getLogLevel(msg)
+	}
+	logContext.Lock()
+	record := logRecord{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Level:     level,
+		Msg:       msg,
+		EnvDir:    logContext.envDir,
+		EnvID:     logContext.envID,
+	}
+	logContext.Unlock()
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.out.Write(append(data, '\n'))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// getLogLevel detects the level of the message: warn, error or info
+func getLogLevel(msg string) string {
+	switch {
+	case strings.HasPrefix(msg, "Warning"):
+		return "warn"
+	case strings.HasPrefix(msg, "Error"), strings.HasPrefix(msg, "Failed"),
+		strings.Contains(strings.SplitN(msg, "\n", 2)[0], " failed"):
+		return "error"
+	}
+	return "info"
+}
+
+// isJSONLog checks if log messages are printed as JSON objects
+func isJSONLog() bool {
+	return flagLogFormat == "json"
+}
+
+// setupLogFormat verifies the value of --log-format and switches loggerErr and
+// errors reported by cobra to JSON records if requested. Results printed to
+// STDOUT (loggerOut) are not affected, so they can be piped
+func setupLogFormat(root *cobra.Command, errOut io.Writer) error {
+	switch flagLogFormat {
+	case "plain":
+		return nil
+	case "json":
+		loggerErr.SetOutput(&jsonLogWriter{out: errOut})
+		root.SetErr(&jsonLogWriter{out: errOut, level: "error"})
+		return nil
+	}
+	return fmt.Errorf("invalid --log-format value %q: expected plain or json", flagLogFormat)
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// isTerminal checks if the file is connected to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// notifyBuildFinished notifies the user that the build of the virtual
+// environment has finished if it took longer than --notify-after. By default a
+// terminal bell is emitted, --notify-command runs the provided command
+// instead. Nothing happens if invenv doesn't run in a terminal
+func notifyBuildFinished(envDir string, elapsed time.Duration, buildErr error) {
+	if !flagNotify || elapsed < flagNotifyAfter || !isTerminal(os.Stderr) {
+		return
+	}
+
+	if flagNotifyCommand == "" {
+		fmt.Fprint(os.Stderr, "\a")
+		return
+	}
+
+	status := "success"
+	if buildErr != nil {
+		status = "failure"
+	}
+
+	notifyCmd := newShellCommand(flagNotifyCommand)
+	notifyCmd.Env = append(os.Environ(),
+		"INVENV_BUILD_STATUS="+status,
+		"INVENV_ENV_DIR="+envDir,
+		"INVENV_BUILD_DURATION="+elapsed.Round(time.Second).String(),
+	)
+	output, err := notifyCmd.CombinedOutput()
+	if err != nil {
+		loggerErr.Printf("Failed to run notify command: %s\n%s", err, output)
+	}
+}
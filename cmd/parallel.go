@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// getRequirementGroups returns requirements files which are directly included
+// by the requirements file with `-r`. Each of them is considered to be an
+// independent install group
+func getRequirementGroups(requirementsFile string) ([]string, error) {
+	absPath, err := filepath.Abs(requirementsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(absPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var groups []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		ref, ok := parseRequirementInclude(scanner.Text())
+		if !ok || strings.Contains(ref, "://") {
+			continue
+		}
+		included := resolveRequirementInclude(absPath, ref)
+		if seen[included] {
+			continue
+		}
+		seen[included] = true
+		groups = append(groups, included)
+	}
+	return groups, scanner.Err()
+}
+
+// buildRequirementGroupsInParallel builds wheels for every install group
+// concurrently. pip is not safe to run concurrently in one virtual environment,
+// so each group is built with `pip wheel` into its own staging directory
+// without touching the virtual environment. The returned directories should be
+// passed to the final `pip install` with `--find-links`, so it installs
+// already built wheels. The returned function removes the staging directories
+func (s *Script) buildRequirementGroupsInParallel() ([]string, func(), error) {
+	noop := func() {}
+
+	groups, err := getRequirementGroups(s.RequirementsPath)
+	if err != nil {
+		return nil, noop, err
+	}
+	if len(groups) < 2 {
+		if flagDebug {
+			loggerErr.Println("Less than 2 install groups found, installing requirements sequentially")
+		}
+		return nil, noop, nil
+	}
+
+	stagingDir, err := os.MkdirTemp("", "invenv-wheels-")
+	if err != nil {
+		return nil, noop, err
+	}
+	cleanup := func() {
+		err := os.RemoveAll(stagingDir)
+		if err != nil && flagDebug {
+			loggerErr.Printf("Failed to remove staging directory %s: %s\n", stagingDir, err)
+		}
+	}
+
+	wheelDirs := make([]string, len(groups))
+	outputs := make([][]string, len(groups))
+	errs := make([]error, len(groups))
+	commands := make([][]string, len(groups))
+
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wheelDirs[i] = path.Join(stagingDir, fmt.Sprintf("group%d", i))
+		if flagDebug {
+			loggerErr.Printf("Building install group %s in %s...\n", group, wheelDirs[i])
+		}
+		wg.Add(1)
+		go func(i int, group string) {
+			defer wg.Done()
+			// A panic in a goroutine would crash invenv without running
+			// deferred calls of the main goroutine, leaving the virtual
+			// environment locked
+			defer func() {
+				if r := recover(); r != nil {
+					errs[i] = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			wheelArgs := []string{"wheel", "--no-input", "--wheel-dir", wheelDirs[i], "-r", group}
+			if s.ConstraintsPath != "" {
+				wheelArgs = append(wheelArgs, "-c", s.ConstraintsPath)
+			}
+			wheelArgs = append(wheelArgs, getIndexArgs()...)
+			name, args := s.wrapCommand(venvBinPath(s.EnvDir, "pip"), wheelArgs...)
+			commands[i] = append([]string{name}, args...)
+			outputs[i], errs[i] = execCmdSilent(name, args...)
+		}(i, group)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			printCommandFailure("Building install group "+groups[i], commands[i][0], commands[i][1:], outputs[i], err)
+			cleanup()
+			return nil, noop, fmt.Errorf("failed to build install group %s: %s", groups[i], err)
+		}
+	}
+	return wheelDirs, cleanup, nil
+}
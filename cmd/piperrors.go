@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// isExternallyManagedError checks if pip refused to install requirements
+// because the target environment is managed by the system package manager
+// (PEP 668)
+func isExternallyManagedError(output []string) bool {
+	for _, line := range output {
+		if strings.Contains(line, "externally-managed-environment") {
+			return true
+		}
+	}
+	return false
+}
+
+// explainExternallyManagedError returns an actionable explanation of pip's
+// externally-managed-environment error. pip should never see it inside a
+// virtual environment, so the virtual environment is most likely broken or
+// was created by an interpreter which doesn't support virtual environments
+func explainExternallyManagedError(s *Script) error {
+	return fmt.Errorf(`failed to install requirements: pip treats %s as an externally managed environment (PEP 668)
+This happens when the virtual environment doesn't isolate pip from the system Python, e.g. the
+interpreter %s is a system or distribution-patched one which doesn't support virtual environments
+properly. Try one of the following:
+  - recreate the virtual environment with -n
+  - use a different interpreter with --python, e.g. one installed with pyenv or asdf
+  - if --system-site-packages is used, make sure the interpreter provides the venv module (on
+    Debian and Ubuntu install python3-venv)`, s.EnvDir, s.PythonInterpreter)
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsExternallyManagedError(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		expected bool
+	}{
+		{"pip_externally_managed.txt", true},
+		{"pip_no_matching_distribution.txt", false},
+	}
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			dataBytes, err := os.ReadFile(filepath.Join("testdata", test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			output := strings.Split(string(dataBytes), "\n")
+			if got := isExternallyManagedError(output); got != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, got)
+			}
+		})
+	}
+
+	if isExternallyManagedError(nil) {
+		t.Error("expected false for empty output")
+	}
+}
@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Files of pipenv projects
+const (
+	PipfileFilename     = "Pipfile"
+	PipfileLockFilename = "Pipfile.lock"
+)
+
+// PipfileDefaultCategory is the category of packages which are always
+// installed. Other categories (e.g. develop) are selected with --extras
+const PipfileDefaultCategory = "default"
+
+// pipfileCategoryTables maps categories of Pipfile.lock to tables of Pipfile
+var pipfileCategoryTables = map[string]string{
+	"default": "packages",
+	"develop": "dev-packages",
+}
+
+// PipfileLockPackage is a locked package from Pipfile.lock
+type PipfileLockPackage struct {
+	Version string   `json:"version"`
+	Extras  []string `json:"extras"`
+	Markers string   `json:"markers"`
+	Git     string   `json:"git"`
+	Ref     string   `json:"ref"`
+	File    string   `json:"file"`
+	Path    string   `json:"path"`
+}
+
+// pipfileInlineTableRegexp extracts string keys of the inline table of a
+// package in Pipfile, e.g. {version = ">=2", markers = "os_name == 'nt'"}
+var pipfileInlineTableRegexp = regexp.MustCompile(`([A-Za-z_]+)\s*=\s*("[^"]*"|'[^']*'|\[[^\]]*\])`)
+
+// getPipfileCategories returns the categories of packages to install: the
+// default one and the ones selected with extras
+func getPipfileCategories(extras []string) []string {
+	return append([]string{PipfileDefaultCategory}, extras...)
+}
+
+// readPipfileLock returns locked packages of the categories as pip
+// requirements, sorted by name. Local paths are resolved relative to the
+// directory of the lock file and installed as regular (not editable) packages
+func readPipfileLock(filename string, extras []string) ([]string, error) {
+	dataBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	lock := map[string]json.RawMessage{}
+	err = json.Unmarshal(dataBytes, &lock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", filename, err)
+	}
+
+	var requirements []string
+	for _, category := range getPipfileCategories(extras) {
+		data, ok := lock[category]
+		if !ok {
+			if category == PipfileDefaultCategory {
+				continue
+			}
+			return nil, fmt.Errorf("category %s not found in %s", category, filename)
+		}
+		packages := map[string]*PipfileLockPackage{}
+		err = json.Unmarshal(data, &packages)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s in %s: %s", category, filename, err)
+		}
+		names := make([]string, 0, len(packages))
+		for name := range packages {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			requirements = append(requirements, packages[name].toRequirement(name, path.Dir(filename)))
+		}
+	}
+	return requirements, nil
+}
+
+// toRequirement converts the locked package to a pip requirement
+func (p *PipfileLockPackage) toRequirement(name string, dir string) string {
+	if len(p.Extras) > 0 {
+		name += "[" + strings.Join(p.Extras, ",") + "]"
+	}
+	var requirement string
+	switch {
+	case p.Git != "":
+		url := p.Git
+		if !strings.HasPrefix(url, "git+") {
+			url = "git+" + url
+		}
+		if p.Ref != "" {
+			url += "@" + p.Ref
+		}
+		requirement = name + " @ " + url
+	case p.File != "":
+		requirement = name + " @ " + p.File
+	case p.Path != "":
+		localPath := p.Path
+		if !filepath.IsAbs(localPath) {
+			localPath = filepath.Join(dir, localPath)
+		}
+		requirement = name + " @ file://" + filepath.ToSlash(localPath)
+	case p.Version != "" && p.Version != "*":
+		requirement = name + p.Version
+	default:
+		requirement = name
+	}
+	if p.Markers != "" {
+		requirement += "; " + p.Markers
+	}
+	return requirement
+}
+
+// readPipfile returns packages of the categories from Pipfile as pip
+// requirements. It is used only with --allow-unlocked: the versions are not
+// pinned, so the virtual environment isn't reproducible. Only version
+// specifiers, extras and markers are supported
+func readPipfile(filename string, extras []string) ([]string, error) {
+	dataBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := map[string]bool{}
+	for _, category := range getPipfileCategories(extras) {
+		table, ok := pipfileCategoryTables[category]
+		if !ok {
+			table = category
+		}
+		tables[table] = true
+	}
+
+	var requirements []string
+	table := ""
+	for _, line := range strings.Split(string(dataBytes), "\n") {
+		line = strings.TrimSpace(stripTOMLComment(line))
+		if strings.HasPrefix(line, "[") {
+			table = strings.TrimSpace(strings.Trim(line, "[]"))
+			continue
+		}
+		if !tables[table] {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		name = strings.Trim(strings.TrimSpace(name), `"'`)
+		value = strings.TrimSpace(value)
+
+		pkg := &PipfileLockPackage{}
+		if strings.HasPrefix(value, "{") {
+			for _, match := range pipfileInlineTableRegexp.FindAllStringSubmatch(value, -1) {
+				key, item := match[1], match[2]
+				switch key {
+				case "version":
+					pkg.Version = strings.Trim(item, `"'`)
+				case "markers":
+					pkg.Markers = strings.Trim(item, `"'`)
+				case "extras":
+					pkg.Extras, err = scanTOMLStringArray(item)
+					if err != nil {
+						return nil, fmt.Errorf("failed to parse %s in %s: %s", name, filename, err)
+					}
+				default:
+					return nil, fmt.Errorf("failed to parse %s in %s: %s is not supported without %s", name, filename, key, PipfileLockFilename)
+				}
+			}
+		} else {
+			pkg.Version = strings.Trim(value, `"'`)
+		}
+		requirements = append(requirements, pkg.toRequirement(name, path.Dir(filename)))
+	}
+	for table := range tables {
+		if table != pipfileCategoryTables[PipfileDefaultCategory] && !strings.Contains(string(dataBytes), "["+table+"]") {
+			return nil, fmt.Errorf("category %s not found in %s", table, filename)
+		}
+	}
+	sort.Strings(requirements)
+	return requirements, nil
+}
+
+// findPipfileRequirements looks for a pipenv project in the directory and
+// returns its requirements. Pipfile.lock is preferred. A Pipfile without a
+// lock file is used only with --allow-unlocked. An empty string is returned if
+// there is no pipenv project
+func findPipfileRequirements(dir string) (string, string, []string, error) {
+	lockFile := path.Join(dir, PipfileLockFilename)
+	if _, err := os.Stat(lockFile); err == nil {
+		requirements, err := readPipfileLock(lockFile, flagExtras)
+		if err != nil {
+			return "", "", nil, err
+		}
+		if flagDebug {
+			loggerErr.Printf("Found packages in %s: %s\n", lockFile, strings.Join(requirements, ", "))
+		}
+		explainRequirements("pipfile", lockFile)
+		return lockFile, RequirementsSourcePipfileLock, requirements, nil
+	}
+
+	pipfile := path.Join(dir, PipfileFilename)
+	if _, err := os.Stat(pipfile); err != nil {
+		return "", "", nil, nil
+	}
+	if !flagAllowUnlocked {
+		return "", "", nil, fmt.Errorf("%s has no %s, run `pipenv lock` or use --allow-unlocked to install unpinned packages", pipfile, PipfileLockFilename)
+	}
+	requirements, err := readPipfile(pipfile, flagExtras)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if flagDebug {
+		loggerErr.Printf("Found packages in %s: %s\n", pipfile, strings.Join(requirements, ", "))
+	}
+	explainRequirements("pipfile", pipfile)
+	return pipfile, RequirementsSourcePipfile, requirements, nil
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// PlanInstall prints packages (and their versions) which would be installed
+// in the virtual environment of the script without installing them. pip
+// resolves requirements with --dry-run in a temporary virtual environment, so
+// the cached virtual environment is not touched
+func (s *Script) PlanInstall() error {
+	if s.RequirementsPath == "" {
+		loggerErr.Println("No requirements to install")
+		return nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "invenv-plan-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	plan := *s
+	plan.EnvDir = path.Join(tmpDir, "env")
+	installer, pipArgs, ok := plan.getInstallCommand()
+	if !ok {
+		return fmt.Errorf("planning the installation is not supported for %s", s.RequirementsPath)
+	}
+
+	err = plan.CreateEnv()
+	if err != nil {
+		return err
+	}
+
+	if plan.backend != BackendUV {
+		// --dry-run was added in pip 22.2
+		name, args := plan.wrapCommand(installer, "install", "--help")
+		help, err := exec.Command(name, args...).Output()
+		if err != nil {
+			return fmt.Errorf("failed to check pip options: %s", err)
+		}
+		if !strings.Contains(string(help), "--dry-run") {
+			return fmt.Errorf("pip in the virtual environment doesn't support --dry-run, upgrade it with --upgrade-deps")
+		}
+	}
+
+	printProgress("Resolving requirements...")
+	name, args := plan.wrapCommand(installer, append(pipArgs, "--dry-run")...)
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if !flagDebug {
+		// Clear all progress messages
+		printProgress("")
+	}
+	if err != nil {
+		if isExternallyManagedError(strings.Split(string(output), "\n")) {
+			return explainExternallyManagedError(s)
+		}
+		loggerErr.Println("\n", string(output))
+		return fmt.Errorf("failed to resolve requirements: %s", err)
+	}
+
+	packages := parseInstallPlan(string(output))
+	if packages == nil {
+		// Unknown output format, print it as is
+		loggerOut.Println(strings.TrimSpace(string(output)))
+		return nil
+	}
+	for _, pkg := range packages {
+		loggerOut.Println(pkg)
+	}
+	return nil
+}
+
+// parseInstallPlan extracts packages from the output of pip install --dry-run
+// ("Would install requests-2.31.0 urllib3-2.2.1") or uv pip install --dry-run
+// (" + requests==2.31.0"). nil is returned if the output has no install plan
+func parseInstallPlan(output string) []string {
+	var packages []string
+	found := false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "Would install "):
+			found = true
+			fields := strings.Fields(strings.TrimPrefix(line, "Would install "))
+			if len(fields) == 2 && strings.HasPrefix(fields[1], "package") {
+				// uv prints the number of packages before the list
+				continue
+			}
+			packages = append(packages, fields...)
+		case strings.HasPrefix(line, "Would make no changes"):
+			found = true
+		case strings.HasPrefix(line, "+ "):
+			found = true
+			packages = append(packages, strings.TrimSpace(strings.TrimPrefix(line, "+ ")))
+		}
+	}
+	if !found {
+		return nil
+	}
+	if packages == nil {
+		packages = []string{}
+	}
+	return packages
+}
@@ -0,0 +1,334 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PoetryLockFilename is the lock file of poetry projects
+const PoetryLockFilename = "poetry.lock"
+
+// PoetryLockPackage is a locked package from poetry.lock
+type PoetryLockPackage struct {
+	Name         string
+	Version      string
+	SourceType   string // git, directory, file, url or legacy (a package index)
+	SourceURL    string
+	SourceRef    string
+	Dependencies []PoetryDependency
+}
+
+// PoetryDependency is a dependency of the project or of a locked package.
+// Optional dependencies are installed only with extras of the package, which
+// are not supported, so they are skipped
+type PoetryDependency struct {
+	Name     string
+	Markers  string
+	Optional bool
+}
+
+// poetryMarkersRegexp and poetryOptionalRegexp extract markers and optional
+// from the inline table of a dependency, e.g.
+// {version = ">=1", markers = "sys_platform == \"win32\"", optional = true}
+var poetryMarkersRegexp = regexp.MustCompile(`markers\s*=\s*"((?:[^"\\]|\\.)*)"`)
+var poetryOptionalRegexp = regexp.MustCompile(`optional\s*=\s*true`)
+
+// packageNameRegexp matches the package name at the start of the requirement
+var packageNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+`)
+
+// packageNameSeparatorRegexp matches separators which are equivalent in
+// package names
+var packageNameSeparatorRegexp = regexp.MustCompile(`[-_.]+`)
+
+// normalizePackageName returns the name of the package in the normalized form
+// (PEP 503), so names from pyproject.toml and poetry.lock can be compared
+func normalizePackageName(name string) string {
+	return strings.ToLower(packageNameSeparatorRegexp.ReplaceAllString(strings.TrimSpace(name), "-"))
+}
+
+// parsePoetryDependency parses the `name = value` line of a dependencies table.
+// The value is a version string, an inline table or an array of them (for
+// different environments). Dependencies with several alternatives are treated
+// as unconditional
+func parsePoetryDependency(name string, value string) PoetryDependency {
+	dependency := PoetryDependency{Name: normalizePackageName(strings.Trim(name, `"'`))}
+	if !strings.HasPrefix(value, "{") {
+		return dependency
+	}
+	if match := poetryMarkersRegexp.FindStringSubmatch(value); match != nil {
+		dependency.Markers = strings.ReplaceAll(match[1], `\"`, `"`)
+	}
+	dependency.Optional = poetryOptionalRegexp.MatchString(value)
+	return dependency
+}
+
+// scanTOMLTables calls fn for every `key = value` line of the TOML document
+// with the name of its table. Multi-line arrays are joined into a single
+// value. [[name]] starts a new element of the array of tables, fn is called
+// for it with an empty key
+func scanTOMLTables(content string, fn func(table string, key string, value string)) {
+	table := ""
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(stripTOMLComment(lines[i]))
+		if strings.HasPrefix(line, "[[") {
+			table = strings.TrimSpace(strings.Trim(line, "[]"))
+			fn(table, "", "")
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			table = strings.TrimSpace(strings.Trim(line, "[]"))
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		for getTOMLArrayDepth(value) > 0 && i+1 < len(lines) {
+			i++
+			value += "\n" + stripTOMLComment(lines[i])
+		}
+		fn(table, strings.TrimSpace(key), value)
+	}
+}
+
+// unquoteTOMLString returns the content of the TOML string
+func unquoteTOMLString(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// readPoetryLock returns packages from poetry.lock by their normalized names
+func readPoetryLock(filename string) (map[string]*PoetryLockPackage, error) {
+	dataBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	packages := map[string]*PoetryLockPackage{}
+	var current *PoetryLockPackage
+	scanTOMLTables(string(dataBytes), func(table string, key string, value string) {
+		if table == "package" && key == "" {
+			current = &PoetryLockPackage{}
+			return
+		}
+		if current == nil {
+			return
+		}
+		switch table {
+		case "package":
+			switch key {
+			case "name":
+				current.Name = normalizePackageName(unquoteTOMLString(value))
+				packages[current.Name] = current
+			case "version":
+				current.Version = unquoteTOMLString(value)
+			}
+		case "package.source":
+			switch key {
+			case "type":
+				current.SourceType = unquoteTOMLString(value)
+			case "url":
+				current.SourceURL = unquoteTOMLString(value)
+			case "resolved_reference":
+				current.SourceRef = unquoteTOMLString(value)
+			case "reference":
+				if current.SourceRef == "" {
+					current.SourceRef = unquoteTOMLString(value)
+				}
+			}
+		case "package.dependencies":
+			current.Dependencies = append(current.Dependencies, parsePoetryDependency(key, value))
+		}
+	})
+	if len(packages) == 0 {
+		return nil, fmt.Errorf("no packages found in %s", filename)
+	}
+	return packages, nil
+}
+
+// readPoetryProjectDependencies returns the dependencies declared in
+// pyproject.toml of the poetry project: [tool.poetry.dependencies] (or
+// [project].dependencies) and the dependency groups selected with extras
+func readPoetryProjectDependencies(filename string, extras []string) ([]PoetryDependency, error) {
+	dataBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string][]PoetryDependency{}
+	scanTOMLTables(string(dataBytes), func(table string, key string, value string) {
+		group := ""
+		switch {
+		case table == "tool.poetry.dependencies":
+		case table == "tool.poetry.dev-dependencies":
+			group = "dev"
+		case strings.HasPrefix(table, "tool.poetry.group.") && strings.HasSuffix(table, ".dependencies"):
+			group = strings.TrimSuffix(strings.TrimPrefix(table, "tool.poetry.group."), ".dependencies")
+		default:
+			return
+		}
+		groups[group] = append(groups[group], parsePoetryDependency(key, value))
+	})
+
+	// Poetry 2 projects declare dependencies in the [project] table
+	projectDependencies, _, err := readProjectDependencies(filename, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, dependency := range projectDependencies {
+		name, markers, _ := strings.Cut(dependency, ";")
+		name = packageNameRegexp.FindString(strings.TrimSpace(name))
+		groups[""] = append(groups[""], PoetryDependency{Name: normalizePackageName(name), Markers: strings.TrimSpace(markers)})
+	}
+
+	dependencies := groups[""]
+	for _, extra := range extras {
+		items, ok := groups[extra]
+		if !ok {
+			return nil, fmt.Errorf("dependency group %s not found in %s", extra, filename)
+		}
+		dependencies = append(dependencies, items...)
+	}
+	return dependencies, nil
+}
+
+// toRequirement converts the locked package to a pip requirement
+func (p *PoetryLockPackage) toRequirement(dir string) string {
+	switch p.SourceType {
+	case "git":
+		url := p.SourceURL
+		if p.SourceRef != "" {
+			url += "@" + p.SourceRef
+		}
+		return p.Name + " @ git+" + url
+	case "directory", "file":
+		localPath := p.SourceURL
+		if !filepath.IsAbs(localPath) {
+			localPath = filepath.Join(dir, localPath)
+		}
+		return p.Name + " @ file://" + filepath.ToSlash(localPath)
+	case "url":
+		return p.Name + " @ " + p.SourceURL
+	}
+	return p.Name + "==" + p.Version
+}
+
+// resolvePoetryLock returns the locked packages required by the dependencies
+// of the project as pip requirements, sorted by name. Environment markers of
+// the dependencies are kept, but markers of transitive dependencies are not
+// combined with the markers of the packages which require them. Use poetry
+// export for the exact set, see exportPoetryRequirements
+func resolvePoetryLock(lockFile string, dependencies []PoetryDependency) ([]string, error) {
+	packages, err := readPoetryLock(lockFile)
+	if err != nil {
+		return nil, err
+	}
+
+	markers := map[string]string{}
+	queue := []PoetryDependency{}
+	for _, dependency := range dependencies {
+		if dependency.Name == "python" || dependency.Optional {
+			continue
+		}
+		queue = append(queue, dependency)
+	}
+	for len(queue) > 0 {
+		dependency := queue[0]
+		queue = queue[1:]
+		pkg, ok := packages[dependency.Name]
+		if !ok {
+			return nil, fmt.Errorf("package %s not found in %s, run `poetry lock`", dependency.Name, lockFile)
+		}
+		existing, visited := markers[dependency.Name]
+		switch {
+		case !visited:
+			markers[dependency.Name] = dependency.Markers
+			for _, child := range pkg.Dependencies {
+				if child.Name != "python" && !child.Optional {
+					queue = append(queue, child)
+				}
+			}
+		case existing == "" || existing == dependency.Markers:
+		case dependency.Markers == "":
+			markers[dependency.Name] = ""
+		default:
+			markers[dependency.Name] = "(" + existing + ") or (" + dependency.Markers + ")"
+		}
+	}
+
+	requirements := make([]string, 0, len(markers))
+	for name, marker := range markers {
+		requirement := packages[name].toRequirement(path.Dir(lockFile))
+		if marker != "" {
+			requirement += "; " + marker
+		}
+		requirements = append(requirements, requirement)
+	}
+	sort.Strings(requirements)
+	return requirements, nil
+}
+
+// exportPoetryRequirements exports the locked requirements of the poetry
+// project with `poetry export`, which evaluates the whole dependency graph.
+// false is returned if poetry (or its export plugin) is not installed
+func exportPoetryRequirements(dir string, extras []string) ([]string, bool) {
+	if _, err := exec.LookPath("poetry"); err != nil {
+		return nil, false
+	}
+	args := []string{"export", "--format", "requirements.txt", "--without-hashes"}
+	if len(extras) > 0 {
+		args = append(args, "--with", strings.Join(extras, ","))
+	}
+	exportCmd := exec.Command("poetry", args...)
+	exportCmd.Dir = dir
+	output, err := exportCmd.Output()
+	if err != nil {
+		if flagDebug {
+			loggerErr.Printf("Failed to export requirements with poetry, reading %s instead: %s\n", PoetryLockFilename, err)
+		}
+		return nil, false
+	}
+
+	var requirements []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "-") {
+			continue
+		}
+		requirements = append(requirements, line)
+	}
+	return requirements, true
+}
+
+// findPoetryRequirements looks for a poetry project with poetry.lock in the
+// directory and returns its locked requirements. An empty string is returned
+// if there is none
+func findPoetryRequirements(dir string) (string, []string, error) {
+	lockFile := path.Join(dir, PoetryLockFilename)
+	if _, err := os.Stat(lockFile); err != nil {
+		return "", nil, nil
+	}
+	dependencies, err := readPoetryProjectDependencies(path.Join(dir, PyprojectFilename), flagExtras)
+	if err != nil {
+		return "", nil, err
+	}
+	requirements, err := resolvePoetryLock(lockFile, dependencies)
+	if err != nil {
+		return "", nil, err
+	}
+	if flagDebug {
+		loggerErr.Printf("Found packages in %s: %s\n", lockFile, strings.Join(requirements, ", "))
+	}
+	explainRequirements("poetry", lockFile)
+	return lockFile, requirements, nil
+}
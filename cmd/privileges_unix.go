@@ -0,0 +1,132 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lookupCredential resolves the user specification into a credential. The
+// specification can be a user name, a numeric uid or uid:gid
+func lookupCredential(spec string) (*syscall.Credential, error) {
+	uidStr, gidStr, hasGid := strings.Cut(spec, ":")
+
+	if _, err := strconv.ParseUint(uidStr, 10, 32); err != nil {
+		// Not a numeric uid, must be a user name
+		u, err := user.Lookup(uidStr)
+		if err != nil {
+			return nil, err
+		}
+		uidStr = u.Uid
+		if !hasGid {
+			gidStr = u.Gid
+		}
+	} else if !hasGid {
+		// Use the primary group of the user if it is known
+		gidStr = uidStr
+		u, err := user.LookupId(uidStr)
+		if err == nil {
+			gidStr = u.Gid
+		}
+	}
+
+	uid, err := strconv.ParseUint(uidStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid %s: %s", uidStr, err)
+	}
+	gid, err := strconv.ParseUint(gidStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid %s: %s", gidStr, err)
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// makeEnvReadable grants read access to the virtual environment to all users
+// and allows them to traverse directories and run executables in it
+func makeEnvReadable(envDir string) error {
+	return filepath.WalkDir(envDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := info.Mode().Perm() | 0444
+		if d.IsDir() || info.Mode().Perm()&0100 != 0 {
+			mode |= 0111
+		}
+		if mode == info.Mode().Perm() {
+			return nil
+		}
+		return os.Chmod(p, mode)
+	})
+}
+
+// checkDirsTraversable verifies that the user with the credential can
+// traverse every ancestor of the directory. makeEnvReadable changes only the
+// virtual environment itself, so e.g. the environments directory in root's
+// home directory is not accessible to other users. Supplementary groups are
+// dropped, so only the uid and the gid are taken into account
+func checkDirsTraversable(dir string, credential *syscall.Credential) error {
+	for current := filepath.Dir(dir); ; current = filepath.Dir(current) {
+		info, err := os.Stat(current)
+		if err != nil {
+			return err
+		}
+		perm := info.Mode().Perm()
+		required := fs.FileMode(0001)
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			switch {
+			case stat.Uid == credential.Uid:
+				required = 0100
+			case stat.Gid == credential.Gid:
+				required = 0010
+			}
+		}
+		if perm&required == 0 {
+			return fmt.Errorf("directory %s (mode %s) can't be traversed by uid %d", current, perm, credential.Uid)
+		}
+		if current == filepath.Dir(current) {
+			return nil
+		}
+	}
+}
+
+// prepareDropPrivileges makes the virtual environment usable by the target
+// user and returns process attributes to run the script as that user
+func prepareDropPrivileges(spec string, envDir string) (*syscall.SysProcAttr, error) {
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("dropping privileges requires invenv to run as root")
+	}
+
+	credential, err := lookupCredential(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve user %s: %s", spec, err)
+	}
+
+	err = checkDirsTraversable(envDir, credential)
+	if err != nil {
+		return nil, fmt.Errorf("virtual environment %s is not accessible to user %s: %s. Select an accessible environments directory with --env-dir", envDir, spec, err)
+	}
+
+	err = makeEnvReadable(envDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make virtual environment readable: %s", err)
+	}
+
+	if flagDebug {
+		loggerErr.Printf("Running script as uid %d, gid %d\n", credential.Uid, credential.Gid)
+	}
+	return &syscall.SysProcAttr{Credential: credential}, nil
+}
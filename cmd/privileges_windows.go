@@ -0,0 +1,13 @@
+//go:build windows
+
+package cmd
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// prepareDropPrivileges is not supported on Windows
+func prepareDropPrivileges(spec string, envDir string) (*syscall.SysProcAttr, error) {
+	return nil, fmt.Errorf("dropping privileges is not supported on Windows")
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// processDetectionSupported is true if findProcessesWithPrefix can detect
+// processes on the current platform
+const processDetectionSupported = true
+
+// findProcessesWithPrefix finds all processes with the given prefix in their
+// command line
+func findProcessesWithPrefix(prefix string) ([]*ProcessInfo, error) {
+	output, err := exec.Command("ps", "-axo", "pid=,command=").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []*ProcessInfo
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	// Command lines can be longer than the default buffer size
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		command := strings.TrimSpace(fields[1])
+		if strings.HasPrefix(command, prefix) {
+			processes = append(processes, &ProcessInfo{PID: pid, Command: command})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return processes, nil
+}
+
+// readCmdline reads the command line of a process
+func readCmdline(pid int) (string, error) {
+	output, err := exec.Command("ps", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", fmt.Errorf("process %d not found: %s", pid, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
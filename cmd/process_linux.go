@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// processDetectionSupported is true if findProcessesWithPrefix can detect
+// processes on the current platform
+const processDetectionSupported = true
+
+// findProcessesWithPrefix finds all processes with the given prefix in their
+// command line
+func findProcessesWithPrefix(prefix string) ([]*ProcessInfo, error) {
+	d, err := os.Open("/proc")
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	var processes []*ProcessInfo
+	for {
+		names, err := d.Readdirnames(10)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			// We only care if the name starts with a numeric
+			if name[0] < '0' || name[0] > '9' {
+				continue
+			}
+
+			// From this point forward, any errors we just ignore, because
+			// it might simply be that the process doesn't exist anymore.
+			pid, err := strconv.ParseInt(name, 10, 0)
+			if err != nil {
+				continue
+			}
+
+			cmdline, err := readCmdline(int(pid))
+			if err != nil {
+				continue
+			}
+			if strings.HasPrefix(cmdline, prefix) {
+				// Arguments in cmdline are separated with NUL bytes
+				command := strings.TrimSpace(strings.ReplaceAll(cmdline, "\x00", " "))
+				processes = append(processes, &ProcessInfo{PID: int(pid), Command: command})
+			}
+		}
+	}
+	return processes, nil
+}
+
+// readCmdline reads the command line of a process
+func readCmdline(pid int) (string, error) {
+	cmdlinePath := fmt.Sprintf("/proc/%d/cmdline", pid)
+	dataBytes, err := os.ReadFile(cmdlinePath)
+	if err != nil {
+		return "", err
+	}
+	return string(dataBytes), nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// processDetectionSupported is true if findProcessesWithPrefix can detect
+// processes on the current platform
+const processDetectionSupported = false
+
+// findProcessesWithPrefix is not supported on this platform. It always reports
+// that no process was found
+func findProcessesWithPrefix(prefix string) ([]*ProcessInfo, error) {
+	return nil, nil
+}
+
+// readCmdline is not supported on this platform
+func readCmdline(pid int) (string, error) {
+	return "", fmt.Errorf("reading command line is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// PyprojectFilename is the name of the file with Python project metadata
+const PyprojectFilename = "pyproject.toml"
+
+// stripTOMLComment removes the comment from the TOML line, ignoring `#` inside
+// strings
+func stripTOMLComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// scanTOMLStringArray extracts strings from the TOML array of strings
+func scanTOMLStringArray(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "[") {
+		return nil, fmt.Errorf("expected an array, got %q", value)
+	}
+
+	var items []string
+	var current strings.Builder
+	var quote rune
+	escaped := false
+	for _, c := range value[1:] {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				items = append(items, current.String())
+				current.Reset()
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ']':
+			return items, nil
+		case c == ',' || c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		default:
+			return nil, fmt.Errorf("only arrays of strings are supported, got %q", value)
+		}
+	}
+	return nil, fmt.Errorf("array is not closed")
+}
+
+// getTOMLArrayDepth returns the nesting level of arrays at the end of the
+// value, ignoring brackets inside strings. 0 means that the array is closed
+func getTOMLArrayDepth(value string) int {
+	depth := 0
+	var quote rune
+	escaped := false
+	for _, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth
+}
+
+// parseTOMLStringArrays returns arrays of strings from the TOML document for
+// which want returns true. Keys are prefixed with the name of their table,
+// e.g. project.dependencies. Only the subset of TOML used for dependencies is
+// supported: other values are skipped without being validated
+func parseTOMLStringArrays(content string, want func(key string) bool) (map[string][]string, error) {
+	arrays := make(map[string][]string)
+	table := ""
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(stripTOMLComment(lines[i]))
+		if strings.HasPrefix(line, "[") {
+			table = strings.TrimSpace(strings.Trim(line, "[]"))
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"'`)
+		if table != "" {
+			key = table + "." + key
+		}
+		value = strings.TrimSpace(value)
+		if !strings.HasPrefix(value, "[") {
+			continue
+		}
+
+		// Arrays can span multiple lines
+		for getTOMLArrayDepth(value) > 0 && i+1 < len(lines) {
+			i++
+			value += "\n" + stripTOMLComment(lines[i])
+		}
+		if !want(key) {
+			continue
+		}
+		items, err := scanTOMLStringArray(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", key, err)
+		}
+		arrays[key] = items
+	}
+	return arrays, nil
+}
+
+// parseTOMLString returns the value of the string key from the TOML document.
+// The key is prefixed with the name of its table, see parseTOMLStringArrays.
+// found is false if the key is missing or its value is not a string
+func parseTOMLString(content string, wantKey string) (value string, found bool) {
+	table := ""
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(stripTOMLComment(line))
+		if strings.HasPrefix(line, "[") {
+			table = strings.TrimSpace(strings.Trim(line, "[]"))
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"'`)
+		if table != "" {
+			key = table + "." + key
+		}
+		if key != wantKey {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) < 2 || (value[0] != '"' && value[0] != '\'') || value[len(value)-1] != value[0] {
+			return "", false
+		}
+		return value[1 : len(value)-1], true
+	}
+	return "", false
+}
+
+// readProjectRequiresPython returns requires-python from the [project] table
+// of pyproject.toml in the directory. An empty string is returned if there is
+// no pyproject.toml or it doesn't declare requires-python
+func readProjectRequiresPython(dir string) (string, error) {
+	dataBytes, err := os.ReadFile(path.Join(dir, PyprojectFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	requiresPython, _ := parseTOMLString(string(dataBytes), "project.requires-python")
+	return strings.TrimSpace(requiresPython), nil
+}
+
+// readProjectDependencies reads dependencies from the [project] table of the
+// pyproject.toml file. Dependencies of the optional dependency groups from
+// extras are added to them. found is false if the file doesn't declare
+// dependencies
+func readProjectDependencies(filename string, extras []string) (dependencies []string, found bool, err error) {
+	dataBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, false, err
+	}
+
+	arrays, err := parseTOMLStringArrays(string(dataBytes), func(key string) bool {
+		return key == "project.dependencies" || strings.HasPrefix(key, "project.optional-dependencies.")
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse %s: %s", filename, err)
+	}
+
+	dependencies, found = arrays["project.dependencies"]
+	for _, extra := range extras {
+		items, ok := arrays["project.optional-dependencies."+extra]
+		if !ok {
+			return nil, false, fmt.Errorf("optional dependency group %s not found in %s", extra, filename)
+		}
+		dependencies = append(dependencies, items...)
+		found = true
+	}
+	return dependencies, found, nil
+}
+
+// normalizeDependencies returns dependencies in a canonical form, so the
+// formatting of pyproject.toml doesn't affect the virtual environment ID
+func normalizeDependencies(dependencies []string) []string {
+	normalized := make([]string, 0, len(dependencies))
+	for _, dependency := range dependencies {
+		normalized = append(normalized, strings.Join(strings.Fields(dependency), ""))
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// findProjectDependencies looks for pyproject.toml with dependencies in the
+// directory. An empty string is returned if there is none
+func findProjectDependencies(dir string) (string, []string, error) {
+	pyprojectFile := path.Join(dir, PyprojectFilename)
+	if _, err := os.Stat(pyprojectFile); err != nil {
+		return "", nil, nil
+	}
+
+	dependencies, found, err := readProjectDependencies(pyprojectFile, flagExtras)
+	if err != nil {
+		return "", nil, err
+	}
+	if !found {
+		if flagDebug {
+			loggerErr.Printf("%s doesn't declare dependencies\n", pyprojectFile)
+		}
+		return "", nil, nil
+	}
+	if flagDebug {
+		loggerErr.Printf("Found dependencies in %s: %s\n", pyprojectFile, strings.Join(dependencies, ", "))
+	}
+	explainRequirements("pyproject", pyprojectFile)
+	return pyprojectFile, dependencies, nil
+}
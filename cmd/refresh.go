@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// VEnvBuiltAtFilename is the name of the file in the virtual environment which
+// stores the time of its last build
+const VEnvBuiltAtFilename = ".venv.built"
+
+// getRefreshInterval returns the interval after which requirements of the
+// virtual environment are reinstalled, see --refresh-interval. Zero disables
+// refreshing
+func getRefreshInterval() (time.Duration, error) {
+	if flagRefreshInterval == "" {
+		return 0, nil
+	}
+	interval, err := parseAge(flagRefreshInterval)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid --refresh-interval value %q: expected a positive duration, e.g. 12h or 7d", flagRefreshInterval)
+	}
+	return interval, nil
+}
+
+// recordBuildTime stores the current time as the time of the last build of the
+// virtual environment
+func (s *Script) recordBuildTime() error {
+	builtAtFilename := path.Join(s.EnvDir, VEnvBuiltAtFilename)
+	return os.WriteFile(builtAtFilename, []byte(time.Now().UTC().Format(time.RFC3339)), 0644)
+}
+
+// isEnvBuilt checks if the build of the virtual environment has finished
+func (s *Script) isEnvBuilt() bool {
+	_, err := os.Stat(path.Join(s.EnvDir, VEnvBuiltAtFilename))
+	return err == nil
+}
+
+// getLastBuildTime returns the time of the last build of the virtual
+// environment. Virtual environments built before the build time was recorded
+// fall back to the modification time of pyvenv.cfg, which is written once when
+// the virtual environment is created
+func (s *Script) getLastBuildTime() (time.Time, error) {
+	data, err := os.ReadFile(path.Join(s.EnvDir, VEnvBuiltAtFilename))
+	if err == nil {
+		return time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	}
+	if !os.IsNotExist(err) {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(path.Join(s.EnvDir, "pyvenv.cfg"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// isRefreshDue checks if the last build of the virtual environment is older
+// than the refresh interval
+func (s *Script) isRefreshDue() bool {
+	interval, err := getRefreshInterval()
+	if err != nil || interval == 0 {
+		return false
+	}
+	builtAt, err := s.getLastBuildTime()
+	if err != nil {
+		if flagDebug {
+			loggerErr.Printf("Failed to get last build time of %s: %s\n", s.EnvDir, err)
+		}
+		return false
+	}
+	if flagDebug {
+		loggerErr.Printf("Virtual environment was built at %s\n", builtAt.Format(time.RFC3339))
+	}
+	return time.Since(builtAt) > interval
+}
+
+// refreshEnv reinstalls requirements in the existing virtual environment with
+// --upgrade, so packages are updated to the latest versions allowed by the
+// requirements. The virtual environment ID doesn't change. The caller must
+// hold the lock
+func (s *Script) refreshEnv() error {
+	if flagDebug {
+		loggerErr.Println("Refreshing virtual environment...")
+	}
+	s.refreshing = true
+	defer func() { s.refreshing = false }()
+	err := s.InstallRequirementsInEnv()
+	if err != nil {
+		return fmt.Errorf("failed to refresh virtual environment: %s", err)
+	}
+	return s.recordBuildTime()
+}
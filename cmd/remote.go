@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// RemoteRequirementsDir is the directory in the environments directory where
+// requirements files downloaded from URLs are cached
+const RemoteRequirementsDir = "requirements"
+
+// isRequirementsURL checks if the requirements file provided with -r is a URL
+func isRequirementsURL(requirementsFile string) bool {
+	return strings.HasPrefix(requirementsFile, "http://") || strings.HasPrefix(requirementsFile, "https://")
+}
+
+// getRemoteRequirementsCacheFile returns the path of the cached copy of the
+// requirements file downloaded from the URL
+func getRemoteRequirementsCacheFile(url string) (string, error) {
+	envsDir, err := getEnvironmentDir()
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%x.txt", sha256.Sum256([]byte(url)))
+	return path.Join(envsDir, RemoteRequirementsDir, name), nil
+}
+
+// fetchRemoteRequirements downloads the requirements file from the URL and
+// returns the path of its local copy. Requirements are installed from the
+// local copy and its content identifies the virtual environment. If the
+// download fails, the previously downloaded copy is used
+func fetchRemoteRequirements(url string) (string, error) {
+	cacheFile, err := getRemoteRequirementsCacheFile(url)
+	if err != nil {
+		return "", err
+	}
+
+	if validateOnly {
+		if _, err := os.Stat(cacheFile); err != nil {
+			return "", fmt.Errorf("requirements file %s hasn't been downloaded yet, it isn't downloaded with --validate or --dry-run", url)
+		}
+		return cacheFile, nil
+	}
+
+	err = downloadRequirements(url, cacheFile)
+	if err != nil {
+		if _, statErr := os.Stat(cacheFile); statErr != nil {
+			return "", fmt.Errorf("failed to download requirements file %s: %s", url, err)
+		}
+		loggerErr.Printf("\nWarning: failed to download requirements file %s, using the previously downloaded copy: %s\n", url, err)
+		return cacheFile, nil
+	}
+	if flagDebug {
+		loggerErr.Printf("Downloaded requirements file %s to %s\n", url, cacheFile)
+	}
+	return cacheFile, nil
+}
+
+// downloadRequirements downloads the file from the URL. The file is replaced
+// atomically, so a failed download never corrupts the cached copy
+func downloadRequirements(url string, filename string) error {
+	client := &http.Client{Timeout: flagRequirementsTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	err = os.MkdirAll(path.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	tmpFilename := fmt.Sprintf("%s.tmp-%d", filename, os.Getpid())
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
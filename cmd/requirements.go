@@ -0,0 +1,371 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// parseRequirementInclude checks if the line includes another requirements
+// file and returns the referenced path. All forms accepted by pip are
+// supported: `-r file.txt`, `-rfile.txt`, `--requirement file.txt` and
+// `--requirement=file.txt`
+func parseRequirementInclude(line string) (string, bool) {
+	return parseFileOption(line, "-r", "--requirement")
+}
+
+// parseConstraintInclude checks if the line references a constraints file
+// (`-c file.txt` and the other forms, see parseRequirementInclude) and returns
+// the referenced path
+func parseConstraintInclude(line string) (string, bool) {
+	return parseFileOption(line, "-c", "--constraint")
+}
+
+// parseFileOption checks if the line of a requirements file is the option
+// (short or long form) which references a file and returns the path
+func parseFileOption(line string, short string, long string) (string, bool) {
+	line = strings.TrimSpace(line)
+	// Strip inline comments. pip requires whitespace before the `#`
+	if idx := strings.Index(line, " #"); idx != -1 {
+		line = strings.TrimSpace(line[:idx])
+	}
+
+	var ref string
+	switch {
+	case strings.HasPrefix(line, long):
+		ref = strings.TrimPrefix(line, long)
+		if !strings.HasPrefix(ref, "=") && !strings.HasPrefix(ref, " ") && !strings.HasPrefix(ref, "\t") {
+			// E.g. --requirements, which is not an include
+			return "", false
+		}
+		ref = strings.TrimPrefix(strings.TrimSpace(ref), "=")
+	case strings.HasPrefix(line, short):
+		ref = strings.TrimPrefix(line, short)
+	default:
+		return "", false
+	}
+
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return "", false
+	}
+	return ref, true
+}
+
+// resolveRequirementInclude resolves the path of an included requirements
+// file. pip resolves nested includes relative to the directory of the file
+// which includes them, not relative to the current working directory
+func resolveRequirementInclude(includingFile string, ref string) string {
+	if filepath.IsAbs(ref) {
+		return ref
+	}
+	return filepath.Join(filepath.Dir(includingFile), ref)
+}
+
+// collectRequirementFiles returns the requirements file and all files it
+// includes (recursively) in the order pip reads them. Each file is returned
+// only once, which also protects from include cycles. Files included with -r
+// and constraints files referenced with -c must exist, otherwise the error
+// names the missing file and the line which references it
+func collectRequirementFiles(filename string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+
+	var walk func(string) error
+	walk = func(current string) error {
+		absPath, err := filepath.Abs(current)
+		if err != nil {
+			return err
+		}
+		if seen[absPath] {
+			return nil
+		}
+		seen[absPath] = true
+		files = append(files, absPath)
+
+		file, err := os.Open(absPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		lineNumber := 0
+		for scanner.Scan() {
+			lineNumber++
+			ref, isInclude := parseRequirementInclude(scanner.Text())
+			if !isInclude {
+				var isConstraint bool
+				ref, isConstraint = parseConstraintInclude(scanner.Text())
+				if !isConstraint {
+					continue
+				}
+			}
+			if strings.Contains(ref, "://") {
+				// Remote requirements files are fetched by pip itself
+				continue
+			}
+			included := resolveRequirementInclude(absPath, ref)
+			_, err = os.Stat(included)
+			if err != nil {
+				return fmt.Errorf("requirements file %s, line %d: referenced file %s not found", absPath, lineNumber, included)
+			}
+			if !isInclude {
+				// Constraints files don't contain requirements to install
+				continue
+			}
+			if flagDebug {
+				loggerErr.Printf("Requirements file %s includes %s\n", absPath, included)
+			}
+			err = walk(included)
+			if err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	}
+
+	err := walk(filename)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// requirementCommentRegexp matches a comment in the requirements file: pip
+// treats # as the start of a comment at the beginning of the line or after
+// whitespace
+var requirementCommentRegexp = regexp.MustCompile(`(^|\s)#.*$`)
+
+// normalizeRequirements returns lines of the requirements file in a canonical
+// form, so formatting changes don't affect the virtual environment ID:
+// continuation lines are joined, comments, blank lines and whitespace are
+// removed, package names are normalized (PEP 503) and lines are sorted
+func normalizeRequirements(content string) []string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = strings.ReplaceAll(content, "\\\n", "")
+
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.Join(strings.Fields(requirementCommentRegexp.ReplaceAllString(line, "")), "")
+		if line == "" {
+			continue
+		}
+		// Options (e.g. -r or --index-url), URLs and paths are kept as is
+		name := packageNameRegexp.FindString(line)
+		rest := line[len(name):]
+		if name != "" && !strings.HasPrefix(name, "-") && !strings.HasPrefix(name, ".") &&
+			!strings.HasPrefix(rest, "/") && !strings.HasPrefix(rest, "\\") && !strings.HasPrefix(rest, ":") {
+			line = normalizePackageName(name) + rest
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// getNormalizedRequirements returns the normalized requirements of the script
+// (see normalizeRequirements) from the requirements list or from all its
+// requirements files. nil is returned if they can't be read
+func (s *Script) getNormalizedRequirements() []string {
+	if len(s.requirementsList) > 0 {
+		return normalizeRequirements(strings.Join(s.requirementsList, "\n"))
+	}
+	if s.requirementsSource != RequirementsSourcePip || s.RequirementsPath == "" {
+		return nil
+	}
+	files, err := collectRequirementFiles(s.RequirementsPath)
+	if err != nil {
+		return nil
+	}
+	var lines []string
+	for _, f := range files {
+		dataBytes, err := os.ReadFile(f)
+		if err != nil {
+			return nil
+		}
+		lines = append(lines, normalizeRequirements(string(dataBytes))...)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// RebuildCooldownMaxChange is the largest fraction of requirements lines which
+// may change for --rebuild-cooldown to reuse the outdated virtual environment
+const RebuildCooldownMaxChange = 0.5
+
+// isRequirementsChangeSmall checks if at most RebuildCooldownMaxChange of the
+// requirements lines changed. Lines which are only in one of the normalized
+// requirements are counted as changed, e.g. a new version of a package changes
+// two lines. Unknown previous requirements are never a small change
+func isRequirementsChangeSmall(previous []string, current []string) bool {
+	if previous == nil {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, line := range previous {
+		counts[line]++
+	}
+	for _, line := range current {
+		counts[line]--
+	}
+	changed := 0
+	for _, count := range counts {
+		if count != 0 {
+			changed++
+		}
+	}
+	return float64(changed) <= RebuildCooldownMaxChange*float64(len(counts))
+}
+
+// isRequirementsEmpty checks if the requirements file and all requirements
+// files it includes contain only comments and blank lines
+func isRequirementsEmpty(filename string) (bool, error) {
+	files, err := collectRequirementFiles(filename)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range files {
+		dataBytes, err := os.ReadFile(f)
+		if err != nil {
+			return false, err
+		}
+		if len(normalizeRequirements(string(dataBytes))) > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// skipEmptyRequirements returns an empty string if the requirements file
+// doesn't contain any requirements, so the virtual environment is the same as
+// the one of a script without requirements and pip is not run
+func skipEmptyRequirements(requirementsFile string) (string, error) {
+	empty, err := isRequirementsEmpty(requirementsFile)
+	if err != nil || !empty {
+		return requirementsFile, err
+	}
+	if flagDebug {
+		loggerErr.Printf("Requirements file %s is empty, ignoring it\n", requirementsFile)
+	}
+	explainRequirements("empty", requirementsFile)
+	return "", nil
+}
+
+// getRequirementsHash calculates the hash of the requirements file and all
+// requirements files it includes. The content is normalized before it is
+// hashed, see normalizeRequirements. With --exact-hash the content is hashed
+// as is: for a file without includes the hash is the same as the one returned
+// by getFileHash
+func getRequirementsHash(filename string) (string, error) {
+	files, err := collectRequirementFiles(filename)
+	if err != nil {
+		return "", err
+	}
+
+	hasher := sha256.New()
+	var lines []string
+	for _, f := range files {
+		dataBytes, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		if flagExactHash {
+			hasher.Write(dataBytes)
+		} else {
+			lines = append(lines, normalizeRequirements(string(dataBytes))...)
+		}
+	}
+	if !flagExactHash {
+		sort.Strings(lines)
+		hasher.Write([]byte(strings.Join(lines, "\n")))
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// getRequirementsSourceHash calculates the hash of requirements depending on
+// how they are installed. extras are used only for pyproject.toml dependencies,
+// pipenv categories and poetry dependency groups
+func getRequirementsSourceHash(requirementsSource string, requirementsFile string, extras []string) (string, error) {
+	switch requirementsSource {
+	case RequirementsSourcePip:
+		return getRequirementsHash(requirementsFile)
+	case RequirementsSourceInline:
+		requirements, err := readRequirementsDirective(requirementsFile)
+		if err != nil {
+			return "", err
+		}
+		return getInlineRequirementsHash(requirements), nil
+	case RequirementsSourceProject:
+		dependencies, _, err := readProjectDependencies(requirementsFile, extras)
+		if err != nil {
+			return "", err
+		}
+		return getInlineRequirementsHash(normalizeDependencies(dependencies)), nil
+	case RequirementsSourcePipfile, RequirementsSourcePipfileLock, RequirementsSourcePoetryLock:
+		return getLockFileHash(requirementsFile, extras)
+	default:
+		return getFileHash(requirementsFile)
+	}
+}
+
+// getLockFileHash returns the hash of the lock file (e.g. Pipfile.lock) which
+// identifies the virtual environment. Groups of packages selected with extras
+// are taken into account
+func getLockFileHash(filename string, extras []string) (string, error) {
+	hash, err := getFileHash(filename)
+	if err != nil || len(extras) == 0 {
+		return hash, err
+	}
+	sorted := append([]string{}, extras...)
+	sort.Strings(sorted)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(hash+"\n"+strings.Join(sorted, ",")))), nil
+}
+
+// checkRequirementsSize verifies that the requirements file, including all
+// files it includes, doesn't exceed the limits set with
+// --max-requirements-size and --max-requirements-lines. It protects from
+// accidentally installing a wrong (e.g. huge) requirements file
+func checkRequirementsSize(requirementsFile string) error {
+	if flagMaxRequirementsSize == "" && flagMaxRequirementsLines <= 0 {
+		return nil
+	}
+
+	var maxSize int64
+	var err error
+	if flagMaxRequirementsSize != "" {
+		maxSize, err = parseSize(flagMaxRequirementsSize)
+		if err != nil {
+			return fmt.Errorf("invalid --max-requirements-size: %s", err)
+		}
+	}
+
+	files, err := collectRequirementFiles(requirementsFile)
+	if err != nil {
+		return err
+	}
+
+	var totalSize int64
+	var totalLines int
+	for _, f := range files {
+		dataBytes, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		totalSize += int64(len(dataBytes))
+		totalLines += len(strings.Split(strings.TrimRight(string(dataBytes), "\n"), "\n"))
+	}
+
+	if maxSize > 0 && totalSize > maxSize {
+		return fmt.Errorf("requirements file %s is too large: %d bytes, limit is %d bytes", requirementsFile, totalSize, maxSize)
+	}
+	if flagMaxRequirementsLines > 0 && totalLines > flagMaxRequirementsLines {
+		return fmt.Errorf("requirements file %s is too large: %d lines, limit is %d lines", requirementsFile, totalLines, flagMaxRequirementsLines)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeRequirementFiles creates the files (relative path to content) in the
+// directory
+func writeRequirementFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(filename), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filename, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResolveRequirementInclude(t *testing.T) {
+	tests := []struct {
+		name          string
+		includingFile string
+		ref           string
+		expected      string
+	}{
+		{"same directory", "/project/requirements.txt", "base.txt", "/project/base.txt"},
+		{"subdirectory", "/project/requirements.txt", "requirements/dev.txt", "/project/requirements/dev.txt"},
+		{"relative to the including file", "/project/requirements/dev.txt", "base.txt", "/project/requirements/base.txt"},
+		{"parent directory", "/project/requirements/dev.txt", "../common.txt", "/project/common.txt"},
+		{"sibling directory", "/project/requirements/dev.txt", "../constraints/pins.txt", "/project/constraints/pins.txt"},
+		{"absolute path", "/project/requirements.txt", "/other/base.txt", "/other/base.txt"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := resolveRequirementInclude(filepath.FromSlash(test.includingFile), filepath.FromSlash(test.ref))
+			if got != filepath.FromSlash(test.expected) {
+				t.Errorf("expected %s, got %s", filepath.FromSlash(test.expected), got)
+			}
+		})
+	}
+}
+
+func TestCollectRequirementFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected []string
+		err      string // $DIR is replaced with the directory of the files
+	}{
+		{
+			name: "no includes",
+			files: map[string]string{
+				"requirements.txt": "requests\n",
+			},
+			expected: []string{"requirements.txt"},
+		},
+		{
+			name: "include relative to the including file",
+			files: map[string]string{
+				"requirements.txt":          "-r requirements/dev.txt\n",
+				"requirements/dev.txt":      "-r base.txt\npytest\n",
+				"requirements/base.txt":     "requests\n",
+				"base.txt":                  "not included\n",
+				"requirements/unrelated.in": "not included\n",
+			},
+			expected: []string{"requirements.txt", "requirements/dev.txt", "requirements/base.txt"},
+		},
+		{
+			name: "two levels deep across subdirectories",
+			files: map[string]string{
+				"requirements.txt":        "--requirement=envs/dev.txt\n",
+				"envs/dev.txt":            "-r../common/base.txt\n",
+				"common/base.txt":         "--requirement pinned/extra.txt # pinned\nrequests\n",
+				"common/pinned/extra.txt": "rich\n",
+			},
+			expected: []string{"requirements.txt", "envs/dev.txt", "common/base.txt", "common/pinned/extra.txt"},
+		},
+		{
+			name: "constraints files are not walked",
+			files: map[string]string{
+				"requirements.txt":     "-c constraints/pins.txt\nrequests\n",
+				"constraints/pins.txt": "-r missing.txt\n",
+			},
+			expected: []string{"requirements.txt"},
+		},
+		{
+			name: "include cycle",
+			files: map[string]string{
+				"requirements.txt": "-r sub/a.txt\n",
+				"sub/a.txt":        "-r ../requirements.txt\n",
+			},
+			expected: []string{"requirements.txt", "sub/a.txt"},
+		},
+		{
+			name: "remote includes are skipped",
+			files: map[string]string{
+				"requirements.txt": "-r https://example.com/requirements.txt\n",
+			},
+			expected: []string{"requirements.txt"},
+		},
+		{
+			name: "missing include",
+			files: map[string]string{
+				"requirements.txt": "-r sub/dev.txt\n",
+				"sub/dev.txt":      "-r base.txt\n",
+			},
+			err: "requirements file $DIR/sub/dev.txt, line 1: referenced file $DIR/sub/base.txt not found",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeRequirementFiles(t, dir, test.files)
+
+			got, err := collectRequirementFiles(filepath.Join(dir, "requirements.txt"))
+			if test.err != "" {
+				expected := filepath.FromSlash(strings.ReplaceAll(test.err, "$DIR", filepath.ToSlash(dir)))
+				if err == nil || err.Error() != expected {
+					t.Fatalf("expected error %q, got %v", expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := make([]string, len(test.expected))
+			for i, name := range test.expected {
+				expected[i] = filepath.Join(dir, filepath.FromSlash(name))
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("expected %v, got %v", expected, got)
+			}
+		})
+	}
+}
+
+func TestMarkerRequirementsEnvID(t *testing.T) {
+	requirementsFile := filepath.Join("testdata", "requirements_markers.txt")
+	hash, err := getRequirementsHash(requirementsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasMarkers, err := hasEnvironmentMarkers(requirementsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasMarkers {
+		t.Errorf("expected environment markers in %s", requirementsFile)
+	}
+
+	// Markers are a part of the hash, but the formatting of marker lines
+	// isn't
+	tests := []struct {
+		name     string
+		content  string
+		expected bool
+	}{
+		{"reformatted markers", "# Reformatted\nrequests==2.31.0\npywin32==306;sys_platform==\"win32\"\nexceptiongroup==1.2.0;python_version<\"3.11\"\ntyping-extensions>=4.7 ;  python_version < \"3.12\"\ntomli==2.0.1 ; python_version < \"3.11\"  # for 3.10\n", true},
+		{"different marker", "requests==2.31.0\ntomli==2.0.1; python_version < \"3.12\"\ntyping-extensions>=4.7; python_version < \"3.12\"\nexceptiongroup==1.2.0 ; python_version < \"3.11\"\npywin32==306; sys_platform == \"win32\"\n", false},
+		{"marker removed", "requests==2.31.0\ntomli==2.0.1\ntyping-extensions>=4.7; python_version < \"3.12\"\nexceptiongroup==1.2.0 ; python_version < \"3.11\"\npywin32==306; sys_platform == \"win32\"\n", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeRequirementFiles(t, dir, map[string]string{"requirements.txt": test.content})
+			got, err := getRequirementsHash(filepath.Join(dir, "requirements.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == hash) != test.expected {
+				t.Errorf("expected same hash to be %t, got %s and %s", test.expected, hash, got)
+			}
+		})
+	}
+
+	// The installed packages depend on the interpreter the markers are
+	// evaluated for, so each interpreter gets its own stable environment ID
+	python311 := generateEnvID(hash, "Python 3.11.4", "/usr/bin/python3.11")
+	if again := generateEnvID(hash, "Python 3.11.4", "/usr/bin/python3.11"); again != python311 {
+		t.Errorf("expected the same environment ID with the same interpreter, got %s and %s", python311, again)
+	}
+	python310 := generateEnvID(hash, "Python 3.10.12", "/usr/bin/python3.10")
+	python312 := generateEnvID(hash, "Python 3.12.1", "/usr/bin/python3.12")
+	if python310 == python311 || python311 == python312 || python310 == python312 {
+		t.Errorf("expected distinct environment IDs across interpreter versions, got %s, %s and %s", python310, python311, python312)
+	}
+}
+
+func TestHasEnvironmentMarkers(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected bool
+	}{
+		{"no markers", map[string]string{"requirements.txt": "requests==2.31.0\n"}, false},
+		{"semicolon in a comment", map[string]string{"requirements.txt": "requests==2.31.0 # see docs; pinned\n"}, false},
+		{"marker", map[string]string{"requirements.txt": "tomli; python_version < \"3.11\"\n"}, true},
+		{"marker in an included file", map[string]string{
+			"requirements.txt":      "-r requirements/base.txt\n",
+			"requirements/base.txt": "pywin32==306; sys_platform == \"win32\"\n",
+		}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeRequirementFiles(t, dir, test.files)
+			got, err := hasEnvironmentMarkers(filepath.Join(dir, "requirements.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestIsRequirementsChangeSmall(t *testing.T) {
+	base := []string{"click==8.1.7", "requests==2.31.0", "rich==13.7.0", "urllib3==2.1.0"}
+	tests := []struct {
+		name     string
+		previous []string
+		current  []string
+		expected bool
+	}{
+		{"unchanged", base, base, true},
+		{"one version bumped", base, []string{"click==8.1.7", "requests==2.32.0", "rich==13.7.0", "urllib3==2.1.0"}, true},
+		{"one package added", base, append([]string{"attrs==23.2.0"}, base...), true},
+		{"replaced", base, []string{"django==5.0", "psycopg==3.1.18"}, false},
+		{"half of the versions bumped", base, []string{"click==8.1.8", "requests==2.32.0", "rich==13.7.0", "urllib3==2.1.0"}, false},
+		{"unknown previous requirements", nil, base, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isRequirementsChangeSmall(test.previous, test.current); got != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// resolveRequirements resolves requirements into a canonical list of pinned
+// packages with uv (if installed) or pip-compile. Requirements which resolve to
+// the same packages produce the same list regardless of their order, comments
+// or constraints (e.g. requests and requests>=2)
+func resolveRequirements(requirementsFile string, wrapper []string, pythonInterpreter string, pythonVersion string) ([]string, error) {
+	var name string
+	var args []string
+	if _, err := exec.LookPath("uv"); err == nil {
+		name = "uv"
+		args = []string{"pip", "compile", "--quiet", "--no-header", "--no-annotate"}
+		if len(wrapper) > 0 {
+			// The wrapped interpreter isn't available on the host, resolve
+			// for its version instead
+			args = append(args, "--python-version", strings.TrimPrefix(pythonVersion, "Python "))
+		} else {
+			args = append(args, "--python", pythonInterpreter)
+		}
+		args = append(args, requirementsFile)
+	} else if _, err := exec.LookPath("pip-compile"); err == nil {
+		// pip-compile resolves requirements for the interpreter it is
+		// installed with. Environment markers would be evaluated for that
+		// interpreter, so requirements which differ only for the interpreter
+		// of the script could share the virtual environment
+		hasMarkers, err := hasEnvironmentMarkers(requirementsFile)
+		if err != nil {
+			return nil, err
+		}
+		if hasMarkers {
+			return nil, fmt.Errorf("pip-compile can't resolve requirements with environment markers for %s, install uv", pythonVersion)
+		}
+		name = "pip-compile"
+		args = []string{"--quiet", "--no-header", "--no-annotate", "--output-file", "-", requirementsFile}
+	} else {
+		return nil, fmt.Errorf("neither uv nor pip-compile is installed")
+	}
+	args = append(args, getIndexArgs()...)
+
+	if flagDebug {
+		loggerErr.Printf("Resolving requirements with %s %s\n", name, strings.Join(args, " "))
+	}
+	// execCmdSilent discards the output of successful commands
+	output, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve requirements with %s: %s", name, err)
+	}
+
+	var pinned []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		if line == "" {
+			continue
+		}
+		pinned = append(pinned, strings.ToLower(line))
+	}
+	sort.Strings(pinned)
+	return pinned, nil
+}
+
+// hasEnvironmentMarkers checks if the requirements file, including all files it
+// includes, has requirements with environment markers, e.g.
+// tomli; python_version < "3.11"
+func hasEnvironmentMarkers(requirementsFile string) (bool, error) {
+	files, err := collectRequirementFiles(requirementsFile)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range files {
+		dataBytes, err := os.ReadFile(f)
+		if err != nil {
+			return false, err
+		}
+		for _, line := range strings.Split(string(dataBytes), "\n") {
+			if idx := strings.Index(line, "#"); idx != -1 {
+				line = line[:idx]
+			}
+			if strings.Contains(line, ";") {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// getEnvIDRequirementsHash returns the hash of requirements which is a part of
+// the virtual environment ID. With --resolve-for-id it is the hash of resolved
+// requirements (see resolveRequirements), so different requirements which
+// resolve to the same packages share the virtual environment. If resolution
+// fails, requirementsHash is used
+func getEnvIDRequirementsHash(requirementsHash string, requirementsSource string, requirementsFile string, requirementsList []string, wrapper []string, pythonInterpreter string, pythonVersion string) string {
+	if !flagResolveForID || requirementsHash == "" {
+		return requirementsHash
+	}
+
+	switch requirementsSource {
+	case RequirementsSourcePip:
+	case RequirementsSourceInline, RequirementsSourceProject, RequirementsSourcePipfile:
+		// Resolvers read requirements from files only
+		tmpDir, err := os.MkdirTemp("", "invenv-resolve-")
+		if err != nil {
+			loggerErr.Printf("Failed to resolve requirements, using requirements hash: %s\n", err)
+			return requirementsHash
+		}
+		defer os.RemoveAll(tmpDir)
+		requirementsFile = path.Join(tmpDir, "requirements.in")
+		err = os.WriteFile(requirementsFile, []byte(strings.Join(requirementsList, "\n")+"\n"), 0644)
+		if err != nil {
+			loggerErr.Printf("Failed to resolve requirements, using requirements hash: %s\n", err)
+			return requirementsHash
+		}
+	default:
+		// uv.lock already pins all packages
+		return requirementsHash
+	}
+
+	pinned, err := resolveRequirements(requirementsFile, wrapper, pythonInterpreter, pythonVersion)
+	if err != nil {
+		loggerErr.Printf("Failed to resolve requirements, using requirements hash: %s\n", err)
+		return requirementsHash
+	}
+	resolvedHash := getInlineRequirementsHash(pinned)
+	if flagDebug {
+		loggerErr.Printf("Resolved requirements hash: %s (%d packages)\n", resolvedHash, len(pinned))
+	}
+	return resolvedHash
+}
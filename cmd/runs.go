@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RunsDir is the directory in the environments directory where records of
+// running scripts are stored
+const RunsDir = "runs"
+
+// RunRecord describes a script started by invenv
+type RunRecord struct {
+	PID                int       `json:"pid"`
+	Script             string    `json:"script"`
+	EnvDir             string    `json:"env_dir"`
+	EnvID              string    `json:"env_id"`
+	RequirementsPath   string    `json:"requirements_path"`
+	RequirementsHash   string    `json:"requirements_hash"`
+	RequirementsSource string    `json:"requirements_source,omitempty"`
+	Extras             []string  `json:"extras,omitempty"`
+	StartedAt          time.Time `json:"started_at"`
+}
+
+func getRunsDir() (string, error) {
+	envsDir, err := getEnvironmentDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(envsDir, RunsDir), nil
+}
+
+// recordRun stores the record of the script which is about to be started
+// with the given PID
+func recordRun(s *Script, pid int) error {
+	runsDir, err := getRunsDir()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(runsDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	record := &RunRecord{
+		PID:                pid,
+		Script:             s.AbsolutePath,
+		EnvDir:             s.EnvDir,
+		EnvID:              s.venvID,
+		RequirementsPath:   s.RequirementsPath,
+		RequirementsHash:   s.requirementsHash,
+		RequirementsSource: s.requirementsSource,
+		Extras:             flagExtras,
+		StartedAt:          time.Now(),
+	}
+	dataBytes, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(runsDir, fmt.Sprintf("%d.json", pid)), dataBytes, 0644)
+}
+
+// loadRunRecords returns records of scripts which are still running. Records
+// of finished scripts are removed
+func loadRunRecords() ([]*RunRecord, error) {
+	runsDir, err := getRunsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(runsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var records []*RunRecord
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		recordFilename := path.Join(runsDir, entry.Name())
+		dataBytes, err := os.ReadFile(recordFilename)
+		if err != nil {
+			if flagDebug {
+				loggerErr.Println(err)
+			}
+			continue
+		}
+		record := &RunRecord{}
+		err = json.Unmarshal(dataBytes, record)
+		if err != nil || !isRunAlive(record) {
+			if flagDebug {
+				loggerErr.Printf("Removing record of finished script %s\n", recordFilename)
+			}
+			os.Remove(recordFilename)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].StartedAt.Before(records[j].StartedAt)
+	})
+	return records, nil
+}
+
+// isRunAlive checks if the process from the record is still running the
+// script from the virtual environment. Comparing the command line protects
+// from reused PIDs
+func isRunAlive(record *RunRecord) bool {
+	cmdline, err := readCmdline(record.PID)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(cmdline, record.EnvDir)
+}
+
+// isRunOutdated checks if the requirements of the running script have changed
+// since it was started
+func isRunOutdated(record *RunRecord) (bool, error) {
+	if record.RequirementsPath == "" {
+		return false, nil
+	}
+	currentHash, err := getRequirementsSourceHash(record.RequirementsSource, record.RequirementsPath, record.Extras)
+	if err != nil {
+		return false, err
+	}
+	return record.RequirementsHash != currentHash, nil
+}
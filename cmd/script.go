@@ -1,32 +1,49 @@
 package cmd
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 )
 
 const VEnvInfoFilename = ".venv.version"
+const VEnvLocationFilename = ".venv.location"
 const VEnvDirDefaultName = ".venv"
 
 // Script represents a Python script
 type Script struct {
-	AbsolutePath      string // Full path to the script
-	EnvDir            string // Full path to the virtual environment
-	PythonInterpreter string // Python interpreter to use
-	RequirementsPath  string // Full path to the requirements file
-	venvID            string // Unique identifier for the virtual environment
-	fromInitCommand   bool   // True if the script was created with init subcommand
+	AbsolutePath       string   // Full path to the script
+	EnvDir             string   // Full path to the virtual environment
+	PythonInterpreter  string   // Python interpreter to use
+	interpreterWrapper []string // Command which runs the Python interpreter, e.g. docker run
+	RequirementsPath   string   // Full path to the requirements file
+	ConstraintsPath    string   // Full path to the pip constraints file
+	Prompt             string   // Prompt prefix of the activated virtual environment
+	venvID             string   // Unique identifier for the virtual environment
+	requirementsHash   string   // Hash of the requirements file
+	requirementsSource string   // How requirements are installed, see RequirementsSource* constants
+	requirementsList   []string // Requirements from the script directive or pyproject.toml dependencies
+	pythonVersion      string   // Version of the Python interpreter
+	backend            string   // Backend which creates the virtual environment, see Backend* constants
+	variants           []string // Variants of the virtual environment ID, see getEnvIDVariants
+	fromInitCommand    bool     // True if the script was created with init subcommand
+	customEnvID        bool     // True if the environment ID was set with SetEnvID
+	refreshing         bool     // True while requirements are reinstalled with --upgrade, see refreshEnv
 }
 
 // EnsureEnv ensures that the virtual environment for the script exists. It creates
 // a new virtual environment or waits until it is created by another process
 func (s *Script) EnsureEnv(deleteOldEnv bool) error {
+	setLogContext(s.EnvDir, s.venvID)
 	readOperationOnly := !deleteOldEnv
+	idMismatch := false
 
 	_, err := os.Stat(s.EnvDir)
 	if err != nil {
@@ -51,6 +68,7 @@ func (s *Script) EnsureEnv(deleteOldEnv bool) error {
 				// Environment ID mismatch, recreate the environment
 				readOperationOnly = false
 				deleteOldEnv = true
+				idMismatch = true
 				if flagDebug {
 					loggerErr.Printf("Environment ID mismatch: got %s, want %s\n", string(data), s.venvID)
 				}
@@ -75,102 +93,480 @@ func (s *Script) EnsureEnv(deleteOldEnv bool) error {
 		return err
 	}
 
+	if readOperationOnly {
+		// The virtual environment could have been removed as stale while
+		// waiting for the lock
+		if _, err := os.Stat(s.EnvDir); os.IsNotExist(err) {
+			readOperationOnly = false
+		}
+	}
+
+	infoMismatch := false
+	if readOperationOnly {
+		if reason := s.checkEnvInfo(); reason != "" {
+			if flagDebug {
+				loggerErr.Printf("Recreating virtual environment: %s\n", reason)
+			}
+			readOperationOnly = false
+			deleteOldEnv = true
+			infoMismatch = true
+		}
+	}
+
 	if !readOperationOnly {
-		lockEnv(s.EnvDir)
-		defer unlockEnv(s.EnvDir)
-		if deleteOldEnv {
-			err = s.RemoveEnv()
+		buildStart := time.Now()
+		defer func() {
+			notifyBuildFinished(s.EnvDir, time.Since(buildStart), err)
+		}()
+		err = withEnvLock(s.EnvDir, func() error {
+			if (!deleteOldEnv || (infoMismatch && s.checkEnvInfo() == "")) && !s.fromInitCommand && s.isEnvBuilt() {
+				// Another process built (or rebuilt) the virtual
+				// environment while this one was waiting for the lock
+				s.updateIndex(false)
+				return nil
+			}
+			return s.buildEnv(deleteOldEnv, idMismatch)
+		})
+		return err
+	}
+	if s.isRefreshDue() {
+		return withEnvLock(s.EnvDir, func() error {
+			err := s.refreshEnv()
 			if err != nil {
 				return err
 			}
+			s.updateIndex(true)
+			return nil
+		})
+	}
+	s.updateIndex(false)
+	return nil
+}
+
+// buildEnv (re)creates the virtual environment and installs requirements. If
+// the ID of the virtual environment created with init command changed and
+// --incremental is set, the virtual environment is updated in place instead.
+// The virtual environment must be locked
+func (s *Script) buildEnv(deleteOldEnv bool, idMismatch bool) error {
+	var err error
+	if idMismatch && flagIncremental {
+		err = s.updateEnvIncrementally()
+		if err == nil {
+			err = s.writeEnvInfo()
+			if err != nil {
+				return err
+			}
+			err = s.saveVEnvInfo()
+			if err != nil {
+				return err
+			}
+			err = s.recordBuildTime()
+			if err != nil && flagDebug {
+				loggerErr.Printf("Failed to record build time: %s\n", err)
+			}
+			s.updateIndex(true)
+			return nil
 		}
+		loggerErr.Printf("Incremental update failed, recreating the environment: %s\n", err)
+	}
+	if deleteOldEnv {
+		err = s.RemoveEnv()
+		if err != nil {
+			return err
+		}
+	}
+	if atomicBuildSupported() && s.backend != BackendConda {
+		// Conda environments have their prefix embedded in many files
+		err = s.buildEnvInTempDir()
+	} else {
 		err = s.CreateEnv()
+		if err == nil {
+			err = s.InstallRequirementsInEnv()
+			if err != nil {
+				// If the installation failed, remove the environment so we don't
+				// leave a broken environment behind and other scripts won't use it
+				s.RemoveEnv()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if s.fromInitCommand {
+		err = s.writeEnvInfo()
 		if err != nil {
 			return err
 		}
-		err = s.InstallRequirementsInEnv()
+	}
+	err = s.recordBuildTime()
+	if err != nil && flagDebug {
+		loggerErr.Printf("Failed to record build time: %s\n", err)
+	}
+	s.updateIndex(true)
+	return nil
+}
+
+// atomicBuildSupported checks if virtual environments can be built in a
+// temporary directory and moved into place. On Windows console scripts are
+// executables with the path of the interpreter embedded, so they can't be
+// relocated, and a directory with open files can't be renamed
+func atomicBuildSupported() bool {
+	return runtime.GOOS != "windows"
+}
+
+// getTempEnvDir returns the directory the virtual environment is built in
+// before it is moved to envDir
+func getTempEnvDir(envDir string) string {
+	return fmt.Sprintf("%s.tmp-%d", envDir, os.Getpid())
+}
+
+// buildEnvInTempDir creates the virtual environment and installs requirements
+// in a temporary directory next to the virtual environment and then moves it
+// into place, so a build which failed or was interrupted never leaves a broken
+// virtual environment behind. The virtual environment must be locked
+func (s *Script) buildEnvInTempDir() error {
+	envDir := s.EnvDir
+	tempDir := getTempEnvDir(envDir)
+
+	// Temporary directories of builds which were killed. They can be removed
+	// safely, because the virtual environment is locked
+	leftovers, _ := filepath.Glob(envDir + ".tmp-*")
+	for _, dir := range leftovers {
+		if flagDebug {
+			loggerErr.Printf("Removing leftover temporary directory %s\n", dir)
+		}
+		err := removeDir(dir)
 		if err != nil {
-			// If the installation failed, remove the environment so we don't
-			// leave a broken environment behind and other scripts won't use it
-			s.RemoveEnv()
 			return err
 		}
-		if s.fromInitCommand {
-			// Write the environment ID to the info file
-			infoFilename := path.Join(s.EnvDir, VEnvInfoFilename)
-			err = os.WriteFile(infoFilename, []byte(s.venvID), 0644)
-			if err != nil {
-				return err
-			}
-			if flagDebug {
-				loggerErr.Printf("Wrote environment ID to %s\n", infoFilename)
-			}
+	}
+	trackTempDir(tempDir)
+	defer untrackTempDir(tempDir)
+
+	s.EnvDir = tempDir
+	err := s.CreateEnv()
+	if err == nil {
+		err = s.InstallRequirementsInEnv()
+	}
+	s.EnvDir = envDir
+	if err == nil {
+		err = relocateEnv(tempDir, envDir)
+	}
+	if err == nil {
+		// An incomplete virtual environment, e.g. .venv of a project which
+		// wasn't created by invenv, is replaced
+		err = removeDir(envDir)
+	}
+	if err == nil {
+		err = os.Rename(tempDir, envDir)
+		if err == nil && flagDebug {
+			loggerErr.Printf("Moved virtual environment from %s to %s\n", tempDir, envDir)
 		}
-		return nil
+	}
+	if err != nil {
+		removeDir(tempDir)
+		return err
 	}
 	return nil
 }
 
+// relocateEnv replaces the path of the virtual environment in the scripts in
+// its bin directory (activate scripts and shebangs of console scripts), so
+// they work after the virtual environment is moved from oldDir to newDir
+func relocateEnv(oldDir string, newDir string) error {
+	binDir := path.Join(oldDir, "bin")
+	entries, err := os.ReadDir(binDir)
+	if err != nil {
+		return fmt.Errorf("failed to relocate virtual environment: %s", err)
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			// Skip symlinks to the interpreter
+			continue
+		}
+		filename := path.Join(binDir, entry.Name())
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("failed to relocate virtual environment: %s", err)
+		}
+		if bytes.IndexByte(data, 0) != -1 || !bytes.Contains(data, []byte(oldDir)) {
+			// Binary file or no references to the virtual environment
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("failed to relocate virtual environment: %s", err)
+		}
+		data = bytes.ReplaceAll(data, []byte(oldDir), []byte(newDir))
+		err = os.WriteFile(filename, data, info.Mode().Perm())
+		if err != nil {
+			return fmt.Errorf("failed to relocate virtual environment: %s", err)
+		}
+	}
+	return nil
+}
+
+// writeEnvInfo writes the environment ID, the location and the requirements
+// the virtual environment was built from to the environment created with init
+// command
+func (s *Script) writeEnvInfo() error {
+	infoFilename := path.Join(s.EnvDir, VEnvInfoFilename)
+	err := os.WriteFile(infoFilename, []byte(s.venvID), 0644)
+	if err != nil {
+		return err
+	}
+	if flagDebug {
+		loggerErr.Printf("Wrote environment ID to %s\n", infoFilename)
+	}
+	err = os.WriteFile(path.Join(s.EnvDir, VEnvLocationFilename), []byte(s.EnvDir), 0644)
+	if err != nil {
+		return err
+	}
+	return s.saveRequirementsSnapshot()
+}
+
+// updateIndex records the virtual environment in the environments index.
+// Failing to update the index is not fatal
+func (s *Script) updateIndex(built bool) {
+	if s.fromInitCommand {
+		// Environments created with init command are not stored in the
+		// environments directory. Only the location of the virtual
+		// environment created with --venv-dir is recorded, so it is found
+		// when init is run again
+		err := recordProjectInIndex(s.AbsolutePath, s.EnvDir)
+		if err != nil && flagDebug {
+			loggerErr.Printf("Failed to update environments index: %s\n", err)
+		}
+		return
+	}
+	if !built {
+		// Keep the modification time of the reused virtual environment up
+		// to date, so least recently used virtual environments can be found
+		// even if the index is missing
+		now := time.Now()
+		err := os.Chtimes(s.EnvDir, now, now)
+		if err != nil && flagDebug {
+			loggerErr.Printf("Failed to update modification time of %s: %s\n", s.EnvDir, err)
+		}
+	}
+	err := recordEnvInIndex(s, built)
+	if err != nil && flagDebug {
+		loggerErr.Printf("Failed to update environments index: %s\n", err)
+	}
+}
+
+// wrapCommand prepends the interpreter wrapper, if any, to the command. Commands
+// which run executables from the virtual environment must be wrapped
+func (s *Script) wrapCommand(name string, args ...string) (string, []string) {
+	return wrapCommand(s.interpreterWrapper, name, args...)
+}
+
+// checkVenvModule checks that venv module is available in the interpreter
+func (s *Script) checkVenvModule() error {
+	name, args := s.wrapCommand(s.PythonInterpreter, "-m", "venv", "--help")
+	return exec.Command(name, args...).Run()
+}
+
 // CreateEnv creates a virtual environment for the script
 func (s *Script) CreateEnv() error {
 	var err error
 	var output []string
+	// The last run command, reported if it fails
+	var name string
+	var args []string
 
 	if flagDebug {
 		loggerErr.Println("Creating new virtual environment...")
 	}
 
-	// First, try to use venv module
-	err = exec.Command(s.PythonInterpreter, "-m", "venv", "--help").Run()
-	if err == nil {
+	stopProgress := startProgressTimer("Creating virtual environment...")
+
+	if s.backend == BackendConda {
+		// conda refuses to create an environment in an existing directory,
+		// e.g. left by an interrupted build
+		err = removeDir(s.EnvDir)
+		if err == nil {
+			name, err = getCondaExecutable()
+		}
+		if err != nil {
+			stopProgress()
+			return fmt.Errorf("failed to create conda environment: %s", err)
+		}
+		args = []string{"env", "create", "--prefix", s.EnvDir, "--file", s.RequirementsPath}
+		if flagDebug {
+			loggerErr.Printf("Using %s...\n", path.Base(name))
+		}
+		if showInstallOutput() {
+			err = execCmd(name, args...)
+		} else {
+			output, err = execCmdSilent(name, args...)
+		}
+	} else if s.backend == BackendUV {
+		// --seed installs pip, so the virtual environment can be managed
+		// without uv later. The seeded pip is always up to date, so
+		// --upgrade-deps is implied
+		uvArgs := []string{"venv", "--seed", "--python", s.PythonInterpreter, "--prompt", s.Prompt}
+		if flagSystemSitePackages {
+			uvArgs = append(uvArgs, "--system-site-packages")
+		}
+		uvArgs = append(uvArgs, s.EnvDir)
+		name, args = "uv", uvArgs
+		if flagDebug {
+			loggerErr.Println("Using uv...")
+		}
+		if showInstallOutput() {
+			err = execCmd(name, args...)
+		} else {
+			output, err = execCmdSilent(name, args...)
+		}
+	} else if err = s.checkVenvModule(); err == nil {
+		// First, try to use venv module
+		venvArgs := []string{"-m", "venv", "--prompt", s.Prompt}
+		if flagUpgradeDeps {
+			venvArgs = append(venvArgs, "--upgrade-deps")
+		}
+		if flagSystemSitePackages {
+			venvArgs = append(venvArgs, "--system-site-packages")
+		}
+		venvArgs = append(venvArgs, s.EnvDir)
+		name, args = s.wrapCommand(s.PythonInterpreter, venvArgs...)
 		if flagDebug {
 			loggerErr.Println("Using venv module...")
-			err = execCmd(s.PythonInterpreter, "-m", "venv", s.EnvDir)
+		}
+		if showInstallOutput() {
+			err = execCmd(name, args...)
 		} else {
-			output, err = execCmdSilent(s.PythonInterpreter, "-m", "venv", s.EnvDir)
+			output, err = execCmdSilent(name, args...)
 		}
+	} else if len(s.interpreterWrapper) > 0 {
+		// virtualenv runs on the host and can't use the wrapped interpreter
+		stopProgress()
+		return fmt.Errorf("failed to create virtual environment: venv module is not available in %s: %s", s.PythonInterpreter, err)
 	} else {
 		// Ensure virtualenv is installed
 		var virtualenvPath string
 		virtualenvPath, err = exec.LookPath("virtualenv")
 		if err != nil {
+			stopProgress()
 			return fmt.Errorf("failed to find virtualenv: %s", err)
 		}
+		virtualenvArgs := []string{"--python", s.PythonInterpreter, "--prompt", s.Prompt}
+		if flagSystemSitePackages {
+			virtualenvArgs = append(virtualenvArgs, "--system-site-packages")
+		}
+		virtualenvArgs = append(virtualenvArgs, s.EnvDir)
+		name, args = virtualenvPath, virtualenvArgs
 		if flagDebug {
 			loggerErr.Println("Using virtualenv...")
-			err = execCmd(virtualenvPath, "--python", s.PythonInterpreter, s.EnvDir)
+		}
+		if showInstallOutput() {
+			err = execCmd(name, args...)
 		} else {
-			output, err = execCmdSilent(virtualenvPath, "--python", s.PythonInterpreter, s.EnvDir)
+			output, err = execCmdSilent(name, args...)
+		}
+		if err == nil && flagUpgradeDeps {
+			// virtualenv has no equivalent of venv's --upgrade-deps
+			name, args = venvBinPath(s.EnvDir, "pip"), []string{"install", "--no-input", "--upgrade", "pip", "setuptools"}
+			if flagDebug {
+				loggerErr.Println("Upgrading pip and setuptools...")
+			}
+			if showInstallOutput() {
+				err = execCmd(name, args...)
+			} else {
+				output, err = execCmdSilent(name, args...)
+			}
 		}
 	}
+	stopProgress()
+	if err != nil {
+		printCommandFailure("Creating virtual environment", name, args, output, err)
+		return fmt.Errorf("failed to create virtual environment: %s", err)
+	}
+	err = s.saveVEnvInfo()
 	if err != nil {
-		// Print buffered combined output if the command failed
-		if !flagDebug {
-			loggerErr.Println("\n", strings.Join(output, "\n"))
-		}
 		return fmt.Errorf("failed to create virtual environment: %s", err)
 	}
 	return nil
 }
 
+// getInstallCommand returns the command which installs requirements in the
+// virtual environment with pip (or uv pip). ok is false if requirements are
+// installed from a uv project, see installUVRequirements
+func (s *Script) getInstallCommand() (installer string, pipArgs []string, ok bool) {
+	installer = venvBinPath(s.EnvDir, "pip")
+	pipArgs = []string{"install", "--no-input"}
+	if s.backend == BackendUV {
+		installer = "uv"
+		pipArgs = []string{"pip", "install", "--python", venvBinPath(s.EnvDir, "python")}
+	}
+	if s.refreshing {
+		pipArgs = append(pipArgs, "--upgrade")
+	}
+	switch s.requirementsSource {
+	case RequirementsSourcePip:
+		pipArgs = append(pipArgs, "-r", s.RequirementsPath)
+	case RequirementsSourceInline, RequirementsSourceProject, RequirementsSourcePipfile, RequirementsSourcePipfileLock, RequirementsSourcePoetryLock:
+		pipArgs = append(pipArgs, s.requirementsList...)
+	default:
+		return "", nil, false
+	}
+
+	if s.ConstraintsPath != "" {
+		pipArgs = append(pipArgs, "-c", s.ConstraintsPath)
+	}
+	pipArgs = append(pipArgs, getIndexArgs()...)
+	pipArgs = append(pipArgs, flagPipArgs...)
+	return installer, pipArgs, true
+}
+
 func (s *Script) InstallRequirementsInEnv() error {
 	var err error
 	var output []string
 
-	if s.RequirementsPath == "" {
+	if s.RequirementsPath == "" || s.backend == BackendConda {
+		// Packages of conda environments are installed when they are created
 		return nil
 	}
 
-	if flagDebug {
-		err = execCmd(path.Join(s.EnvDir, "bin/pip"), "install", "--no-input", "-r", s.RequirementsPath)
+	if s.requirementsSource == RequirementsSourcePoetryLock {
+		// poetry evaluates markers of the whole dependency graph, so its set
+		// of requirements is preferred over the one read from poetry.lock
+		if requirements, ok := exportPoetryRequirements(path.Dir(s.RequirementsPath), flagExtras); ok {
+			s.requirementsList = requirements
+		}
+	}
+
+	installer, pipArgs, ok := s.getInstallCommand()
+	if !ok {
+		return s.installUVRequirements()
+	}
+
+	if flagParallelInstall && s.requirementsSource == RequirementsSourcePip {
+		var wheelDirs []string
+		var cleanup func()
+		wheelDirs, cleanup, err = s.buildRequirementGroupsInParallel()
+		if err != nil {
+			return fmt.Errorf("failed to install requirements: %s", err)
+		}
+		defer cleanup()
+		for _, dir := range wheelDirs {
+			pipArgs = append(pipArgs, "--find-links", dir)
+		}
+	}
+
+	installer, pipArgs = s.wrapCommand(installer, pipArgs...)
+	if flagInstallStallTimeout > 0 {
+		output, err = execCmdWatched(flagInstallStallTimeout, showInstallOutput(), installer, pipArgs...)
+	} else if showInstallOutput() {
+		err = execCmd(installer, pipArgs...)
 	} else {
-		output, err = execCmdSilent(path.Join(s.EnvDir, "bin/pip"), "install", "--no-input", "-r", s.RequirementsPath)
+		output, err = execCmdSilent(installer, pipArgs...)
 	}
 	if err != nil {
-		// Print buffered combined output if the command failed
-		if !flagDebug {
-			loggerErr.Println("\n", strings.Join(output, "\n"))
+		if isExternallyManagedError(output) {
+			return explainExternallyManagedError(s)
 		}
+		printCommandFailure("Installing requirements", installer, pipArgs, output, err)
 		return fmt.Errorf("failed to install requirements: %s", err)
 	}
 	return err
@@ -181,7 +577,40 @@ func (s *Script) RemoveEnv() error {
 		loggerErr.Println("Deleting virtual environment...")
 	}
 	err := removeDir(s.EnvDir)
-	return err
+	if err != nil {
+		return err
+	}
+	if !s.fromInitCommand {
+		err = removeEnvFromIndex(s.EnvDir)
+		if err != nil && flagDebug {
+			loggerErr.Printf("Failed to update environments index: %s\n", err)
+		}
+	}
+	return nil
+}
+
+// SetEnvID replaces the generated environment ID with the provided one. It
+// allows external tools to control how virtual environments are cached
+func (s *Script) SetEnvID(envID string) error {
+	if s.fromInitCommand {
+		return fmt.Errorf("environment ID can't be set for init command")
+	}
+	if !isValidEnvID(envID) {
+		return fmt.Errorf("invalid environment ID %q: only letters, digits, '.', '_' and '-' are allowed", envID)
+	}
+
+	envsDir, err := getEnvironmentDir()
+	if err != nil {
+		return err
+	}
+
+	s.venvID = envID
+	s.customEnvID = true
+	s.EnvDir = path.Join(envsDir, envID+".env")
+	if flagDebug {
+		loggerErr.Println("Using virtual environment: ", s.EnvDir)
+	}
+	return nil
 }
 
 // NewScript creates a new Script instance
@@ -197,8 +626,37 @@ func NewScript(scriptName string, interpreterOverride string, requirementsOverri
 		return nil, err
 	}
 
+	return newCachedScript(scriptPath, interpreterOverride, requirementsOverride, true)
+}
+
+// NewDirScript creates a new Script instance for the directory when there is
+// no script to anchor the virtual environment to. The requirements file is
+// looked up in the directory
+func NewDirScript(dir string, interpreterOverride string, requirementsOverride string) (*Script, error) {
+	dirPath, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return newCachedScript(dirPath, interpreterOverride, requirementsOverride, false)
+}
+
+// newCachedScript creates a new Script instance with the virtual environment
+// in the environments directory. If isScript is false, scriptPath is a
+// directory
+func newCachedScript(scriptPath string, interpreterOverride string, requirementsOverride string, isScript bool) (*Script, error) {
+	var err error
+
+	scriptDir := scriptPath
+	prompt := path.Base(scriptPath)
+	anchorPath := path.Join(scriptPath, ".placeholder")
+	if isScript {
+		scriptDir = path.Dir(scriptPath)
+		prompt = strings.TrimSuffix(prompt, ".py")
+		anchorPath = scriptPath
+	}
+
 	// Try to find requirements.txt file for the script
-	requirementsFile, err := getRequirementsFileForScript(scriptPath, requirementsOverride)
+	requirementsFile, err := getRequirementsFileForScript(anchorPath, requirementsOverride)
 	if err != nil {
 		return nil, err
 	}
@@ -211,12 +669,83 @@ func NewScript(scriptName string, interpreterOverride string, requirementsOverri
 		}
 	}
 
+	requirementsSource := RequirementsSourcePip
+	var requirementsList []string
+	if requirementsFile == "" && isScript {
+		// Requirements files take precedence over the requirements directive
+		requirementsList, err = readRequirementsDirective(scriptPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(requirementsList) > 0 {
+			if flagDebug {
+				loggerErr.Printf("Found requirements directive: %s\n", strings.Join(requirementsList, ", "))
+			}
+			explainRequirements("directive", scriptPath)
+			requirementsSource = RequirementsSourceInline
+			requirementsFile = scriptPath
+		}
+	}
+	if requirementsFile == "" || flagCondaEnvFile != "" {
+		var condaEnvFile string
+		condaEnvFile, err = findCondaEnvFile(scriptDir)
+		if err != nil {
+			return nil, err
+		}
+		if condaEnvFile != "" {
+			return newCondaScript(scriptPath, condaEnvFile, prompt, interpreterOverride)
+		}
+	}
+	if requirementsFile == "" {
+		requirementsFile, requirementsSource, requirementsList, err = findPipfileRequirements(scriptDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if requirementsFile == "" {
+		requirementsFile, requirementsList, err = findPoetryRequirements(scriptDir)
+		if err != nil {
+			return nil, err
+		}
+		if requirementsFile != "" {
+			requirementsSource = RequirementsSourcePoetryLock
+		}
+	}
+	if requirementsFile == "" {
+		requirementsFile, requirementsList, err = findProjectDependencies(scriptDir)
+		if err != nil {
+			return nil, err
+		}
+		if requirementsFile != "" {
+			requirementsSource = RequirementsSourceProject
+		}
+	}
+
 	requirementsHash := ""
-	if requirementsFile != "" {
-		requirementsHash, err = getFileHash(requirementsFile)
+	if requirementsSource == RequirementsSourceInline {
+		requirementsHash = getInlineRequirementsHash(requirementsList)
+	} else if requirementsSource == RequirementsSourceProject {
+		requirementsHash = getInlineRequirementsHash(normalizeDependencies(requirementsList))
+	} else if requirementsSource == RequirementsSourcePipfile || requirementsSource == RequirementsSourcePipfileLock || requirementsSource == RequirementsSourcePoetryLock {
+		requirementsHash, err = getLockFileHash(requirementsFile, flagExtras)
 		if err != nil {
 			return nil, err
 		}
+	} else if requirementsFile != "" {
+		err = checkRequirementsSize(requirementsFile)
+		if err != nil {
+			return nil, err
+		}
+		requirementsFile, err = skipEmptyRequirements(requirementsFile)
+		if err != nil {
+			return nil, err
+		}
+		if requirementsFile != "" {
+			requirementsHash, err = getRequirementsHash(requirementsFile)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	if flagDebug {
@@ -224,36 +753,55 @@ func NewScript(scriptName string, interpreterOverride string, requirementsOverri
 	}
 
 	var pythonInterpreter string
+	var interpreterWrapper []string
 	if interpreterOverride == "" {
-		pythonInterpreter, err = extractPythonFromShebang(scriptPath)
-		if err != nil {
-			if flagDebug {
-				loggerErr.Printf("Failed to extract python from shebang: %s\n", err)
+		if isScript {
+			pythonInterpreter, _, err = extractPythonFromShebang(scriptPath)
+			if err != nil {
+				if flagDebug {
+					loggerErr.Printf("Failed to extract python from shebang: %s\n", err)
+				}
 			}
+			pythonInterpreter = resolveRelativeInterpreter(pythonInterpreter, scriptDir)
 		}
-		if pythonInterpreter == "" {
-			pythonInterpreter = "python"
+		// An explicit interpreter in the shebang takes precedence over asdf
+		if isGenericPythonInterpreter(pythonInterpreter) {
+			if asdfPython := resolveASDFPython(scriptDir); asdfPython != "" {
+				pythonInterpreter = asdfPython
+			}
 		}
 	} else {
-		pythonInterpreter = interpreterOverride
+		pythonInterpreter, interpreterWrapper, err = resolveInterpreterOverride(interpreterOverride)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Check if the python interpreter exists in path
-	_, err = exec.LookPath(pythonInterpreter)
-	if err != nil && interpreterOverride != "" {
-		return nil, fmt.Errorf("failed to find python interpreter %s: %s", pythonInterpreter, err)
-	} else if err != nil {
-		if flagDebug {
-			loggerErr.Printf("Failed to find python interpreter %s: %s, assuming `python`...\n", pythonInterpreter, err)
-		}
-		pythonInterpreter = "python"
-		_, err = exec.LookPath(pythonInterpreter)
+	// Check if the python interpreter exists in path. The interpreter run
+	// with a wrapper isn't on the host
+	if len(interpreterWrapper) == 0 {
+		pythonInterpreter, err = findPythonInterpreter(pythonInterpreter, interpreterOverride != "")
 		if err != nil {
-			return nil, fmt.Errorf("failed to find python interpreter %s: %s", pythonInterpreter, err)
+			return nil, err
 		}
 	}
 
-	pythonVersion, err := getPythonVersion(pythonInterpreter)
+	pythonVersion, err := getPythonVersion(interpreterWrapper, pythonInterpreter)
+	if err != nil {
+		return nil, err
+	}
+
+	// The supported Python versions can be declared in the PEP 723 inline
+	// script metadata or in pyproject.toml
+	metadataScript := ""
+	if isScript {
+		metadataScript = scriptPath
+	}
+	requiresPython, requiresPythonSource, err := getRequiresPython(metadataScript, scriptDir)
+	if err != nil {
+		return nil, err
+	}
+	pythonInterpreter, pythonVersion, err = checkRequiresPython(requiresPython, requiresPythonSource, pythonInterpreter, pythonVersion, interpreterOverride != "")
 	if err != nil {
 		return nil, err
 	}
@@ -262,31 +810,108 @@ func NewScript(scriptName string, interpreterOverride string, requirementsOverri
 		loggerErr.Printf("Using python interpreter: %s\n", pythonVersion)
 	}
 
-	envID := generateEnvID(requirementsHash, pythonVersion)
+	interpreterPath, err := getInterpreterPath(interpreterWrapper, pythonInterpreter)
+	if err != nil {
+		return nil, err
+	}
+	if flagDebug {
+		loggerErr.Printf("Python interpreter path: %s\n", interpreterPath)
+	}
 
-	homeDir, err := os.UserHomeDir()
+	backend, err := resolveBackend(interpreterWrapper)
 	if err != nil {
 		return nil, err
 	}
+	if flagDebug {
+		loggerErr.Printf("Using %s backend\n", backend)
+	}
 
-	envDir := path.Join(homeDir, EnvironmentsDir, envID+".env")
+	variants, err := getEnvIDVariants(backend, interpreterWrapper, pythonInterpreter)
+	if err != nil {
+		return nil, err
+	}
+	constraintsFile := ""
+	if requirementsFile != "" && requirementsSource != RequirementsSourceUVLock {
+		// uv.lock already pins all packages
+		constraintsFile, err = getConstraintsFileForScript(anchorPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	constraintsVariant, err := getConstraintsVariant(constraintsFile)
+	if err != nil {
+		return nil, err
+	}
+	variants = append(variants, constraintsVariant...)
+
+	idRequirementsHash := getEnvIDRequirementsHash(requirementsHash, requirementsSource, requirementsFile, requirementsList, interpreterWrapper, pythonInterpreter, pythonVersion)
+	envID := generateEnvID(idRequirementsHash, pythonVersion, interpreterPath, variants...)
+
+	envsDir, err := getEnvironmentDir()
+	if err != nil {
+		return nil, err
+	}
+
+	envDir := path.Join(envsDir, envID+".env")
 
 	if flagDebug {
 		loggerErr.Println("Using virtual environment: ", envDir)
 	}
 
 	script := &Script{
-		AbsolutePath:      scriptPath,
-		EnvDir:            envDir,
-		PythonInterpreter: pythonInterpreter,
-		RequirementsPath:  requirementsFile,
-		venvID:            envID,
+		AbsolutePath:       scriptPath,
+		EnvDir:             envDir,
+		PythonInterpreter:  pythonInterpreter,
+		interpreterWrapper: interpreterWrapper,
+		RequirementsPath:   requirementsFile,
+		ConstraintsPath:    constraintsFile,
+		Prompt:             prompt,
+		venvID:             envID,
+		requirementsHash:   requirementsHash,
+		requirementsSource: requirementsSource,
+		requirementsList:   requirementsList,
+		pythonVersion:      pythonVersion,
+		backend:            backend,
+		variants:           variants,
 	}
 	return script, nil
 }
 
-// NewInitCmd creates a new Script instance
-func NewInitCmd(interpreterOverride string, requirementsOverride string) (*Script, error) {
+// getInitEnvDir returns the directory of the virtual environment created with
+// init command in projectDir
+func getInitEnvDir(projectDir string, venvDirOverride string) (string, error) {
+	if venvDirOverride != "" {
+		return filepath.Abs(venvDirOverride)
+	}
+
+	envDir := getProjectEnvDir(projectDir)
+	if envDir != "" {
+		if flagDebug {
+			loggerErr.Println("Found virtual environment created with --venv-dir: ", envDir)
+		}
+		return envDir, nil
+	}
+
+	envDir = path.Join(projectDir, VEnvDirDefaultName)
+	if _, err := os.Stat(envDir); err == nil {
+		return envDir, nil
+	}
+	err := checkDirWritable(projectDir)
+	if err != nil {
+		return "", fmt.Errorf("unable to create virtual environment in %s: directory is not writable (%s). Use --venv-dir to create it in a writable location", projectDir, err)
+	}
+	return envDir, nil
+}
+
+// appendLocationVariant makes the ID of the virtual environment depend on its location
+func appendLocationVariant(variants []string, envDir string) []string {
+	return append(variants, "location:"+envDir)
+}
+
+// NewInitCmd creates a new Script instance. The virtual environment is created
+// in .venv directory in the current directory, unless venvDirOverride is
+// provided or the current directory was initialized with it before
+func NewInitCmd(interpreterOverride string, requirementsOverride string, venvDirOverride string) (*Script, error) {
 	cwd, err := os.Getwd()
 	if err != nil {
 		return nil, err
@@ -298,6 +923,42 @@ func NewInitCmd(interpreterOverride string, requirementsOverride string) (*Scrip
 		return nil, err
 	}
 
+	// Lock files of pipenv and poetry take precedence over a uv project
+	// without uv.lock, which is detected by pyproject.toml only
+	requirementsSource := RequirementsSourcePip
+	var requirementsList []string
+	if requirementsFile == "" {
+		requirementsFile, requirementsSource, requirementsList, err = findPipfileRequirements(cwd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if requirementsFile == "" {
+		requirementsFile, requirementsList, err = findPoetryRequirements(cwd)
+		if err != nil {
+			return nil, err
+		}
+		if requirementsFile != "" {
+			requirementsSource = RequirementsSourcePoetryLock
+		}
+	}
+	if requirementsOverride == "" && requirementsSource == RequirementsSourcePip {
+		source, file := detectUVProject(cwd, requirementsFile != "")
+		if file != "" {
+			requirementsSource = source
+			requirementsFile = file
+		}
+	}
+	if requirementsFile == "" {
+		requirementsFile, requirementsList, err = findProjectDependencies(cwd)
+		if err != nil {
+			return nil, err
+		}
+		if requirementsFile != "" {
+			requirementsSource = RequirementsSourceProject
+		}
+	}
+
 	if flagDebug {
 		if requirementsFile == "" {
 			loggerErr.Println("No requirements file found")
@@ -308,7 +969,19 @@ func NewInitCmd(interpreterOverride string, requirementsOverride string) (*Scrip
 
 	requirementsHash := ""
 	if requirementsFile != "" {
-		requirementsHash, err = getFileHash(requirementsFile)
+		if requirementsSource == RequirementsSourcePip {
+			err = checkRequirementsSize(requirementsFile)
+			if err != nil {
+				return nil, err
+			}
+			requirementsFile, err = skipEmptyRequirements(requirementsFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if requirementsFile != "" {
+		requirementsHash, err = getRequirementsSourceHash(requirementsSource, requirementsFile, flagExtras)
 		if err != nil {
 			return nil, err
 		}
@@ -319,28 +992,35 @@ func NewInitCmd(interpreterOverride string, requirementsOverride string) (*Scrip
 	}
 
 	var pythonInterpreter string
+	var interpreterWrapper []string
 	if interpreterOverride == "" {
-		pythonInterpreter = "python"
+		pythonInterpreter = resolveASDFPython(cwd)
 	} else {
-		pythonInterpreter = interpreterOverride
+		pythonInterpreter, interpreterWrapper, err = resolveInterpreterOverride(interpreterOverride)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Check if the python interpreter exists in path
-	_, err = exec.LookPath(pythonInterpreter)
-	if err != nil && interpreterOverride != "" {
-		return nil, fmt.Errorf("failed to find python interpreter %s: %s", pythonInterpreter, err)
-	} else if err != nil {
-		if flagDebug {
-			loggerErr.Printf("Failed to find python interpreter %s: %s, assuming `python`...\n", pythonInterpreter, err)
-		}
-		pythonInterpreter = "python"
-		_, err = exec.LookPath(pythonInterpreter)
+	// Check if the python interpreter exists in path. The interpreter run
+	// with a wrapper isn't on the host
+	if len(interpreterWrapper) == 0 {
+		pythonInterpreter, err = findPythonInterpreter(pythonInterpreter, interpreterOverride != "")
 		if err != nil {
-			return nil, fmt.Errorf("failed to find python interpreter %s: %s", pythonInterpreter, err)
+			return nil, err
 		}
 	}
 
-	pythonVersion, err := getPythonVersion(pythonInterpreter)
+	pythonVersion, err := getPythonVersion(interpreterWrapper, pythonInterpreter)
+	if err != nil {
+		return nil, err
+	}
+
+	requiresPython, requiresPythonSource, err := getRequiresPython("", cwd)
+	if err != nil {
+		return nil, err
+	}
+	pythonInterpreter, pythonVersion, err = checkRequiresPython(requiresPython, requiresPythonSource, pythonInterpreter, pythonVersion, interpreterOverride != "")
 	if err != nil {
 		return nil, err
 	}
@@ -349,24 +1029,72 @@ func NewInitCmd(interpreterOverride string, requirementsOverride string) (*Scrip
 		loggerErr.Printf("Using python interpreter: %s\n", pythonVersion)
 	}
 
-	envID := generateEnvID(requirementsHash, pythonVersion)
+	interpreterPath, err := getInterpreterPath(interpreterWrapper, pythonInterpreter)
+	if err != nil {
+		return nil, err
+	}
 	if flagDebug {
-		loggerErr.Printf("Generated environment ID: %s\n", envID)
+		loggerErr.Printf("Python interpreter path: %s\n", interpreterPath)
+	}
+
+	backend, err := resolveBackend(interpreterWrapper)
+	if err != nil {
+		return nil, err
+	}
+	if flagDebug {
+		loggerErr.Printf("Using %s backend\n", backend)
 	}
 
-	envDir := path.Join(cwd, VEnvDirDefaultName)
+	variants, err := getEnvIDVariants(backend, interpreterWrapper, pythonInterpreter)
+	if err != nil {
+		return nil, err
+	}
+	constraintsFile := ""
+	if requirementsFile != "" && requirementsSource != RequirementsSourceUVLock {
+		// uv.lock already pins all packages
+		constraintsFile, err = getConstraintsFileForScript(path.Join(cwd, ".placeholder"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	constraintsVariant, err := getConstraintsVariant(constraintsFile)
+	if err != nil {
+		return nil, err
+	}
+	variants = append(variants, constraintsVariant...)
+
+	envDir, err := getInitEnvDir(cwd, venvDirOverride)
+	if err != nil {
+		return nil, err
+	}
+
+	variants = appendLocationVariant(variants, envDir)
+	idRequirementsHash := getEnvIDRequirementsHash(requirementsHash, requirementsSource, requirementsFile, requirementsList, interpreterWrapper, pythonInterpreter, pythonVersion)
+	envID := generateEnvID(idRequirementsHash, pythonVersion, interpreterPath, variants...)
+	if flagDebug {
+		loggerErr.Printf("Generated environment ID: %s\n", envID)
+	}
 
 	if flagDebug {
 		loggerErr.Println("Using virtual environment: ", envDir)
 	}
 
 	script := &Script{
-		AbsolutePath:      cwd,
-		EnvDir:            envDir,
-		PythonInterpreter: pythonInterpreter,
-		RequirementsPath:  requirementsFile,
-		venvID:            envID,
-		fromInitCommand:   true,
+		AbsolutePath:       cwd,
+		EnvDir:             envDir,
+		PythonInterpreter:  pythonInterpreter,
+		interpreterWrapper: interpreterWrapper,
+		RequirementsPath:   requirementsFile,
+		ConstraintsPath:    constraintsFile,
+		Prompt:             path.Base(cwd),
+		venvID:             envID,
+		requirementsHash:   requirementsHash,
+		requirementsSource: requirementsSource,
+		requirementsList:   requirementsList,
+		pythonVersion:      pythonVersion,
+		backend:            backend,
+		variants:           variants,
+		fromInitCommand:    true,
 	}
 	return script, nil
 }
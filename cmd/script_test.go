@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitEnvsAreIndependent(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is not installed")
+	}
+	flagEnvDir = t.TempDir()
+	defer func() { flagEnvDir = "" }()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	projects := t.TempDir()
+	initProject := func(project string) *Script {
+		t.Helper()
+		projectDir := filepath.Join(projects, project)
+		writeRequirementFiles(t, projectDir, map[string]string{"requirements.txt": "requests==2.31.0\n"})
+		err := os.Chdir(projectDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		script, err := NewInitCmd("", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return script
+	}
+
+	scriptA := initProject("a")
+	scriptB := initProject("b")
+	if scriptA.requirementsHash != scriptB.requirementsHash {
+		t.Fatalf("expected identical requirements, got %s and %s", scriptA.requirementsHash, scriptB.requirementsHash)
+	}
+	if scriptA.venvID == scriptB.venvID {
+		t.Errorf("projects with identical requirements share the environment ID %s", scriptA.venvID)
+	}
+
+	scriptAgain := initProject("a")
+	if scriptAgain.venvID != scriptA.venvID {
+		t.Errorf("expected the same environment ID for the same project, got %s and %s", scriptA.venvID, scriptAgain.venvID)
+	}
+}
+
+func TestCondaRejectsPythonOverride(t *testing.T) {
+	flagEnvDir = t.TempDir()
+	defer func() { flagEnvDir = "" }()
+
+	dir := t.TempDir()
+	writeRequirementFiles(t, dir, map[string]string{"environment.yml": "dependencies:\n  - python=3.11\n"})
+	envFile := filepath.Join(dir, "environment.yml")
+
+	_, err := newCondaScript(filepath.Join(dir, "script.py"), envFile, "script", "python3.12")
+	if err == nil {
+		t.Fatal("expected an error with --python")
+	}
+	script, err := newCondaScript(filepath.Join(dir, "script.py"), envFile, "script", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if script.backend != BackendConda {
+		t.Errorf("expected %s backend, got %s", BackendConda, script.backend)
+	}
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// getSystemPackagesHash calculates the hash of the packages installed in the
+// site-packages of the Python interpreter. Virtual environments created with
+// --system-site-packages depend on them
+func getSystemPackagesHash(wrapper []string, pythonInterpreter string) (string, error) {
+	name, args := wrapCommand(wrapper, pythonInterpreter, "-m", "pip", "list", "--format=freeze")
+	// execCmdSilent discards the output of successful commands
+	output, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to list system site-packages of %s: %s", pythonInterpreter, err)
+	}
+
+	var packages []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		// Skip pip warnings, e.g. about a new version being available
+		if line != "" && !strings.HasPrefix(line, "[notice]") && !strings.HasPrefix(line, "WARNING") {
+			packages = append(packages, line)
+		}
+	}
+	sort.Strings(packages)
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(packages, "\n"))))
+	if flagDebug {
+		loggerErr.Printf("System site-packages hash: %s (%d packages)\n", hash, len(packages))
+	}
+	return hash, nil
+}
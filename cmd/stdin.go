@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// StdinScriptName is the name of the file the script read from STDIN is
+// written to
+const StdinScriptName = "stdin.py"
+
+// StdinDirPrefix is the prefix of the temporary directory the script read
+// from STDIN is written to
+const StdinDirPrefix = "invenv-stdin-"
+
+// isStdinScript returns true if the script was read from STDIN. Such scripts
+// are removed after they run
+func isStdinScript(scriptPath string) bool {
+	return path.Base(scriptPath) == StdinScriptName && strings.HasPrefix(path.Base(path.Dir(scriptPath)), StdinDirPrefix)
+}
+
+// writeStdinScript writes the script read from STDIN to a new temporary
+// directory, so no requirements files are guessed for it. The returned
+// function removes the directory
+func writeStdinScript() (string, func(), error) {
+	noop := func() {}
+
+	content, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", noop, err
+	}
+
+	tmpDir, err := os.MkdirTemp("", StdinDirPrefix)
+	if err != nil {
+		return "", noop, err
+	}
+	cleanup := func() {
+		err := os.RemoveAll(tmpDir)
+		if err != nil && flagDebug {
+			loggerErr.Printf("Failed to remove %s: %s\n", tmpDir, err)
+		}
+	}
+
+	// The script must be readable when it runs as a different user with
+	// --drop-privileges
+	err = os.Chmod(tmpDir, 0755)
+	if err != nil {
+		cleanup()
+		return "", noop, err
+	}
+	scriptPath := path.Join(tmpDir, StdinScriptName)
+	err = os.WriteFile(scriptPath, content, 0644)
+	if err != nil {
+		cleanup()
+		return "", noop, err
+	}
+	if flagDebug {
+		loggerErr.Printf("Wrote script from STDIN to %s\n", scriptPath)
+	}
+	return scriptPath, cleanup, nil
+}
@@ -2,15 +2,19 @@ package cmd
 
 import (
 	"bufio"
-	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"math/big"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-cmd/cmd"
@@ -22,19 +26,30 @@ const EnvironmentsDir = ".local/invenv"
 const CyanColor = "\033[1;36m"
 const ResetColor = "\033[0m"
 
-// LockAcquireAttempts is the number of attempts to acquire the lock. Also
-// correlates with the number of seconds to wait for the lock.
-const LockAcquireAttempts = 300
+// LockAcquireInterval is the default interval between attempts to acquire the
+// lock
+const LockAcquireInterval = 1 * time.Second
 
-// LockStaleTime is the time after which the lock is considered stale
+// LockStaleTime is the default time after which the lock is considered stale
 const LockStaleTime = 15 * time.Minute
 
 // StaleEnvironmentTime is the time after which the virtual environment is considered stale
 const StaleEnvironmentTime = 14 * 24 * time.Hour
 
+// envIDRegexp matches environment IDs which are safe to use as directory names
+var envIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
 // errStaleLock is returned when the lockfile is stale - older than LockStaleTime
 var errStaleLockfile = fmt.Errorf("stale lockfile")
 
+// errEnvLocked is returned when the virtual environment is locked by another
+// process
+var errEnvLocked = fmt.Errorf("virtual environment is locked")
+
+// errLockTimeout is returned when the lock wasn't acquired in --lock-attempts
+// attempts or in --lock-timeout
+var errLockTimeout = fmt.Errorf("timed out waiting for the lock")
+
 // getFileHash calculates the SHA256 hash of the file
 func getFileHash(filename string) (string, error) {
 	// Check that the file exists
@@ -49,67 +64,313 @@ func getFileHash(filename string) (string, error) {
 	}
 
 	// Calculate hash of the file
-	hasher := sha1.New()
-	hasher.Write(dataBytes)
-	hashBS := hasher.Sum(nil)
-	hashStr := fmt.Sprintf("%x", hashBS)[:8]
-	return hashStr, nil
+	return fmt.Sprintf("%x", sha256.Sum256(dataBytes)), nil
 }
 
 // generateEnvID generates a unique name for the virtual environment based
-// on the requirements file hash and the Python version
-func generateEnvID(requirementsHash, pythonVersion string) string {
-	venvID := fmt.Sprintf("%s_%s", requirementsHash, pythonVersion)
-	// Encode it in base62
-	bigInt := big.NewInt(0).SetBytes([]byte(venvID))
+// on the requirements file hash, the Python version and the path of the
+// Python interpreter. Variants describe options which change the content of
+// the virtual environment
+func generateEnvID(requirementsHash, pythonVersion, interpreterPath string, variants ...string) string {
+	venvID := fmt.Sprintf("%s_%s_%s", requirementsHash, pythonVersion, interpreterPath)
+	for _, variant := range variants {
+		venvID += "_" + variant
+	}
+	// Hash it to keep the ID (and shebangs of scripts in the virtual
+	// environment) short and encode it in base62
+	hashBS := sha256.Sum256([]byte(venvID))
+	bigInt := big.NewInt(0).SetBytes(hashBS[:])
 	encoded := base62.EncodeBigInt(bigInt)
 	return encoded
 }
 
+// getEnvIDVariants returns variants of the virtual environment selected with
+// flags, see generateEnvID
+func getEnvIDVariants(backend string, wrapper []string, pythonInterpreter string) ([]string, error) {
+	var variants []string
+	if flagPlatformRequirements {
+		// Platforms must not share virtual environments
+		variants = append(variants, runtime.GOOS)
+	}
+	if flagUpgradeDeps {
+		variants = append(variants, "upgrade-deps")
+	}
+	if backend == BackendUV {
+		// Virtual environments created by uv are not identical to the ones
+		// created by venv
+		variants = append(variants, BackendUV)
+	}
+	if flagSystemSitePackages {
+		variants = append(variants, "system-site-packages")
+		if flagHashSystemSitePackages {
+			hash, err := getSystemPackagesHash(wrapper, pythonInterpreter)
+			if err != nil {
+				return nil, err
+			}
+			variants = append(variants, "system-packages-"+hash)
+		}
+	} else if flagHashSystemSitePackages {
+		return nil, fmt.Errorf("--hash-system-site-packages requires --system-site-packages")
+	}
+	if flagHashIndex {
+		indexArgs := getIndexArgs()
+		if len(indexArgs) == 0 {
+			return nil, fmt.Errorf("--hash-index requires --index-url or --extra-index-url")
+		}
+		variants = append(variants, "index:"+strings.Join(indexArgs, " "))
+	}
+	return variants, nil
+}
+
+// getIndexArgs returns pip (and uv) arguments which select package indexes,
+// see --index-url and --extra-index-url
+func getIndexArgs() []string {
+	var args []string
+	if flagIndexURL != "" {
+		args = append(args, "--index-url", flagIndexURL)
+	}
+	for _, url := range flagExtraIndexURLs {
+		args = append(args, "--extra-index-url", url)
+	}
+	return args
+}
+
+// isValidEnvID checks that the environment ID is safe to use as a directory name
+func isValidEnvID(envID string) bool {
+	if envID == "" || envID == "." || envID == ".." {
+		return false
+	}
+	return envIDRegexp.MatchString(envID)
+}
+
 func generateLockFileName(envDir string) string {
 	lockFileName := path.Join(path.Dir(envDir), path.Base(envDir)+".lock")
 	return lockFileName
 }
 
+// heldLockFiles holds open lock files of virtual environments locked by this
+// process. The advisory lock is held as long as the file is open
+var heldLockFiles = struct {
+	sync.Mutex
+	files map[string]*os.File
+}{files: make(map[string]*os.File)}
+
+// isEnvLocked checks if the virtual environment is locked. A lock file which is
+// not locked with an advisory lock was left by a crashed process and doesn't
+// lock the virtual environment
 func isEnvLocked(envDir string) bool {
 	lockFileName := generateLockFileName(envDir)
 	_, err := os.Stat(lockFileName)
 	if err != nil && os.IsNotExist(err) {
 		return false
 	}
-	return true
+	if !flockSupported {
+		return true
+	}
+
+	heldLockFiles.Lock()
+	_, held := heldLockFiles.files[envDir]
+	heldLockFiles.Unlock()
+	if held {
+		return true
+	}
+
+	file, err := os.Open(lockFileName)
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+	defer file.Close()
+	locked, err := flockFile(file, false)
+	if err != nil || !locked {
+		return true
+	}
+	funlockFile(file)
+	return false
 }
 
+// lockEnv locks the virtual environment without waiting. errEnvLocked is
+// returned if another process holds the lock. Without advisory locks the lock
+// file is taken over, waitUntilEnvIsUnlocked must be used before
 func lockEnv(envDir string) error {
 	if flagDebug {
 		loggerErr.Println("Locking virtual environment...")
 	}
-	lockFileName := generateLockFileName(envDir)
-	_, err := os.Stat(lockFileName)
-	if err == nil {
-		// Already locked
-		return nil
-	}
-	if os.IsNotExist(err) {
-		if err = os.MkdirAll(path.Dir(lockFileName), 0755); err != nil {
+	if !flockSupported {
+		lockFileName := generateLockFileName(envDir)
+		_, err := os.Stat(lockFileName)
+		if err == nil {
+			// Already locked
+			trackLock(envDir)
+			return nil
+		}
+		if !os.IsNotExist(err) {
 			return err
 		}
-		_, err = os.Create(lockFileName)
+	}
+	locked, err := tryLockEnv(envDir)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return errEnvLocked
+	}
+	return nil
+}
+
+// acquireEnvLock locks the virtual environment, waiting for another process to
+// release the lock. The number of attempts and the interval between them are
+// the same as in waitUntilEnvIsUnlocked
+func acquireEnvLock(envDir string) error {
+	attempts, interval, _, err := getLockSettings()
+	if err != nil {
 		return err
 	}
-	return err
+	timeout, err := getLockTimeout()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err = lockEnv(envDir)
+		if !errors.Is(err, errEnvLocked) {
+			return err
+		}
+		if attempts > 0 && attempt >= attempts {
+			return fmt.Errorf("%s on %s after %d attempts", errLockTimeout, envDir, attempts)
+		}
+		if timeout > 0 && time.Since(start) >= timeout {
+			return fmt.Errorf("%s on %s after %s", errLockTimeout, envDir, timeout)
+		}
+		time.Sleep(interval)
+	}
 }
 
 func unlockEnv(envDir string) error {
 	if flagDebug {
 		loggerErr.Println("Unlocking virtual environment...")
 	}
+	// The lock file is removed while the advisory lock is still held, so no
+	// other process can lock the file which is being removed
 	lockFileName := generateLockFileName(envDir)
 	err := os.Remove(lockFileName)
-	if os.IsNotExist(err) {
-		return nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	heldLockFiles.Lock()
+	file, held := heldLockFiles.files[envDir]
+	delete(heldLockFiles.files, envDir)
+	heldLockFiles.Unlock()
+	if held {
+		funlockFile(file)
+		file.Close()
+	}
+	untrackLock(envDir)
+	return nil
+}
+
+// withEnvLock runs fn while holding the lock of the virtual environment. The
+// lock is released when fn returns or panics, so a crash doesn't leave the
+// lock behind until it becomes stale
+func withEnvLock(envDir string, fn func() error) error {
+	err := acquireEnvLock(envDir)
+	if err != nil {
+		return fmt.Errorf("failed to lock virtual environment: %s", err)
+	}
+	if flagKeepLockOnExit {
+		loggerErr.Printf("Debug: keeping lock file %s\n", generateLockFileName(envDir))
+		return fn()
 	}
-	return err
+	// Deferred calls run while the panic unwinds the stack
+	defer unlockEnv(envDir)
+	return fn()
+}
+
+// withFileLock runs fn while holding an exclusive advisory lock on the lock
+// file, waiting for other processes to release it. It serializes short
+// read-modify-write cycles of shared files, e.g. the index. The lock file is
+// never removed. Without advisory locks (Windows) fn runs unlocked and
+// shared files rely on being replaced atomically
+func withFileLock(lockFileName string, fn func() error) error {
+	if !flockSupported {
+		return fn()
+	}
+	err := os.MkdirAll(path.Dir(lockFileName), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(lockFileName, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file %s: %s", lockFileName, err)
+	}
+	defer file.Close()
+	err = flockFileWait(file)
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %s", lockFileName, err)
+	}
+	defer funlockFile(file)
+	return fn()
+}
+
+// getLockSettings returns the number of attempts to acquire the lock (0 means
+// no limit), the interval between them and the time after which the lock is
+// considered stale. Flags take precedence over the lock section of the
+// configuration file
+func getLockSettings() (int, time.Duration, time.Duration, error) {
+	attempts, interval, staleTime := flagLockAttempts, flagLockInterval, flagLockStaleTime
+
+	config, err := loadConfig()
+	if err != nil {
+		if flagDebug {
+			loggerErr.Println(err)
+		}
+		config = &Config{}
+	}
+	if attempts == 0 {
+		attempts = config.Lock.Attempts
+	}
+	if interval == 0 && config.Lock.Interval != "" {
+		interval, err = time.ParseDuration(config.Lock.Interval)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid lock interval in the configuration file: %s", err)
+		}
+	}
+	if staleTime == 0 && config.Lock.StaleTime != "" {
+		staleTime, err = time.ParseDuration(config.Lock.StaleTime)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid lock stale_time in the configuration file: %s", err)
+		}
+	}
+
+	if attempts < 0 || interval < 0 || staleTime < 0 {
+		return 0, 0, 0, fmt.Errorf("lock attempts, interval and stale time must not be negative")
+	}
+	if interval == 0 {
+		interval = LockAcquireInterval
+	}
+	if staleTime == 0 {
+		staleTime = LockStaleTime
+	}
+	return attempts, interval, staleTime, nil
+}
+
+// getLockTimeout returns the maximum time to wait for the lock, 0 means no
+// limit. --lock-timeout takes precedence over the configuration file
+func getLockTimeout() (time.Duration, error) {
+	timeout := flagLockTimeout
+	if timeout == 0 {
+		config, err := loadConfig()
+		if err == nil && config.Lock.Timeout != "" {
+			timeout, err = time.ParseDuration(config.Lock.Timeout)
+			if err != nil {
+				return 0, fmt.Errorf("invalid lock timeout in the configuration file: %s", err)
+			}
+		}
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("lock timeout must not be negative")
+	}
+	return timeout, nil
 }
 
 func waitUntilEnvIsUnlocked(envDir string) error {
@@ -117,17 +378,36 @@ func waitUntilEnvIsUnlocked(envDir string) error {
 		loggerErr.Println("Acquiring lock on virtual environment...")
 		defer loggerErr.Println("Lock acquired")
 	}
+	attempts, interval, staleTime, err := getLockSettings()
+	if err != nil {
+		return err
+	}
+	timeout, err := getLockTimeout()
+	if err != nil {
+		return err
+	}
 	now := time.Now()
-	for {
+	for attempt := 1; ; attempt++ {
 		if !isEnvLocked(envDir) {
 			return nil
 		}
-		time.Sleep(1 * time.Second)
-		if time.Since(now) > LockStaleTime {
+		if attempts > 0 && attempt > attempts {
+			return fmt.Errorf("%s on %s after %d attempts", errLockTimeout, envDir, attempts)
+		}
+		if timeout > 0 && time.Since(now) >= timeout {
+			return fmt.Errorf("%s on %s after %s", errLockTimeout, envDir, timeout)
+		}
+		time.Sleep(interval)
+		if flockSupported {
+			// The advisory lock is held by a running process, it is never
+			// stale
+			continue
+		}
+		if time.Since(now) > staleTime {
 			return errStaleLockfile
 		}
 		// Lockfile is not stale but lets check if there is a process which uses this virtual environment
-		if runtime.GOOS == "linux" {
+		if processDetectionSupported {
 			_, err := findProcessWithPrefix(envDir)
 			if err == ErrNoProcessFound {
 				return err
@@ -136,11 +416,92 @@ func waitUntilEnvIsUnlocked(envDir string) error {
 	}
 }
 
-// extractPythonFromShebang extracts the interpreter path from a shebang
-func extractPythonFromShebang(filename string) (string, error) {
+// envOptionsWithArgument are options of env which take an argument as the
+// next word, e.g. env -u NAME python
+var envOptionsWithArgument = map[string]bool{
+	"-u": true, "--unset": true,
+	"-C": true, "--chdir": true,
+	"-P": true,
+}
+
+// isPythonInterpreterName checks if the command looks like a Python
+// interpreter, e.g. python3.11 or /usr/bin/pypy3
+func isPythonInterpreterName(command string) bool {
+	name := strings.ToLower(filepath.Base(command))
+	return strings.HasPrefix(name, "python") || strings.HasPrefix(name, "pypy")
+}
+
+// parseShebang returns the Python interpreter and its flags from the shebang
+// line. The interpreter is either the command itself (#!/usr/bin/python3 -O)
+// or the command run with env (#!/usr/bin/env python3). Options of env
+// (including -S, which splits the rest of the line into arguments) and
+// variable assignments are skipped. If the command doesn't look like a Python
+// interpreter, the first word which does is used, without flags
+func parseShebang(line string) (string, []string, error) {
+	words := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(words) == 0 {
+		return "", nil, fmt.Errorf("shebang is empty")
+	}
+
+	command := 0
+	if filepath.Base(words[0]) == "env" {
+		command = -1
+		for i := 1; i < len(words); i++ {
+			word := words[i]
+			switch {
+			case envOptionsWithArgument[word]:
+				i++
+			case strings.HasPrefix(word, "--split-string="):
+				words[i] = strings.TrimPrefix(word, "--split-string=")
+				command = i
+			case strings.HasPrefix(word, "-S") && len(word) > 2:
+				words[i] = strings.TrimPrefix(word, "-S")
+				command = i
+			case strings.HasPrefix(word, "-"), strings.Contains(word, "="):
+			default:
+				command = i
+			}
+			if command != -1 {
+				break
+			}
+		}
+		if command == -1 {
+			return "", nil, fmt.Errorf("no command found in shebang %q", line)
+		}
+	}
+
+	if isPythonInterpreterName(words[command]) {
+		return words[command], words[command+1:], nil
+	}
+	for _, word := range words[command+1:] {
+		if isPythonInterpreterName(word) {
+			return word, nil, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no python interpreter found in shebang %q", line)
+}
+
+// resolveRelativeInterpreter resolves the relative interpreter path from the
+// shebang (e.g. ./venv/bin/python) against the script directory. Interpreter
+// names without a directory (e.g. python3) are looked up in PATH and are
+// returned as is
+func resolveRelativeInterpreter(interpreter string, scriptDir string) string {
+	if interpreter == "" || filepath.IsAbs(interpreter) || !strings.ContainsAny(interpreter, `/\`) {
+		return interpreter
+	}
+	resolved := filepath.Join(scriptDir, interpreter)
+	if flagDebug {
+		loggerErr.Printf("Resolved relative python interpreter %s from shebang to %s\n", interpreter, resolved)
+	}
+	return resolved
+}
+
+// extractPythonFromShebang extracts the interpreter path and its flags (e.g.
+// -O or -X dev) from a shebang
+func extractPythonFromShebang(filename string) (string, []string, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	defer file.Close()
 
@@ -155,16 +516,7 @@ func extractPythonFromShebang(filename string) (string, error) {
 		}
 
 		if strings.HasPrefix(line, "#!") {
-			interpreterPath := strings.TrimPrefix(line, "#!")
-			// Two cases are possible: it could be a python interpreter or it could be
-			// something like /usr/bin/env python
-			// First we split the line by spaces
-			split := strings.Split(interpreterPath, " ")
-			if len(split) > 1 {
-				// The last part must be python interpreter
-				return split[len(split)-1], nil
-			}
-			return interpreterPath, nil
+			return parseShebang(line)
 		}
 
 		// Skip comments
@@ -175,14 +527,20 @@ func extractPythonFromShebang(filename string) (string, error) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	return "", fmt.Errorf("shebang not found in the file")
+	return "", nil, fmt.Errorf("shebang not found in the file")
 }
 
 // execCmd executes a command and streams its output to STDOUT and STDERR
 func execCmd(name string, arg ...string) error {
+	return execCmdEnv(nil, name, arg...)
+}
+
+// execCmdEnv executes a command with the environment variables (in addition
+// to the ones of invenv) and streams its output to STDOUT and STDERR
+func execCmdEnv(env []string, name string, arg ...string) error {
 	// Disable output buffering, enable streaming
 	cmdOptions := cmd.Options{
 		Buffered:  false,
@@ -191,6 +549,10 @@ func execCmd(name string, arg ...string) error {
 
 	// Create Cmd with options
 	envCmd := cmd.NewCmdOptions(cmdOptions, name, arg...)
+	if len(env) > 0 {
+		envCmd.Env = append(os.Environ(), env...)
+	}
+	defer trackCmd(envCmd)()
 
 	// Print STDOUT and STDERR lines streaming from Cmd
 	doneChan := make(chan struct{})
@@ -220,13 +582,19 @@ func execCmd(name string, arg ...string) error {
 	// Wait for goroutine to print everything
 	<-doneChan
 	if status.Exit != 0 {
-		return fmt.Errorf("exit code: %d", status.Exit)
+		return &exitCodeError{code: status.Exit}
 	}
 	return nil
 }
 
 // execCmdSilent executes a command and does not stream its output to STDOUT and STDERR
 func execCmdSilent(name string, arg ...string) ([]string, error) {
+	return execCmdSilentEnv(nil, name, arg...)
+}
+
+// execCmdSilentEnv executes a command with the environment variables (in
+// addition to the ones of invenv) and does not stream its output
+func execCmdSilentEnv(env []string, name string, arg ...string) ([]string, error) {
 	// Disable output buffering, enable streaming
 	cmdOptions := cmd.Options{
 		CombinedOutput: true,
@@ -235,21 +603,127 @@ func execCmdSilent(name string, arg ...string) ([]string, error) {
 
 	// Create Cmd with options
 	envCmd := cmd.NewCmdOptions(cmdOptions, name, arg...)
+	if len(env) > 0 {
+		envCmd.Env = append(os.Environ(), env...)
+	}
+	defer trackCmd(envCmd)()
 
 	// Run and wait for Cmd to return, discard Status
 	status := <-envCmd.Start()
 
 	if status.Exit != 0 {
-		return status.Stdout, fmt.Errorf("exit code: %d", status.Exit)
+		return status.Stdout, &exitCodeError{code: status.Exit}
+	}
+	return nil, nil
+}
+
+// errCmdStalled is returned when the command was stopped because it didn't
+// produce any output for too long
+var errCmdStalled = fmt.Errorf("command stalled")
+
+// execCmdWatched executes a command and detects if it stalls: if no output is
+// produced within stallTimeout, a warning is printed and, if --abort-on-stall
+// is set, the command is stopped. If stream is true, the output is streamed to
+// STDERR, otherwise it is returned
+func execCmdWatched(stallTimeout time.Duration, stream bool, name string, arg ...string) ([]string, error) {
+	cmdOptions := cmd.Options{
+		Buffered:  false,
+		Streaming: true,
+	}
+
+	envCmd := cmd.NewCmdOptions(cmdOptions, name, arg...)
+	defer trackCmd(envCmd)()
+
+	var output []string
+	activityChan := make(chan struct{}, 1)
+	handleLine := func(line string) {
+		if stream {
+			loggerErr.Println(line)
+		} else {
+			output = append(output, line)
+		}
+		select {
+		case activityChan <- struct{}{}:
+		default:
+		}
+	}
+
+	doneChan := make(chan struct{})
+	go func() {
+		defer close(doneChan)
+		for envCmd.Stdout != nil || envCmd.Stderr != nil {
+			select {
+			case line, open := <-envCmd.Stdout:
+				if !open {
+					envCmd.Stdout = nil
+					continue
+				}
+				handleLine(line)
+			case line, open := <-envCmd.Stderr:
+				if !open {
+					envCmd.Stderr = nil
+					continue
+				}
+				handleLine(line)
+			}
+		}
+	}()
+
+	// Watchdog which is reset every time the command produces output
+	stalled := false
+	watchdogStop := make(chan struct{})
+	watchdogDone := make(chan struct{})
+	go func() {
+		defer close(watchdogDone)
+		timer := time.NewTimer(stallTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-watchdogStop:
+				return
+			case <-activityChan:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(stallTimeout)
+			case <-timer.C:
+				loggerErr.Printf("\nNo output from %s for %s, it may be stuck\n", path.Base(name), stallTimeout)
+				if flagAbortOnStall {
+					stalled = true
+					envCmd.Stop()
+					return
+				}
+				timer.Reset(stallTimeout)
+			}
+		}
+	}()
+
+	status := <-envCmd.Start()
+	<-doneChan
+	close(watchdogStop)
+	<-watchdogDone
+
+	if stalled {
+		return output, errCmdStalled
+	}
+	if status.Exit != 0 {
+		return output, &exitCodeError{code: status.Exit}
 	}
 	return nil, nil
 }
 
+// envVarArgRegexp matches arguments which set environment variables, see
+// organizeArgs
+var envVarArgRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
 // organizeArgs organizes the arguments in three groups:
 // - env variables
 // - script name
 // - script arguments
-func organizeArgs(args []string) ([]string, string, []string) {
+//
+// An argument before the script name which contains `=`, but isn't a valid
+// NAME=value pair or an existing script, is reported as an error
+func organizeArgs(args []string) ([]string, string, []string, error) {
 	var envVars []string
 	var scriptName string
 	var scriptArgs []string
@@ -257,7 +731,15 @@ func organizeArgs(args []string) ([]string, string, []string) {
 
 	for _, el := range args {
 		if !foundName && strings.Contains(el, "=") {
-			envVars = append(envVars, el)
+			if envVarArgRegexp.MatchString(el) {
+				envVars = append(envVars, el)
+				continue
+			}
+			if _, err := os.Stat(el); err != nil {
+				return nil, "", nil, fmt.Errorf("invalid environment variable %q: expected NAME=value, where NAME consists of letters, digits and underscores and doesn't start with a digit", el)
+			}
+			scriptName = el
+			foundName = true
 		} else if !foundName {
 			scriptName = el
 			foundName = true
@@ -265,19 +747,74 @@ func organizeArgs(args []string) ([]string, string, []string) {
 			scriptArgs = append(scriptArgs, el)
 		}
 	}
-	return envVars, scriptName, scriptArgs
+	return envVars, scriptName, scriptArgs, nil
 }
 
-// printProgress prints a progress message
+// printProgress prints a progress message. If STDERR is a terminal, the
+// message replaces the previous one, an empty message clears it
 func printProgress(s string) {
-	if !flagDebug {
-		if !flagSilent {
-			// Clear the line
-			fmt.Fprint(os.Stderr, "\033[2K\r")
-			fmt.Fprint(os.Stderr, CyanColor+s+ResetColor)
+	if flagSilent && !flagDebug {
+		return
+	}
+	if s != "" && useColor(os.Stderr) {
+		s = CyanColor + s + ResetColor
+	}
+	if !flagDebug && !flagShowInstall && !isJSONLog() && isTerminal(os.Stderr) {
+		// Clear the line
+		fmt.Fprint(os.Stderr, "\033[2K\r"+s)
+		return
+	}
+	// Every message is printed on its own line in debug mode, when the
+	// output of pip is streamed, when messages are JSON records and when
+	// STDERR is not a terminal (e.g. in CI logs)
+	if s != "" {
+		loggerErr.Println(s)
+	}
+}
+
+// showInstallOutput checks if the output of commands which create the virtual
+// environment and install requirements is streamed instead of buffered, see
+// --show-install
+func showInstallOutput() bool {
+	return flagDebug || flagShowInstall
+}
+
+// startProgressTimer periodically prints the progress message with the elapsed
+// time, so it is clear that invenv is not stuck during long operations. The
+// returned function stops the timer. Nothing is printed in debug and silent
+// modes
+func startProgressTimer(s string) func() {
+	if flagDebug || flagSilent {
+		return func() {}
+	}
+	if flagShowInstall || isJSONLog() || !isTerminal(os.Stderr) {
+		// The elapsed time would be mixed with the streamed output or
+		// printed on a new line every second
+		printProgress(s)
+		return func() {}
+	}
+
+	printProgress(s)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		start := time.Now()
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				printProgress(fmt.Sprintf("%s %s", s, time.Since(start).Round(time.Second)))
+			}
 		}
-	} else {
-		loggerErr.Println(CyanColor + s + ResetColor)
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
 	}
 }
 
@@ -297,10 +834,21 @@ func removeDir(dir string) error {
 	return nil
 }
 
-func getPythonVersion(pythonInterpreter string) (string, error) {
+func getPythonVersion(wrapper []string, pythonInterpreter string) (string, error) {
+	if flagPythonCheckCommand != "" {
+		return getPythonVersionWithCommand(wrapper, pythonInterpreter)
+	}
+	if len(wrapper) == 0 {
+		// The interpreter run with a wrapper isn't on the host, so its binary
+		// can't be checked for changes
+		if version := getCachedPythonVersion(pythonInterpreter); version != "" {
+			return version, nil
+		}
+	}
 	// Verify that the Python version used to create the virtual environment is the same
 	// as the current Python version
-	currentPythonVersion, err := exec.Command(pythonInterpreter, "--version").CombinedOutput()
+	name, args := wrapCommand(wrapper, pythonInterpreter, "--version")
+	currentPythonVersion, err := exec.Command(name, args...).CombinedOutput()
 	if err != nil {
 		return "", fmt.Errorf("failed to get Python version: %s", err)
 	}
@@ -308,9 +856,46 @@ func getPythonVersion(pythonInterpreter string) (string, error) {
 	if flagDebug {
 		loggerErr.Printf("Python interpreter %s has version %s\n", pythonInterpreter, currentPythonVersionStr)
 	}
+	if len(wrapper) == 0 {
+		cachePythonVersion(pythonInterpreter, currentPythonVersionStr)
+	}
 	return currentPythonVersionStr, nil
 }
 
+// getPythonVersionWithCommand gets the version of the Python interpreter with
+// the command from --python-check-command, e.g.
+// {interpreter} -c "import platform; print(platform.python_version())".
+// {interpreter} is replaced with the interpreter. The version printed by the
+// command is returned in the same format as python --version prints it
+func getPythonVersionWithCommand(wrapper []string, pythonInterpreter string) (string, error) {
+	words, err := splitCommandLine(flagPythonCheckCommand)
+	if err != nil || len(words) == 0 {
+		return "", fmt.Errorf("invalid --python-check-command %q", flagPythonCheckCommand)
+	}
+	for i, word := range words {
+		words[i] = strings.ReplaceAll(word, "{interpreter}", pythonInterpreter)
+	}
+
+	name, args := wrapCommand(wrapper, words[0], words[1:]...)
+	output, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get Python version with %s: %s", strings.Join(words, " "), err)
+	}
+	numbers, err := parsePythonVersion(string(output))
+	if err != nil {
+		return "", fmt.Errorf("failed to get Python version with %s: %s", strings.Join(words, " "), err)
+	}
+	parts := make([]string, len(numbers))
+	for i, number := range numbers {
+		parts[i] = strconv.Itoa(number)
+	}
+	version := "Python " + strings.Join(parts, ".")
+	if flagDebug {
+		loggerErr.Printf("Python interpreter %s has version %s\n", pythonInterpreter, version)
+	}
+	return version, nil
+}
+
 // getRequirementsFileForScript returns the requirements file for the script
 func getRequirementsFileForScript(scriptPath string, requirementsOverride string) (string, error) {
 	scriptPath, err := filepath.Abs(scriptPath)
@@ -320,24 +905,46 @@ func getRequirementsFileForScript(scriptPath string, requirementsOverride string
 
 	// Select requirements file. First check if the file provided in overrides exists
 	if requirementsOverride != "" {
+		if isRequirementsURL(requirementsOverride) {
+			explainRequirements("override", requirementsOverride)
+			requirementsFile, err := fetchRemoteRequirements(requirementsOverride)
+			if err != nil {
+				return "", err
+			}
+			explainRequirements("selected", requirementsFile)
+			return requirementsFile, nil
+		}
 		if !path.IsAbs(requirementsOverride) {
 			cwd, err := os.Getwd()
 			if err != nil {
 				return "", err
 			}
-			return path.Join(cwd, requirementsOverride), nil
-		} else {
-			return requirementsOverride, nil
+			requirementsOverride = path.Join(cwd, requirementsOverride)
 		}
+		explainRequirements("override", requirementsOverride)
+		explainRequirements("selected", requirementsOverride)
+		return requirementsOverride, nil
 	} else {
 		// Find suitable requirements file based on name patterns
 		scriptDir := path.Dir(scriptPath)
 		scriptFile := path.Base(scriptPath)
 		scriptFile = strings.TrimSuffix(scriptFile, ".py")
-		guesses := []string{
-			"requirements_" + scriptFile + ".txt",
-			scriptFile + "_requirements.txt",
-			"requirements.txt",
+		var guesses []string
+		if len(flagRequirementsOrder) > 0 {
+			for _, template := range flagRequirementsOrder {
+				guess := strings.ReplaceAll(template, "{name}", scriptFile)
+				guess = strings.ReplaceAll(guess, "{platform}", runtime.GOOS)
+				guesses = append(guesses, guess)
+			}
+		} else {
+			guesses = []string{
+				"requirements_" + scriptFile + ".txt",
+				scriptFile + "_requirements.txt",
+			}
+			if flagPlatformRequirements {
+				guesses = append(guesses, "requirements-"+runtime.GOOS+".txt")
+			}
+			guesses = append(guesses, "requirements.txt")
 		}
 
 		for _, guess := range guesses {
@@ -347,58 +954,354 @@ func getRequirementsFileForScript(scriptPath string, requirementsOverride string
 			}
 			_, err := os.Stat(possibleRequirementsFile)
 			if err == nil {
+				explainRequirements("found", possibleRequirementsFile)
+				explainRequirements("selected", possibleRequirementsFile)
 				return possibleRequirementsFile, nil
 			} else {
+				explainRequirements("missing", possibleRequirementsFile)
 				if flagDebug {
 					loggerErr.Println(err)
 				}
 			}
 		}
 	}
+	explainRequirements("selected", "")
 	return "", nil
 }
 
-// clearStaleEnvs removes stale virtual environments
-func clearStaleEnvs() error {
+// explainRequirements prints a machine-readable line about a requirements
+// file candidate when --explain-requirements is set. Each line has 3
+// tab-separated fields: "requirements", the status (override, found, missing
+// or selected) and the path. The path of the selected line is empty if no file
+// was selected
+func explainRequirements(status string, requirementsFile string) {
+	if !flagExplainRequirements {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "requirements\t%s\t%s\n", status, requirementsFile)
+}
+
+// getEnvironmentDir returns the directory where virtual environments are stored.
+// --env-dir takes precedence over INVENV_ENV_DIR, ~/.local/invenv is used if
+// neither is set
+func getEnvironmentDir() (string, error) {
+	envDir := flagEnvDir
+	if envDir == "" {
+		envDir = os.Getenv("INVENV_ENV_DIR")
+	}
+	if envDir != "" {
+		// Virtual environments are looked up by their absolute path, e.g. in
+		// the index, so the directory must not depend on the working directory
+		return filepath.Abs(envDir)
+	}
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		return err
+		return "", err
 	}
+	return path.Join(homeDir, EnvironmentsDir), nil
+}
 
-	envsDir := path.Join(homeDir, EnvironmentsDir)
-
-	entries, err := os.ReadDir(envsDir)
+// checkDirWritable checks if files can be created in the directory
+func checkDirWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".invenv-write-check-")
 	if err != nil {
 		return err
 	}
+	f.Close()
+	return os.Remove(f.Name())
+}
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			info, err := entry.Info()
-			if err != nil {
-				if flagDebug {
-					loggerErr.Println(err)
-				}
-				continue
-			}
-			if time.Since(info.ModTime()) > StaleEnvironmentTime {
-				staleEnvAbsPath := path.Join(envsDir, entry.Name())
-				if !isEnvLocked(staleEnvAbsPath) {
-					_, err := findProcessWithPrefix(staleEnvAbsPath)
-					if err == ErrNoProcessFound {
-						if flagDebug {
-							loggerErr.Printf("Removing stale virtual environment %s...\n", staleEnvAbsPath)
-						}
-						err = removeDir(staleEnvAbsPath)
-						if err != nil {
-							if flagDebug {
-								loggerErr.Println(err)
-							}
-						}
-					}
-				}
+// venvBinPath returns the path to the executable (e.g. python or pip) in the
+// virtual environment. On Windows executables are stored in the Scripts
+// directory and have the .exe suffix. Conda environments on Windows store
+// python.exe in the root of the environment
+func venvBinPath(envDir, exe string) string {
+	if runtime.GOOS == "windows" {
+		if _, err := os.Stat(filepath.Join(envDir, "conda-meta")); err == nil && exe == "python" {
+			return filepath.Join(envDir, exe+".exe")
+		}
+		return filepath.Join(envDir, "Scripts", exe+".exe")
+	}
+	return path.Join(envDir, "bin", exe)
+}
+
+// parseSize parses a human readable size like 512, 64KB or 10GB into bytes.
+// Units are powers of 1024
+func parseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"TB", 1 << 40},
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(str, unit.suffix) {
+			multiplier = unit.multiplier
+			str = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix))
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// parseAge parses a duration like 7d, 36h or 90m. In addition to the units
+// supported by time.ParseDuration, d (24 hours) is supported
+func parseAge(s string) (time.Duration, error) {
+	str := strings.TrimSpace(s)
+	if strings.HasSuffix(str, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(str, "d"), 64)
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	duration, err := time.ParseDuration(str)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return duration, nil
+}
+
+// getDirSize returns the total size of all files in the directory
+func getDirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// tryLockEnv atomically locks the virtual environment. It returns false if the
+// virtual environment is already locked. The lock file is locked with an
+// advisory lock which is held until unlockEnv, if supported, otherwise the
+// lock file must not exist
+func tryLockEnv(envDir string) (bool, error) {
+	lockFileName := generateLockFileName(envDir)
+	if err := os.MkdirAll(path.Dir(lockFileName), 0755); err != nil {
+		return false, err
+	}
+	if !flockSupported {
+		file, err := os.OpenFile(lockFileName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			if os.IsExist(err) {
+				return false, nil
 			}
+			return false, err
+		}
+		trackLock(envDir)
+		return true, file.Close()
+	}
+
+	for {
+		file, err := os.OpenFile(lockFileName, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return false, err
+		}
+		locked, err := flockFile(file, true)
+		if err != nil || !locked {
+			file.Close()
+			return false, err
 		}
+		// The previous holder could have removed the lock file after it was
+		// opened. Locking the removed file doesn't lock the virtual
+		// environment, so try again with the new one
+		openedInfo, err := file.Stat()
+		if err != nil {
+			funlockFile(file)
+			file.Close()
+			return false, err
+		}
+		currentInfo, err := os.Stat(lockFileName)
+		if err != nil || !os.SameFile(openedInfo, currentInfo) {
+			funlockFile(file)
+			file.Close()
+			continue
+		}
+
+		heldLockFiles.Lock()
+		heldLockFiles.files[envDir] = file
+		heldLockFiles.Unlock()
+		trackLock(envDir)
+		return true, nil
+	}
+}
+
+// isEnvStale checks if the virtual environment was not used for longer than
+// maxAge and no process uses it
+func isEnvStale(env *EnvIndexEntry, maxAge time.Duration) bool {
+	if time.Since(env.LastUsedAt) <= maxAge {
+		return false
+	}
+	_, err := findProcessWithPrefix(env.Dir)
+	return err == ErrNoProcessFound
+}
+
+// isEnvKept checks if the virtual environment must never be removed
+func isEnvKept(env *EnvIndexEntry, keep []string) bool {
+	for _, id := range keep {
+		if env.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// getStaleEnvironmentTime returns the time after which the virtual environment
+// is considered stale. --stale-after takes precedence over INVENV_STALE_AFTER,
+// StaleEnvironmentTime is used if neither is set
+func getStaleEnvironmentTime() (time.Duration, error) {
+	value, source := flagStaleAfter, "--stale-after"
+	if value == "" {
+		value, source = os.Getenv("INVENV_STALE_AFTER"), "INVENV_STALE_AFTER"
+	}
+	if value == "" {
+		return StaleEnvironmentTime, nil
+	}
+	staleAfter, err := parseAge(value)
+	if err != nil || staleAfter <= 0 {
+		return 0, fmt.Errorf("invalid %s value %q: expected a positive duration, e.g. 24h or 14d", source, value)
 	}
-	return err
+	return staleAfter, nil
+}
+
+// isCleanupDisabled checks if the automatic removal of stale virtual
+// environments is disabled with --no-cleanup or INVENV_NO_CLEANUP
+func isCleanupDisabled() bool {
+	if flagNoCleanup {
+		return true
+	}
+	disabled, err := strconv.ParseBool(os.Getenv("INVENV_NO_CLEANUP"))
+	return err == nil && disabled
+}
+
+// clearStaleEnvs removes virtual environments which were not used for longer
+// than the stale environment time (see getStaleEnvironmentTime) and returns
+// the number of removed ones. Virtual environments from keep_named in the
+// configuration file are not removed. It runs automatically before the
+// virtual environment is set up by the root command (unless --validate or
+// --plan-install is used), repl and tool commands. gc command removes stale
+// virtual environments explicitly and is not affected by --no-cleanup
+func clearStaleEnvs() (int, error) {
+	if isCleanupDisabled() {
+		if flagDebug {
+			loggerErr.Println("Automatic cleanup is disabled")
+		}
+		return 0, nil
+	}
+	staleAfter, err := getStaleEnvironmentTime()
+	if err != nil {
+		return 0, err
+	}
+
+	var keep []string
+	config, err := loadConfig()
+	if err != nil {
+		if flagDebug {
+			loggerErr.Println(err)
+		}
+	} else {
+		keep = config.GC.KeepNamed
+	}
+	return clearEnvsOlderThan(staleAfter, keep)
+}
+
+// clearEnvsOlderThan removes virtual environments which were not used for
+// longer than maxAge, except for the ones from keep, and returns the number of
+// removed ones
+func clearEnvsOlderThan(maxAge time.Duration, keep []string) (int, error) {
+	envs, err := listEnvs()
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Nothing was created yet
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	removed := 0
+	for _, env := range envs {
+		if isEnvKept(env, keep) || !isEnvStale(env, maxAge) || isEnvLocked(env.Dir) {
+			continue
+		}
+		if clearStaleEnv(env, maxAge) {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// clearStaleEnv removes the stale virtual environment. The virtual environment
+// is locked while it is removed, so it is not removed while it is being
+// created or reused by another process
+func clearStaleEnv(env *EnvIndexEntry, maxAge time.Duration) bool {
+	locked, err := tryLockEnv(env.Dir)
+	if err != nil || !locked {
+		if flagDebug && err != nil {
+			loggerErr.Println(err)
+		}
+		return false
+	}
+	defer unlockEnv(env.Dir)
+
+	// Another process could have used the virtual environment before the lock
+	// was acquired, so check again
+	if !isEnvStale(reloadEnvIndexEntry(env), maxAge) {
+		return false
+	}
+
+	if flagDebug {
+		loggerErr.Printf("Removing stale virtual environment %s...\n", env.Dir)
+	}
+	return removeCachedEnv(env.Dir)
+}
+
+// reloadEnvIndexEntry returns the current index entry of the virtual
+// environment. LastUsedAt is the later of the recorded time and the
+// modification time of its directory
+func reloadEnvIndexEntry(env *EnvIndexEntry) *EnvIndexEntry {
+	current := *env
+	if index, err := loadEnvIndex(); err == nil {
+		if entry, ok := index.Envs[env.Dir]; ok {
+			current = *entry
+		}
+	}
+	if info, err := os.Stat(current.Dir); err == nil && info.ModTime().After(current.LastUsedAt) {
+		current.LastUsedAt = info.ModTime()
+	}
+	return &current
+}
+
+// removeCachedEnv removes the virtual environment from the environments
+// directory and the index. The virtual environment must be locked by the caller
+func removeCachedEnv(envDir string) bool {
+	err := removeDir(envDir)
+	if err != nil {
+		if flagDebug {
+			loggerErr.Println(err)
+		}
+		return false
+	}
+	err = removeEnvFromIndex(envDir)
+	if err != nil && flagDebug {
+		loggerErr.Println(err)
+	}
+	return true
 }
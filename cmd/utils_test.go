@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetStaleEnvironmentTime(t *testing.T) {
+	defer func() { flagStaleAfter = "" }()
+	tests := []struct {
+		value    string
+		expected time.Duration
+		err      bool
+	}{
+		{"", StaleEnvironmentTime, false},
+		{"14d", 14 * 24 * time.Hour, false},
+		{"36h", 36 * time.Hour, false},
+		{"0.5d", 12 * time.Hour, false},
+		{"0h", 0, true},
+		{"2w", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			flagStaleAfter = test.value
+			t.Setenv("INVENV_STALE_AFTER", "")
+			got, err := getStaleEnvironmentTime()
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+)
+
+// Sources of requirements. By default requirements are installed with pip
+// from a requirements file
+const (
+	RequirementsSourcePip         = ""
+	RequirementsSourceUVLock      = "uv.lock"
+	RequirementsSourceUVProject   = "pyproject.toml"
+	RequirementsSourceInline      = "inline"
+	RequirementsSourceProject     = "project"
+	RequirementsSourcePipfile     = "Pipfile"
+	RequirementsSourcePipfileLock = "Pipfile.lock"
+	RequirementsSourcePoetryLock  = "poetry.lock"
+	RequirementsSourceConda       = "environment.yml"
+)
+
+// Backends which create virtual environments and install requirements
+const (
+	BackendAuto = "auto"
+	BackendPip  = "pip"
+	BackendUV   = "uv"
+	// BackendConda is selected by a conda environment file, not by --backend
+	BackendConda = "conda"
+)
+
+// resolveBackend returns the backend selected with --backend. In auto mode uv
+// is used if it is installed, otherwise venv (or virtualenv) and pip are used.
+// uv runs on the host, so it can't be used with an interpreter wrapper
+func resolveBackend(interpreterWrapper []string) (string, error) {
+	switch flagBackend {
+	case BackendPip:
+		return flagBackend, nil
+	case BackendUV:
+		if len(interpreterWrapper) > 0 {
+			return "", fmt.Errorf("%s backend doesn't support python interpreter wrappers", BackendUV)
+		}
+		return flagBackend, nil
+	case BackendAuto, "":
+		if len(interpreterWrapper) > 0 {
+			return BackendPip, nil
+		}
+		if _, err := exec.LookPath("uv"); err == nil {
+			return BackendUV, nil
+		}
+		return BackendPip, nil
+	default:
+		return "", fmt.Errorf("unsupported backend %q, expected %s, %s or %s", flagBackend, BackendAuto, BackendPip, BackendUV)
+	}
+}
+
+// detectUVProject checks if the directory is a uv project. A project with
+// uv.lock is installed from the lock file. A project with only pyproject.toml
+// is resolved from scratch, but only if no requirements file was found. uv
+// must be installed
+func detectUVProject(dir string, hasRequirementsFile bool) (string, string) {
+	if _, err := exec.LookPath("uv"); err != nil {
+		return "", ""
+	}
+
+	lockFile := path.Join(dir, "uv.lock")
+	if _, err := os.Stat(lockFile); err == nil {
+		if flagDebug {
+			loggerErr.Println("Found uv lock file: ", lockFile)
+		}
+		return RequirementsSourceUVLock, lockFile
+	}
+
+	if hasRequirementsFile {
+		return "", ""
+	}
+
+	pyprojectFile := path.Join(dir, "pyproject.toml")
+	if _, err := os.Stat(pyprojectFile); err == nil {
+		if flagDebug {
+			loggerErr.Println("Found uv project without lock file: ", pyprojectFile)
+		}
+		return RequirementsSourceUVProject, pyprojectFile
+	}
+	return "", ""
+}
+
+// getUVInstallCommand returns arguments and environment variables of the uv
+// command which installs requirements of a uv project in the virtual
+// environment
+func (s *Script) getUVInstallCommand() ([]string, []string, error) {
+	var args []string
+	var env []string
+
+	switch s.requirementsSource {
+	case RequirementsSourceUVLock:
+		// uv syncs the project environment, which is .venv in the project
+		// directory by default. The virtual environment may be built in a
+		// temporary directory (see buildEnvInTempDir) or created with
+		// --venv-dir, so it is selected explicitly
+		args = []string{"sync", "--frozen", "--project", path.Dir(s.RequirementsPath), "--python", venvBinPath(s.EnvDir, "python")}
+		env = []string{"UV_PROJECT_ENVIRONMENT=" + s.EnvDir}
+	case RequirementsSourceUVProject:
+		args = []string{"pip", "install", "--python", venvBinPath(s.EnvDir, "python"), "-r", s.RequirementsPath}
+		if s.refreshing {
+			args = append(args, "--upgrade")
+		}
+		if s.ConstraintsPath != "" {
+			args = append(args, "-c", s.ConstraintsPath)
+		}
+		args = append(args, flagPipArgs...)
+	default:
+		return nil, nil, fmt.Errorf("unsupported requirements source %q", s.requirementsSource)
+	}
+	args = append(args, getIndexArgs()...)
+	return args, env, nil
+}
+
+// installUVRequirements installs requirements of a uv project in the virtual
+// environment
+func (s *Script) installUVRequirements() error {
+	var output []string
+	args, env, err := s.getUVInstallCommand()
+	if err != nil {
+		return err
+	}
+
+	if showInstallOutput() {
+		err = execCmdEnv(env, "uv", args...)
+	} else {
+		output, err = execCmdSilentEnv(env, "uv", args...)
+	}
+	if err != nil {
+		printCommandFailure("Installing requirements", "uv", args, output, err)
+		return fmt.Errorf("failed to install requirements with uv: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUVLockInstallTargetsEnv(t *testing.T) {
+	// Virtual environments are built in a temporary directory and moved
+	// into place, so uv must install packages into it, not into .venv of
+	// the project
+	envDir := getTempEnvDir("/envs/abc.env")
+	script := &Script{
+		EnvDir:             envDir,
+		RequirementsPath:   "/project/uv.lock",
+		requirementsSource: RequirementsSourceUVLock,
+	}
+
+	args, env, err := script.getUVInstallCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedArgs := []string{"sync", "--frozen", "--project", "/project", "--python", venvBinPath(envDir, "python")}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("expected arguments %v, got %v", expectedArgs, args)
+	}
+	expectedEnv := []string{"UV_PROJECT_ENVIRONMENT=" + envDir}
+	if !reflect.DeepEqual(env, expectedEnv) {
+		t.Errorf("expected environment %v, got %v", expectedEnv, env)
+	}
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+)
+
+// validateOnly is set with --validate and --dry-run. The script is inspected
+// without network access and without starting processes other than the
+// interpreter's version check, so anything which needs them is refused
+var validateOnly bool
+
+// getEnvState describes the state of the script's virtual environment in the
+// cache without modifying it. deleteOldEnv is the value of --new-environment
+func (s *Script) getEnvState(deleteOldEnv bool) string {
+	_, err := os.Stat(s.EnvDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "missing, would be created"
+		}
+		return "unknown: " + err.Error()
+	}
+	if isEnvLocked(s.EnvDir) {
+		return "locked by another process, would wait for it"
+	}
+	if deleteOldEnv {
+		return "exists, would be recreated because of --new-environment"
+	}
+	if reason := s.checkEnvInfo(); reason != "" {
+		return "exists, would be recreated: " + reason
+	}
+	if s.isRefreshDue() {
+		return "exists, would be refreshed because of --refresh-interval"
+	}
+	return "exists, would be reused"
+}
+
+// validateScript checks everything which can be checked without network access
+// and building the virtual environment, and prints a report of what would
+// happen (used by --validate and --dry-run). The Python interpreter has already
+// been run by NewScript to get its version; no other processes are started
+func validateScript(s *Script, deleteOldEnv bool) error {
+	report := func(name string, value string) {
+		loggerOut.Printf("%-20s %s\n", name+":", value)
+	}
+
+	report("Script", s.AbsolutePath)
+	if s.backend == BackendConda {
+		report("Python interpreter", venvBinPath(s.EnvDir, "python"))
+	} else {
+		report("Python interpreter", s.PythonInterpreter)
+	}
+	report("Python version", s.pythonVersion)
+	report("Backend", s.backend)
+
+	if s.RequirementsPath == "" {
+		report("Requirements file", "none")
+	} else if s.requirementsSource == RequirementsSourceInline {
+		report("Requirements directive", strings.Join(s.requirementsList, ", "))
+		report("Requirements hash", s.requirementsHash)
+	} else if s.requirementsSource == RequirementsSourceProject {
+		report("Requirements file", s.RequirementsPath)
+		report("Project dependencies", strings.Join(s.requirementsList, ", "))
+		report("Requirements hash", s.requirementsHash)
+	} else if s.requirementsSource == RequirementsSourcePipfile || s.requirementsSource == RequirementsSourcePipfileLock || s.requirementsSource == RequirementsSourcePoetryLock {
+		report("Requirements file", s.RequirementsPath)
+		report("Locked packages", strings.Join(s.requirementsList, ", "))
+		report("Requirements hash", s.requirementsHash)
+	} else if s.requirementsSource != RequirementsSourcePip {
+		report("Requirements file", s.RequirementsPath)
+		report("Requirements hash", s.requirementsHash)
+	} else {
+		report("Requirements file", s.RequirementsPath)
+		files, err := collectRequirementFiles(s.RequirementsPath)
+		if err != nil {
+			report("Requirements", "invalid: "+err.Error())
+			return err
+		}
+		for _, f := range files[1:] {
+			report("Included file", f)
+		}
+		report("Requirements hash", s.requirementsHash)
+	}
+	if s.ConstraintsPath != "" {
+		report("Constraints file", s.ConstraintsPath)
+	}
+
+	report("Environment ID", s.venvID)
+	report("Environment", s.EnvDir)
+	report("Environment state", s.getEnvState(deleteOldEnv))
+	return nil
+}
@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// VEnvInfoYAMLFilename is the file in the virtual environment which describes
+// what it was built from, see VEnvInfo
+const VEnvInfoYAMLFilename = ".venv.info.yaml"
+
+// VEnvInfo describes what the virtual environment was built from. It is
+// verified before the virtual environment is reused, so a virtual environment
+// which doesn't match the script anymore is rebuilt even if its ID is the same.
+// The interpreter binary is described as well: a patched interpreter may
+// report the same version, but break native extensions
+type VEnvInfo struct {
+	RequirementsHash   string    `yaml:"requirements_hash"`
+	Interpreter        string    `yaml:"interpreter"`
+	PythonVersion      string    `yaml:"python_version"`
+	Variants           []string  `yaml:"variants,omitempty"`
+	InterpreterBinary  string    `yaml:"interpreter_binary,omitempty"`
+	InterpreterSize    int64     `yaml:"interpreter_size,omitempty"`
+	InterpreterModTime time.Time `yaml:"interpreter_mod_time,omitempty"`
+	InterpreterSHA256  string    `yaml:"interpreter_sha256,omitempty"`
+}
+
+// NewVEnvInfo returns the description of the virtual environment of the script
+func NewVEnvInfo(s *Script) *VEnvInfo {
+	return &VEnvInfo{
+		RequirementsHash: s.requirementsHash,
+		Interpreter:      s.PythonInterpreter,
+		PythonVersion:    s.pythonVersion,
+		Variants:         s.variants,
+	}
+}
+
+// getVenvInterpreterBinary returns the interpreter binary the virtual
+// environment was created from: the target of its python symlink. An empty
+// string is returned if the interpreter was copied into the virtual
+// environment (e.g. on Windows) and can't be traced back
+func getVenvInterpreterBinary(envDir string) (string, os.FileInfo, error) {
+	binary, err := filepath.EvalSymlinks(venvBinPath(envDir, "python"))
+	if err != nil {
+		return "", nil, err
+	}
+	resolvedEnvDir, err := filepath.EvalSymlinks(envDir)
+	if err != nil {
+		return "", nil, err
+	}
+	if strings.HasPrefix(binary, resolvedEnvDir+string(filepath.Separator)) {
+		return "", nil, nil
+	}
+	info, err := os.Stat(binary)
+	if err != nil {
+		return "", nil, err
+	}
+	return binary, info, nil
+}
+
+// getFileSHA256 returns the SHA-256 hash of the file content
+func getFileSHA256(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// describeInterpreterBinary adds the interpreter binary of the virtual
+// environment to the description. Interpreters which run with a wrapper are
+// not available on the host and are not described
+func (i *VEnvInfo) describeInterpreterBinary(s *Script) error {
+	if len(s.interpreterWrapper) > 0 {
+		return nil
+	}
+	binary, info, err := getVenvInterpreterBinary(s.EnvDir)
+	if err != nil || binary == "" {
+		return err
+	}
+	hash, err := getFileSHA256(binary)
+	if err != nil {
+		return err
+	}
+	i.InterpreterBinary = binary
+	i.InterpreterSize = info.Size()
+	i.InterpreterModTime = info.ModTime()
+	i.InterpreterSHA256 = hash
+	return nil
+}
+
+// saveVEnvInfo describes the virtual environment of the script and writes the
+// description to it. Failing to describe the interpreter binary is not fatal
+func (s *Script) saveVEnvInfo() error {
+	info := NewVEnvInfo(s)
+	err := info.describeInterpreterBinary(s)
+	if err != nil && flagDebug {
+		loggerErr.Printf("Failed to describe the interpreter binary: %s\n", err)
+	}
+	return info.Save(s.EnvDir)
+}
+
+// Save writes the description to the virtual environment
+func (i *VEnvInfo) Save(envDir string) error {
+	data, err := yaml.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(envDir, VEnvInfoYAMLFilename), data, 0644)
+}
+
+// loadVEnvInfo reads the description of the virtual environment. An error
+// satisfying os.IsNotExist is returned for virtual environments created by
+// older versions of invenv
+func loadVEnvInfo(envDir string) (*VEnvInfo, error) {
+	data, err := os.ReadFile(path.Join(envDir, VEnvInfoYAMLFilename))
+	if err != nil {
+		return nil, err
+	}
+	info := &VEnvInfo{}
+	err = yaml.Unmarshal(data, info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", VEnvInfoYAMLFilename, err)
+	}
+	return info, nil
+}
+
+// checkEnvInfoForUpdate verifies that the virtual environment can be updated
+// in place: only requirements may change. The interpreter, its version and
+// variants of the ID (e.g. --upgrade-deps or the constraints file) must be the
+// same as the ones the virtual environment was built with
+func (s *Script) checkEnvInfoForUpdate() error {
+	stored, err := loadVEnvInfo(s.EnvDir)
+	if err != nil {
+		return fmt.Errorf("virtual environment description is not available: %s", err)
+	}
+	current := NewVEnvInfo(s)
+	switch {
+	case stored.PythonVersion != current.PythonVersion:
+		return fmt.Errorf("Python version changed from %s to %s", stored.PythonVersion, current.PythonVersion)
+	case stored.Interpreter != current.Interpreter:
+		return fmt.Errorf("interpreter changed from %s to %s", stored.Interpreter, current.Interpreter)
+	case strings.Join(stored.Variants, "\n") != strings.Join(current.Variants, "\n"):
+		return fmt.Errorf("options of the virtual environment changed")
+	}
+	return nil
+}
+
+// checkEnvInfo compares the stored description of the virtual environment
+// with the current one and returns the reason why the virtual environment
+// must be rebuilt. An empty string is returned if it can be reused or it
+// doesn't have a description. Requirements are not compared if virtual
+// environments are shared on purpose: with --env-id-from and --resolve-for-id.
+// The interpreter binary is compared by size and modification time, its
+// content is hashed only with --verify
+func (s *Script) checkEnvInfo() string {
+	stored, err := loadVEnvInfo(s.EnvDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err.Error()
+		}
+		return ""
+	}
+	current := NewVEnvInfo(s)
+	switch {
+	case stored.PythonVersion != current.PythonVersion:
+		return fmt.Sprintf("Python version changed from %s to %s", stored.PythonVersion, current.PythonVersion)
+	case stored.Interpreter != current.Interpreter:
+		return fmt.Sprintf("interpreter changed from %s to %s", stored.Interpreter, current.Interpreter)
+	case stored.RequirementsHash != current.RequirementsHash && !s.customEnvID && !flagResolveForID:
+		return "requirements changed"
+	}
+	if stored.InterpreterBinary == "" || len(s.interpreterWrapper) > 0 {
+		return ""
+	}
+
+	binary, info, err := getVenvInterpreterBinary(s.EnvDir)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("interpreter binary is not available: %s", err)
+	case binary != stored.InterpreterBinary:
+		return fmt.Sprintf("interpreter binary changed from %s to %s", stored.InterpreterBinary, binary)
+	case info.Size() != stored.InterpreterSize || !info.ModTime().Equal(stored.InterpreterModTime):
+		return fmt.Sprintf("interpreter binary %s was modified", binary)
+	}
+	if flagVerify && stored.InterpreterSHA256 != "" {
+		hash, err := getFileSHA256(binary)
+		if err != nil {
+			return fmt.Sprintf("failed to hash interpreter binary %s: %s", binary, err)
+		}
+		if hash != stored.InterpreterSHA256 {
+			return fmt.Sprintf("content of interpreter binary %s changed", binary)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// PythonVersionCacheFilename is the name of the file in the environments
+// directory which stores versions of Python interpreters
+const PythonVersionCacheFilename = "python_versions.json"
+
+// PythonVersionCacheEntry is the version of the interpreter binary with the
+// modification time
+type PythonVersionCacheEntry struct {
+	ModTime time.Time `json:"mod_time"`
+	Version string    `json:"version"`
+}
+
+// pythonVersionCache caches versions within the process, keyed by the resolved
+// path of the interpreter
+var pythonVersionCache = map[string]*PythonVersionCacheEntry{}
+
+// getPythonVersionCacheKey returns the resolved path and the modification time
+// of the interpreter. ok is false if the version of the interpreter can't be
+// cached, e.g. pyenv and asdf shims select the interpreter on every run
+func getPythonVersionCacheKey(pythonInterpreter string) (string, time.Time, bool) {
+	interpreterPath, err := getInterpreterPath(nil, pythonInterpreter)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	if path.Base(path.Dir(filepath.ToSlash(interpreterPath))) == "shims" {
+		return "", time.Time{}, false
+	}
+	info, err := os.Stat(interpreterPath)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return interpreterPath, info.ModTime(), true
+}
+
+func getPythonVersionCacheFilename() (string, error) {
+	envsDir, err := getEnvironmentDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(envsDir, PythonVersionCacheFilename), nil
+}
+
+// loadPythonVersionCache reads the cache file. A missing or corrupted file
+// results in an empty cache
+func loadPythonVersionCache() map[string]*PythonVersionCacheEntry {
+	cache := map[string]*PythonVersionCacheEntry{}
+	cacheFilename, err := getPythonVersionCacheFilename()
+	if err != nil {
+		return cache
+	}
+	dataBytes, err := os.ReadFile(cacheFilename)
+	if err != nil {
+		return cache
+	}
+	err = json.Unmarshal(dataBytes, &cache)
+	if err != nil {
+		if flagDebug {
+			loggerErr.Printf("Corrupted Python version cache %s: %s\n", cacheFilename, err)
+		}
+		return map[string]*PythonVersionCacheEntry{}
+	}
+	return cache
+}
+
+// getCachedPythonVersion returns the cached version of the interpreter. An
+// empty string is returned if the interpreter binary changed since the version
+// was cached
+func getCachedPythonVersion(pythonInterpreter string) string {
+	key, modTime, ok := getPythonVersionCacheKey(pythonInterpreter)
+	if !ok {
+		return ""
+	}
+	entry, ok := pythonVersionCache[key]
+	if !ok {
+		entry, ok = loadPythonVersionCache()[key]
+		if !ok {
+			return ""
+		}
+	}
+	if !entry.ModTime.Equal(modTime) {
+		return ""
+	}
+	pythonVersionCache[key] = entry
+	if flagDebug {
+		loggerErr.Printf("Python interpreter %s has cached version %s\n", key, entry.Version)
+	}
+	return entry.Version
+}
+
+// cachePythonVersion stores the version of the interpreter. Failing to write
+// the cache is not fatal
+func cachePythonVersion(pythonInterpreter string, version string) {
+	key, modTime, ok := getPythonVersionCacheKey(pythonInterpreter)
+	if !ok {
+		return
+	}
+	entry := &PythonVersionCacheEntry{ModTime: modTime, Version: version}
+	pythonVersionCache[key] = entry
+
+	err := savePythonVersion(key, entry)
+	if err != nil && flagDebug {
+		loggerErr.Printf("Failed to update Python version cache: %s\n", err)
+	}
+}
+
+// savePythonVersion writes the entry to the cache file. The file is replaced
+// atomically so concurrent readers never see a partially written cache
+func savePythonVersion(key string, entry *PythonVersionCacheEntry) error {
+	cacheFilename, err := getPythonVersionCacheFilename()
+	if err != nil {
+		return err
+	}
+	cache := loadPythonVersionCache()
+	cache[key] = entry
+
+	dataBytes, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(path.Dir(cacheFilename), 0755)
+	if err != nil {
+		return err
+	}
+	tmpFilename := fmt.Sprintf("%s.tmp-%d", cacheFilename, os.Getpid())
+	err = os.WriteFile(tmpFilename, dataBytes, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, cacheFilename)
+}
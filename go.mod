@@ -6,6 +6,7 @@ require (
 	github.com/go-cmd/cmd v1.4.3
 	github.com/mattheath/base62 v0.0.0-20150408093626-b80cdc656a7a
 	github.com/spf13/cobra v1.8.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (